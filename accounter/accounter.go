@@ -21,8 +21,11 @@ package accounter
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
+	"fmt"
 	"math/big"
+	"sort"
 	"sync"
 
 	"github.com/pasl-project/pasl/crypto"
@@ -33,12 +36,16 @@ import (
 var emptyDigest = [sha256.Size]byte{}
 
 type Accounter struct {
-	hash       []byte
-	hashBuffer []byte
-	lock       sync.RWMutex
-	packs      packsMap
-	updated    packsMap
-	dirty      map[uint32]struct{}
+	hash          []byte
+	hashBuffer    []byte
+	lock          sync.RWMutex
+	packs         packsMap
+	updated       packsMap
+	keys          keysMap
+	dirty         map[uint32]struct{}
+	truncated     *uint32
+	journal       map[uint32]*PackBase
+	journalHeight uint32
 }
 
 type accounterSerialized struct {
@@ -54,6 +61,7 @@ func NewAccounter() *Accounter {
 		hashBuffer: make([]byte, 0),
 		packs:      newPacksMap(),
 		updated:    newPacksMap(),
+		keys:       newKeysMap(),
 		dirty:      make(map[uint32]struct{}),
 	}
 }
@@ -77,13 +85,11 @@ func (this *Accounter) ToBlob() []byte {
 
 	result := bytes.NewBuffer([]byte(""))
 
-	maxPack := this.getMaxPack()
-	if maxPack != nil {
-		for packIndex := uint32(0); packIndex <= *maxPack; packIndex++ {
-			pack := this.getPackUnsafe(packIndex)
-			result.Write(pack.ToBlob())
-			result.Write(pack.GetHash())
-		}
+	height := this.getHeightUnsafe()
+	for packIndex := uint32(0); packIndex < height; packIndex++ {
+		pack := this.getPackUnsafe(packIndex)
+		result.Write(pack.ToBlob())
+		result.Write(pack.GetHash())
 	}
 	return result.Bytes()
 }
@@ -119,6 +125,9 @@ func (a *Accounter) getHashUnsafe() []byte {
 }
 
 func (this *Accounter) getHeightUnsafe() uint32 {
+	if this.truncated != nil {
+		return *this.truncated
+	}
 	maxPack := this.getMaxPack()
 	if maxPack == nil {
 		return 0
@@ -131,9 +140,30 @@ func (a *Accounter) Merge() {
 	defer a.lock.Unlock()
 
 	a.updated.forEach(func(number uint32, pack *PackBase) {
-		a.packs.set(number, pack)
+		a.setPackUnsafe(number, pack)
 	})
 	a.updated = newPacksMap()
+	if a.truncated != nil {
+		a.deletePacksUnsafe(*a.truncated)
+		a.truncated = nil
+	}
+	a.journal = nil
+}
+
+// setPackUnsafe stores the merged pack and keeps the public keys index in sync
+func (a *Accounter) setPackUnsafe(number uint32, pack *PackBase) {
+	if previous := a.packs.get(number); previous != nil {
+		a.keys.remove(previous)
+	}
+	a.packs.set(number, pack)
+	a.keys.add(pack)
+}
+
+func (a *Accounter) deletePacksUnsafe(height uint32) {
+	for number := a.packs.getMax(); number != nil && *number >= height; number = a.packs.getMax() {
+		a.keys.remove(a.packs.get(*number))
+		a.packs.delete(*number)
+	}
 }
 
 func (a *Accounter) Rollback() {
@@ -144,6 +174,11 @@ func (a *Accounter) Rollback() {
 		a.dirty[number] = struct{}{}
 	})
 	a.updated = newPacksMap()
+	if a.truncated != nil {
+		a.dirty[*a.truncated] = struct{}{}
+		a.truncated = nil
+	}
+	a.journal = nil
 }
 
 func (this *Accounter) GetHeight() uint32 {
@@ -153,23 +188,27 @@ func (this *Accounter) GetHeight() uint32 {
 	return this.getHeightUnsafe()
 }
 
+// GetState takes the write lock as the hash of the dirty packs is computed and cached on demand
 func (this *Accounter) GetState() (uint32, []byte, *big.Int) {
-	this.lock.RLock()
-	defer this.lock.RUnlock()
+	this.lock.Lock()
+	defer this.lock.Unlock()
 
 	return this.getHeightUnsafe(), this.getHashUnsafe(), this.getCumulativeDifficultyUnsafe()
 }
 
 func (this *Accounter) getCumulativeDifficultyUnsafe() *big.Int {
-	max := this.getMaxPack()
-	if max == nil {
+	height := this.getHeightUnsafe()
+	if height == 0 {
 		return big.NewInt(0)
 	}
-	pack := this.getPackUnsafe(*max)
+	pack := this.getPackUnsafe(height - 1)
 	return pack.GetCumulativeDifficulty()
 }
 
 func (a *Accounter) getPackUnsafe(packNumber uint32) *PackBase {
+	if a.truncated != nil && packNumber >= *a.truncated {
+		return nil
+	}
 	if pack := a.updated.get(packNumber); pack != nil {
 		return pack
 	}
@@ -212,15 +251,42 @@ func (this *Accounter) GetAccountPackSerialized(index uint32) ([]byte, error) {
 	return pack.Marshal()
 }
 
+// GetPackHashes returns hashes of the packs in the range [from, to)
+func (a *Accounter) GetPackHashes(from uint32, to uint32) [][]byte {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	to = utils.MinUint32(to, a.getHeightUnsafe())
+	hashes := make([][]byte, 0, utils.MaxUint32(to, from)-from)
+	for index := from; index < to; index++ {
+		hash := make([]byte, sha256.Size)
+		copy(hash, a.getPackUnsafe(index).GetHash())
+		hashes = append(hashes, hash)
+	}
+	return hashes
+}
+
 func (a *Accounter) GetUpdatedPacks() []uint32 {
 	a.lock.RLock()
 	defer a.lock.RUnlock()
 
-	return a.updated.keys()
+	height := a.getHeightUnsafe()
+	updated := make([]uint32, 0, a.updated.len())
+	for _, number := range a.updated.keys() {
+		if number < height {
+			updated = append(updated, number)
+		}
+	}
+	return updated
 }
 
 func (a *Accounter) getPackForUpdateUnsafe(accountNumber uint32) (pack *PackBase, offset uint32) {
 	packNumber := accountNumber / uint32(defaults.AccountsPerBlock)
+	if a.journal != nil && packNumber < a.journalHeight {
+		if _, ok := a.journal[packNumber]; !ok {
+			a.journal[packNumber] = a.getPackUnsafe(packNumber).Copy()
+		}
+	}
 	pack = a.updated.get(packNumber)
 	if pack == nil {
 		pack = a.packs.get(packNumber).Copy()
@@ -235,6 +301,12 @@ func (a *Accounter) appendPackUnsafe(pack *PackBase) {
 	packNumber := a.getHeightUnsafe()
 	a.updated.set(packNumber, pack)
 	a.dirty[packNumber] = struct{}{}
+	if a.truncated != nil {
+		*a.truncated++
+		if *a.truncated > *a.getMaxPack() {
+			a.truncated = nil
+		}
+	}
 }
 
 func (this *Accounter) AppendPack(pack *PackBase) {
@@ -304,6 +376,7 @@ func (a *Accounter) Unmarshal(data []byte) (int, error) {
 	}
 
 	a.packs = newPacksMap()
+	a.keys = newKeysMap()
 	for each := range pod.Packs {
 		p := PackBase{}
 		p.FromPod(*pod.Packs[each])
@@ -313,3 +386,140 @@ func (a *Accounter) Unmarshal(data []byte) (int, error) {
 
 	return size, nil
 }
+
+// StartJournal begins recording the prior state of every existing pack modified until TakeJournal is called
+func (a *Accounter) StartJournal() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.journal = make(map[uint32]*PackBase)
+	a.journalHeight = a.getHeightUnsafe()
+}
+
+func (a *Accounter) TakeJournal() ([]byte, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	packs := make([]*PackPod, 0, len(a.journal))
+	for _, pack := range a.journal {
+		packs = append(packs, pack.Pod())
+	}
+	a.journal = nil
+
+	pod := &AccounterPod{
+		Packs: packs,
+	}
+	return pod.MarshalBinary()
+}
+
+// Undo reverts the top block using the journal recorded while the block was applied
+func (a *Accounter) Undo(index uint32, journal []byte) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	height := a.getHeightUnsafe()
+	if height != index+1 {
+		return fmt.Errorf("can't undo block %d at height %d", index, height)
+	}
+
+	pod := AccounterPod{}
+	if _, err := pod.Unmarshal(journal); err != nil {
+		return err
+	}
+
+	truncated := index
+	a.truncated = &truncated
+	a.dirty[index] = struct{}{}
+	for each := range pod.Packs {
+		pack := &PackBase{}
+		pack.FromPod(*pod.Packs[each])
+		if pack.index >= index {
+			return fmt.Errorf("invalid undo data for block %d, pack %d", index, pack.index)
+		}
+		a.updated.set(pack.index, pack)
+		a.dirty[pack.index] = struct{}{}
+	}
+
+	return nil
+}
+
+func (a *Accounter) MarshalPacks(indexes []uint32) ([]byte, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	packs := make([]*PackPod, 0, len(indexes))
+	for _, index := range indexes {
+		if pack := a.getPackUnsafe(index); pack != nil {
+			packs = append(packs, pack.Pod())
+		}
+	}
+	pod := &AccounterPod{
+		Packs: packs,
+	}
+	return pod.MarshalBinary()
+}
+
+// ApplyPacks overwrites packs with the serialized ones and drops everything at and above the specified height
+func (a *Accounter) ApplyPacks(data []byte, height uint32) error {
+	pod := AccounterPod{}
+	if _, err := pod.Unmarshal(data); err != nil {
+		return err
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	for each := range pod.Packs {
+		pack := &PackBase{}
+		pack.FromPod(*pod.Packs[each])
+		a.setPackUnsafe(pack.index, pack)
+		a.dirty[pack.index] = struct{}{}
+	}
+	a.deletePacksUnsafe(height)
+	a.dirty[height] = struct{}{}
+
+	if uint32(a.packs.len()) != height {
+		return fmt.Errorf("inconsistent packs, got %d expected %d", a.packs.len(), height)
+	}
+	return nil
+}
+
+// GetAccountsByPublicKey returns sorted numbers of the accounts owned by the public key.
+// Merged packs are looked up in the index, pending updates are scanned so rollbacks never touch the index.
+// The lookup is abandoned as soon as the context is done.
+func (a *Accounter) GetAccountsByPublicKey(ctx context.Context, public *crypto.Public) ([]uint32, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	done := ctx.Done()
+	height := a.getHeightUnsafe()
+	result := make([]uint32, 0)
+	for number := range a.keys.get(public) {
+		select {
+		case <-done:
+			return nil, ctx.Err()
+		default:
+		}
+		packNumber := number / defaults.AccountsPerBlock
+		if packNumber >= height || a.updated.get(packNumber) != nil {
+			continue
+		}
+		result = append(result, number)
+	}
+	a.updated.forEach(func(packNumber uint32, pack *PackBase) {
+		if packNumber >= height || ctx.Err() != nil {
+			return
+		}
+		for offset := range pack.accounts {
+			if pack.accounts[offset].IsPublicKeyEqual(public) {
+				result = append(result, pack.accounts[offset].GetNumber())
+			}
+		}
+	})
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+
+	return result, nil
+}
@@ -21,10 +21,12 @@ package accounter
 
 import (
 	"bytes"
+	"context"
 	"math/big"
 	"testing"
 
 	"github.com/pasl-project/pasl/crypto"
+	"github.com/pasl-project/pasl/defaults"
 )
 
 func TestSerialize(t *testing.T) {
@@ -52,3 +54,128 @@ func TestSerialize(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestUndo(t *testing.T) {
+	key, err := crypto.NewKeyByType(crypto.NIDsecp256k1)
+	if err != nil {
+		t.FailNow()
+	}
+
+	accounter := NewAccounter()
+	for each := uint32(0); each < 3; each++ {
+		accounter.NewPack(key.Public, 1, each, big.NewInt(3))
+	}
+	accounter.Merge()
+	_, hash, _ := accounter.GetState()
+
+	accounter.StartJournal()
+	accounter.NewPack(key.Public, 1, 3, big.NewInt(3))
+	accounter.BalanceAdd(0, 5, 3)
+	journal, err := accounter.TakeJournal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accounter.Merge()
+
+	if err := accounter.Undo(3, journal); err != nil {
+		t.Fatal(err)
+	}
+	height, undone, _ := accounter.GetState()
+	if height != 3 || !bytes.Equal(hash, undone) {
+		t.Fatalf("invalid state after undo, height %d", height)
+	}
+	if accounter.GetAccount(0).GetBalance() != 1 {
+		t.Fatalf("balance wasn't restored")
+	}
+
+	accounter.Merge()
+	if height, merged, _ := accounter.GetState(); height != 3 || !bytes.Equal(hash, merged) {
+		t.Fatalf("invalid state after merge, height %d", height)
+	}
+}
+
+func TestApplyPacks(t *testing.T) {
+	key, err := crypto.NewKeyByType(crypto.NIDsecp256k1)
+	if err != nil {
+		t.FailNow()
+	}
+
+	accounter := NewAccounter()
+	for each := uint32(0); each < 3; each++ {
+		accounter.NewPack(key.Public, 1, each, big.NewInt(3))
+	}
+	accounter.Merge()
+	base, err := accounter.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accounter.BalanceAdd(5, 7, 3)
+	accounter.NewPack(key.Public, 1, 3, big.NewInt(3))
+	accounter.Merge()
+	_, hash, _ := accounter.GetState()
+
+	delta, err := accounter.MarshalPacks([]uint32{1, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored := NewAccounter()
+	if _, err := restored.Unmarshal(base); err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.ApplyPacks(delta, 4); err != nil {
+		t.Fatal(err)
+	}
+	if height, restoredHash, _ := restored.GetState(); height != 4 || !bytes.Equal(hash, restoredHash) {
+		t.Fatalf("invalid state after applying packs, height %d", height)
+	}
+	if err := restored.ApplyPacks(delta, 5); err == nil {
+		t.Fatalf("inconsistent packs should be rejected")
+	}
+}
+
+func TestAccountsByPublicKey(t *testing.T) {
+	key, err := crypto.NewKeyByType(crypto.NIDsecp256k1)
+	if err != nil {
+		t.FailNow()
+	}
+	other, err := crypto.NewKeyByType(crypto.NIDsecp256k1)
+	if err != nil {
+		t.FailNow()
+	}
+
+	accounter := NewAccounter()
+	accounter.NewPack(key.Public, 1, 0, big.NewInt(3))
+	accounter.NewPack(key.Public, 1, 1, big.NewInt(3))
+	accounter.Merge()
+	if accounts, _ := accounter.GetAccountsByPublicKey(context.Background(), key.Public); len(accounts) != 2*int(defaults.AccountsPerBlock) {
+		t.Fatalf("unexpected accounts count %d", len(accounts))
+	}
+
+	accounter.KeyChange(0, other.Public, 1, 0)
+	accounter.NewPack(other.Public, 1, 2, big.NewInt(3))
+	if accounts, _ := accounter.GetAccountsByPublicKey(context.Background(), other.Public); len(accounts) != 1+int(defaults.AccountsPerBlock) || accounts[0] != 0 {
+		t.Fatalf("pending updates are not reflected %v", accounts)
+	}
+
+	accounter.Rollback()
+	if accounts, _ := accounter.GetAccountsByPublicKey(context.Background(), other.Public); len(accounts) != 0 {
+		t.Fatalf("rolled back updates are still reflected %v", accounts)
+	}
+
+	accounter.KeyChange(0, other.Public, 1, 0)
+	accounter.Merge()
+	if accounts, _ := accounter.GetAccountsByPublicKey(context.Background(), other.Public); len(accounts) != 1 || accounts[0] != 0 {
+		t.Fatalf("merged updates are not reflected %v", accounts)
+	}
+	if accounts, _ := accounter.GetAccountsByPublicKey(context.Background(), key.Public); len(accounts) != 2*int(defaults.AccountsPerBlock)-1 || accounts[0] != 1 {
+		t.Fatalf("stale index entries %v", accounts)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := accounter.GetAccountsByPublicKey(ctx, key.Public); err != context.Canceled {
+		t.Fatalf("canceled lookup should fail, got %v", err)
+	}
+}
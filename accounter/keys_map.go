@@ -0,0 +1,71 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package accounter
+
+import (
+	"github.com/pasl-project/pasl/crypto"
+	"github.com/pasl-project/pasl/utils"
+)
+
+// keysMap indexes account numbers of the merged packs by their public keys
+type keysMap struct {
+	accounts map[string]map[uint32]struct{}
+}
+
+func newKeysMap() keysMap {
+	return keysMap{
+		accounts: make(map[string]map[uint32]struct{}),
+	}
+}
+
+func keysMapKey(public *crypto.Public) string {
+	serialized := public.Serialized()
+	return string(utils.Serialize(&serialized))
+}
+
+func (k *keysMap) add(pack *PackBase) {
+	for offset := range pack.accounts {
+		account := &pack.accounts[offset]
+		key := keysMapKey(account.GetPublicKey())
+		numbers, ok := k.accounts[key]
+		if !ok {
+			numbers = make(map[uint32]struct{})
+			k.accounts[key] = numbers
+		}
+		numbers[account.GetNumber()] = struct{}{}
+	}
+}
+
+func (k *keysMap) remove(pack *PackBase) {
+	for offset := range pack.accounts {
+		account := &pack.accounts[offset]
+		key := keysMapKey(account.GetPublicKey())
+		if numbers, ok := k.accounts[key]; ok {
+			delete(numbers, account.GetNumber())
+			if len(numbers) == 0 {
+				delete(k.accounts, key)
+			}
+		}
+	}
+}
+
+func (k *keysMap) get(public *crypto.Public) map[uint32]struct{} {
+	return k.accounts[keysMapKey(public)]
+}
@@ -23,6 +23,7 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"encoding/binary"
+	"fmt"
 	"math/big"
 
 	"github.com/pasl-project/pasl/crypto"
@@ -185,3 +186,27 @@ func (p *PackBase) Unmarshal(data []byte) (int, error) {
 	p.FromPod(pod)
 	return size, nil
 }
+
+// UnmarshalPack decodes a pack received from an untrusted source, the serialized hash is discarded and recalculated
+func UnmarshalPack(data []byte) (*PackBase, error) {
+	pod := PackPod{}
+	if _, err := pod.Unmarshal(data); err != nil {
+		return nil, err
+	}
+	if uint32(len(pod.Accounts)) != defaults.AccountsPerBlock {
+		return nil, fmt.Errorf("invalid pack %d accounts count %d", pod.Index, len(pod.Accounts))
+	}
+	for _, account := range pod.Accounts {
+		if account == nil || account.PublicKey == nil {
+			return nil, fmt.Errorf("invalid pack %d account", pod.Index)
+		}
+		if err := crypto.PublicFromSerialized(&crypto.Public{}, account.PublicKey.TypeID, account.PublicKey.X, account.PublicKey.Y); err != nil {
+			return nil, fmt.Errorf("invalid pack %d account %d public key: %v", pod.Index, account.Number, err)
+		}
+	}
+
+	pack := &PackBase{}
+	pack.FromPod(pod)
+	pack.dirty = true
+	return pack, nil
+}
@@ -66,6 +66,19 @@ func (p *packsMap) set(number uint32, pack *PackBase) {
 	p.max = utils.MaxUint32(p.max, number)
 }
 
+func (p *packsMap) delete(number uint32) {
+	delete(p.packs, number)
+	if number != p.max {
+		return
+	}
+	for p.max > 0 {
+		p.max--
+		if _, ok := p.packs[p.max]; ok {
+			break
+		}
+	}
+}
+
 func (p *packsMap) getMax() *uint32 {
 	if len(p.packs) == 0 {
 		return nil
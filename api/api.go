@@ -7,6 +7,7 @@ import (
 	"errors"
 	"fmt"
 
+	"github.com/pasl-project/pasl/accounter"
 	"github.com/pasl-project/pasl/blockchain"
 	"github.com/pasl-project/pasl/crypto"
 	"github.com/pasl-project/pasl/network"
@@ -84,13 +85,17 @@ func (this *Api) GetAccount(_ context.Context, params *struct{ Account uint32 })
 	if account == nil {
 		return nil, errors.New("Not found")
 	}
+	return accountToNetwork(account), nil
+}
+
+func accountToNetwork(account *accounter.Account) *network.Account {
 	return &network.Account{
 		Account:    account.GetNumber(),
 		Balance:    float64(account.GetBalance()) / 10000,
 		EncPubkey:  hex.EncodeToString(utils.Serialize(account.GetPublicKeySerialized())),
 		NOperation: account.GetOperationsCount(),
 		UpdatedB:   account.GetUpdatedIndex(),
-	}, nil
+	}
 }
 
 func txToNetwork(meta *tx.TxMetadata, transaction tx.CommonOperation) network.Operation {
@@ -200,12 +205,17 @@ func (this *Api) GetBlockOperations(_ context.Context, params *struct{ Block uin
 	return result, nil
 }
 
-func (this *Api) GetPubKeyAccounts(_ context.Context, params *struct{ B58_pubkey string }) ([]uint32, error) {
+func (this *Api) GetPubKeyAccounts(ctx context.Context, params *struct {
+	B58_pubkey string
+	Start      uint32
+	Max        uint32
+}) ([]uint32, error) {
 	public, err := crypto.PublicFromBase58(params.B58_pubkey)
 	if err != nil {
 		return nil, err
 	}
-	return this.blockchain.GetAccountsByPublicKey(public), nil
+
+	return this.blockchain.GetAccountsByPublicKey(ctx, public, params.Start, params.Max)
 }
 
 func (a *Api) GetBlockTemplate(_ context.Context, params *struct {
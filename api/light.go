@@ -0,0 +1,42 @@
+package api
+
+import (
+	"context"
+	"errors"
+
+	"github.com/pasl-project/pasl/accounter"
+	"github.com/pasl-project/pasl/network"
+)
+
+// AccountsSource provides the account states cross-checked with the peers
+type AccountsSource interface {
+	GetAccounts(ctx context.Context, numbers []uint32) ([]*accounter.Account, error)
+}
+
+// LightApi serves the account queries of the light wallet mode, it keeps no safebox and relays the queries to the peers
+type LightApi struct {
+	source AccountsSource
+}
+
+func NewLightApi(source AccountsSource) *LightApi {
+	return &LightApi{
+		source: source,
+	}
+}
+
+func (a *LightApi) GetHandlers() map[string]interface{} {
+	return map[string]interface{}{
+		"getaccount": a.GetAccount,
+	}
+}
+
+func (a *LightApi) GetAccount(ctx context.Context, params *struct{ Account uint32 }) (*network.Account, error) {
+	accounts, err := a.source.GetAccounts(ctx, []uint32{params.Account})
+	if err != nil {
+		return nil, err
+	}
+	if accounts[0] == nil {
+		return nil, errors.New("Not found")
+	}
+	return accountToNetwork(accounts[0]), nil
+}
@@ -21,13 +21,14 @@ package blockchain
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"math"
 	"math/big"
 	"sort"
 	"sync"
-	"time"
 
 	"github.com/pasl-project/pasl/accounter"
 	"github.com/pasl-project/pasl/common"
@@ -44,35 +45,47 @@ import (
 var (
 	ErrInvalidOrder    = errors.New("Unexpected block index")
 	ErrFutureTimestamp = errors.New("Block time is too far in the future")
+	ErrPastTimestamp   = errors.New("Block time is older than the median time of the previous blocks")
 	ErrParentNotFound  = errors.New("Parent block not found")
+
+	errUndoUnavailable = errors.New("Undo data is not available")
 )
 
 type NewSafeboxCallback func(accounter *accounter.Accounter) safebox.SafeboxBase
 
 type Blockchain struct {
-	txPool              *iterator.Items
-	storage             storage.Storage
-	safebox             safebox.SafeboxBase
-	lock                sync.RWMutex
-	target              common.TargetBase
-	blocksSinceSnapshot uint32
-	BlocksUpdates       chan safebox.SerializedBlock
-	TxPoolUpdates       chan tx.CommonOperation
-	newSafeboxCallback  NewSafeboxCallback
-	prevSafeboxHash     []byte
+	txPool               *iterator.Items
+	storage              storage.Storage
+	safebox              safebox.SafeboxBase
+	clock                common.Clock
+	lock                 sync.RWMutex
+	target               common.TargetBase
+	blocksSinceSnapshot  uint32
+	snapshotPolicy       SnapshotPolicy
+	snapshotBase         *uint32
+	changedSinceSnapshot map[uint32]struct{}
+	BlocksUpdates        chan safebox.SerializedBlock
+	TxPoolUpdates        chan tx.CommonOperation
+	newSafeboxCallback   NewSafeboxCallback
+	prevSafeboxHash      []byte
+	served               *accounter.Accounter
+	servedLock           sync.Mutex
+	historyStart         uint32
 }
 
 type blockInfo struct {
 	meta         *safebox.BlockMetadata
 	affectedByTx map[*accounter.Account]map[uint32]uint32
+	undo         []byte
 }
 
-func NewBlockchain(fn NewSafeboxCallback, s storage.Storage, height *uint32) (*Blockchain, error) {
+func NewBlockchain(fn NewSafeboxCallback, s storage.Storage, height *uint32, clock common.Clock, policy SnapshotPolicy) (*Blockchain, error) {
 	accounter := accounter.NewAccounter()
 	var topBlock *safebox.BlockMetadata
 	var err error
 
 	restore := false
+	from := uint32(0)
 	if height == nil {
 		if topBlock, err = load(s, accounter); err == storage.ErrSafeboxInconsistent {
 			utils.Tracef("Restoring blockchain, will take a while")
@@ -90,13 +103,27 @@ func NewBlockchain(fn NewSafeboxCallback, s storage.Storage, height *uint32) (*B
 		return common.NewTarget(defaults.MinTarget)
 	}
 
-	blockchain := newBlockchain(fn, s, accounter, getPrevTarget())
+	blockchain := newBlockchain(fn, s, accounter, getPrevTarget(), clock, policy)
 
 	if !restore && height == nil {
 		return blockchain, nil
 	}
 
-	if err = s.LoadBlocks(height, func(index uint32, data []byte) error {
+	target := uint32(math.MaxUint32)
+	if height != nil {
+		target = *height
+	}
+	if snapshot, err := blockchain.LoadNearestSnapshot(target); err == nil && snapshot.GetHeight() > 0 {
+		from = snapshot.GetHeight()
+		parent, err := blockchain.GetBlock(from - 1)
+		if err != nil {
+			return nil, err
+		}
+		utils.Tracef("Starting from snapshot at height %d", from)
+		blockchain = newBlockchain(fn, s, snapshot, parent.GetTarget(), clock, policy)
+	}
+
+	if err = s.LoadBlocks(from, height, func(index uint32, data []byte) error {
 		var blockMeta safebox.BlockMetadata
 		if err := utils.Deserialize(&blockMeta, bytes.NewBuffer(data)); err != nil {
 			return err
@@ -113,34 +140,56 @@ func NewBlockchain(fn NewSafeboxCallback, s storage.Storage, height *uint32) (*B
 	}
 	blockchain.safebox.Merge()
 	if restore {
-		blockchain.flushPacks(blockchain.safebox.GetUpdatedPacks())
+		packs := make([]uint32, blockchain.safebox.GetHeight())
+		for index := range packs {
+			packs[index] = uint32(index)
+		}
+		if err := blockchain.flushPacks(packs); err != nil {
+			return nil, err
+		}
 	}
 
 	return blockchain, nil
 }
 
-func newBlockchain(fn NewSafeboxCallback, s storage.Storage, accounter *accounter.Accounter, target common.TargetBase) *Blockchain {
+func newBlockchain(fn NewSafeboxCallback, s storage.Storage, accounter *accounter.Accounter, target common.TargetBase, clock common.Clock, policy SnapshotPolicy) *Blockchain {
 	safeboxInstance := fn(accounter)
 	nextTarget := safeboxInstance.GetFork().GetNextTarget(target, safeboxInstance.GetLastTimestamps)
 
 	_, safeboxHash, _ := safeboxInstance.GetState()
 
 	blockchain := &Blockchain{
-		blocksSinceSnapshot: 0,
-		safebox:             safeboxInstance,
-		storage:             s,
-		target:              common.NewTarget(nextTarget),
-		txPool:              iterator.New(),
-		BlocksUpdates:       make(chan safebox.SerializedBlock),
-		TxPoolUpdates:       make(chan tx.CommonOperation),
-		newSafeboxCallback:  fn,
-		prevSafeboxHash:     make([]byte, len(safeboxHash)),
+		blocksSinceSnapshot:  0,
+		safebox:              safeboxInstance,
+		storage:              s,
+		clock:                clock,
+		snapshotPolicy:       policy,
+		changedSinceSnapshot: make(map[uint32]struct{}),
+		target:               common.NewTarget(nextTarget),
+		txPool:               iterator.New(),
+		BlocksUpdates:        make(chan safebox.SerializedBlock),
+		TxPoolUpdates:        make(chan tx.CommonOperation),
+		newSafeboxCallback:   fn,
+		prevSafeboxHash:      make([]byte, len(safeboxHash)),
+		historyStart:         historyStart(s, safeboxInstance.GetHeight()),
 	}
 	copy(blockchain.prevSafeboxHash, safeboxHash)
 
 	return blockchain
 }
 
+// historyStart finds the first block stored, the blocks preceding the imported safebox are missing after a fast sync
+func historyStart(s storage.Storage, height uint32) uint32 {
+	if _, err := s.GetBlock(0); err == nil || height == 0 {
+		return 0
+	}
+	// the stored blocks are contiguous up to the top one
+	return uint32(sort.Search(int(height), func(index int) bool {
+		_, err := s.GetBlock(uint32(index))
+		return err == nil
+	}))
+}
+
 func load(storage storage.Storage, accounterInstance *accounter.Accounter) (topBlock *safebox.BlockMetadata, err error) {
 	height, err := storage.Load(func(index uint32, data []byte) error {
 		var pack accounter.PackBase
@@ -178,7 +227,7 @@ func load(storage storage.Storage, accounterInstance *accounter.Accounter) (topB
 }
 
 func (b *Blockchain) addBlock(target common.TargetBase, block safebox.BlockBase) (common.TargetBase, map[*accounter.Account]map[uint32]uint32, error) {
-	if block.GetTimestamp() > uint32(time.Now().Unix())+defaults.MaxBlockTimeOffset {
+	if block.GetTimestamp() > b.clock.Now()+defaults.MaxBlockTimeOffset {
 		return nil, nil, ErrFutureTimestamp
 	}
 
@@ -193,12 +242,12 @@ func (b *Blockchain) addBlock(target common.TargetBase, block safebox.BlockBase)
 	}
 
 	if block.GetIndex() > 0 {
-		lastTimestamps := b.safebox.GetLastTimestamps(1)
+		lastTimestamps := b.safebox.GetLastTimestamps(defaults.MedianTimeBlocks)
 		if len(lastTimestamps) == 0 {
 			return nil, nil, errors.New("Failed to get recent blocks timestamps")
 		}
-		if block.GetTimestamp() < lastTimestamps[0] {
-			return nil, nil, errors.New("Invalid timestamp")
+		if block.GetTimestamp() < common.MedianTimestamp(lastTimestamps) {
+			return nil, nil, ErrPastTimestamp
 		}
 	}
 	if err := b.safebox.GetFork().CheckBlock(target, block); err != nil {
@@ -221,6 +270,20 @@ func (b *Blockchain) addBlock(target common.TargetBase, block safebox.BlockBase)
 	return newTarget, affectedByTx, nil
 }
 
+func blockMetadata(block *safebox.SerializedBlock) *safebox.BlockMetadata {
+	return &safebox.BlockMetadata{
+		Index:           block.Header.Index,
+		Miner:           block.Header.Miner,
+		Version:         block.Header.Version,
+		Timestamp:       block.Header.Time,
+		Target:          block.Header.Target,
+		Nonce:           block.Header.Nonce,
+		Payload:         block.Header.Payload,
+		PrevSafeBoxHash: block.Header.PrevSafeboxHash,
+		Operations:      block.Operations,
+	}
+}
+
 func (this *Blockchain) processNewBlocksUnsafe(blocks []safebox.SerializedBlock, preSave *func(safebox.SafeboxBase) error) error {
 	currentTarget := this.target
 	affectedByBlocks := make(map[safebox.BlockBase]blockInfo)
@@ -228,17 +291,7 @@ func (this *Blockchain) processNewBlocksUnsafe(blocks []safebox.SerializedBlock,
 
 	var affectedByTx map[*accounter.Account]map[uint32]uint32
 	for _, blockSerialized := range blocks {
-		meta := &safebox.BlockMetadata{
-			Index:           blockSerialized.Header.Index,
-			Miner:           blockSerialized.Header.Miner,
-			Version:         blockSerialized.Header.Version,
-			Timestamp:       blockSerialized.Header.Time,
-			Target:          blockSerialized.Header.Target,
-			Nonce:           blockSerialized.Header.Nonce,
-			Payload:         blockSerialized.Header.Payload,
-			PrevSafeBoxHash: blockSerialized.Header.PrevSafeboxHash,
-			Operations:      blockSerialized.Operations,
-		}
+		meta := blockMetadata(&blockSerialized)
 		block, err := safebox.NewBlock(meta)
 		if err != nil {
 			return err
@@ -249,10 +302,15 @@ func (this *Blockchain) processNewBlocksUnsafe(blocks []safebox.SerializedBlock,
 		if err != nil {
 			return err
 		}
+		undo, err := this.safebox.TakeUndo()
+		if err != nil {
+			return err
+		}
 
 		affectedByBlocks[block] = blockInfo{
 			meta:         meta,
 			affectedByTx: affectedByTx,
+			undo:         undo,
 		}
 	}
 
@@ -278,6 +336,14 @@ func (this *Blockchain) processNewBlocksUnsafe(blocks []safebox.SerializedBlock,
 			if err := s.StoreBlock(ctx, block.GetIndex(), utils.Serialize(blockInfo.meta)); err != nil {
 				return err
 			}
+			if err := s.StoreUndo(ctx, block.GetIndex(), blockInfo.undo); err != nil {
+				return err
+			}
+			if block.GetIndex() >= defaults.MaxUndoBlocks {
+				if err := s.DropUndo(ctx, block.GetIndex()-defaults.MaxUndoBlocks); err != nil {
+					return err
+				}
+			}
 
 			operations := block.GetOperations()
 			txIDBytTxIndex := make(map[uint32]uint64)
@@ -307,25 +373,23 @@ func (this *Blockchain) processNewBlocksUnsafe(blocks []safebox.SerializedBlock,
 			}
 		}
 
-		this.blocksSinceSnapshot += uint32(len(affectedByBlocks))
-		if this.blocksSinceSnapshot > defaults.MaxAltChainLength/2 {
-			height := this.safebox.GetHeight()
-
-			snapshots := this.storage.ListSnapshots()
-			sort.Slice(snapshots, func(i, j int) bool { return snapshots[i] > snapshots[j] })
-			for index := 1; index < len(snapshots); index++ {
-				s.DropSnapshot(ctx, snapshots[index])
+		if err := s.Truncate(ctx, this.safebox.GetHeight()); err != nil {
+			return err
+		}
+		if len(blocks) > 0 {
+			if err := this.dropSnapshotsAboveUnsafe(s, ctx, blocks[0].Header.Index); err != nil {
+				return err
 			}
+		}
 
-			buffer, err := this.safebox.SerializeAccounter()
-			if err == nil {
-				if err := s.StoreSnapshot(ctx, height, buffer); err != nil {
-					return err
-				}
-			} else {
-				return fmt.Errorf("failed to serialize accounter: %v", err)
+		for _, packIndex := range updatedPacks {
+			this.changedSinceSnapshot[packIndex] = struct{}{}
+		}
+		this.blocksSinceSnapshot += uint32(len(affectedByBlocks))
+		if this.blocksSinceSnapshot > this.snapshotPolicy.Interval {
+			if err := this.storeSnapshotUnsafe(s, ctx); err != nil {
+				return err
 			}
-
 			this.blocksSinceSnapshot = 0
 		}
 
@@ -368,37 +432,66 @@ func (b *Blockchain) ProcessNewBlock(block safebox.SerializedBlock, broadcast bo
 	return err
 }
 
-func (this *Blockchain) LoadSnapshot(height uint32) (*accounter.Accounter, error) {
-	buffer := this.storage.LoadSnapshot(height)
-	if buffer == nil {
-		return nil, fmt.Errorf("failed to load snapshot %d", height)
-	}
-	snapshot := accounter.NewAccounter()
-	_, err := snapshot.Unmarshal(buffer)
-	if err != nil {
-		return nil, fmt.Errorf("failed to deserialize snapshot %d", height)
+func cumulativeDifficultyCheck(currentCumulativeDifficulty *big.Int) func(safebox.SafeboxBase) error {
+	return func(altSafebox safebox.SafeboxBase) error {
+		_, _, cumulativeDifficulty := altSafebox.GetState()
+		if currentCumulativeDifficulty.Cmp(cumulativeDifficulty) >= 0 {
+			return fmt.Errorf("cumulative difficulty: main chain %s >= %s alt chain", currentCumulativeDifficulty.String(), cumulativeDifficulty.String())
+		}
+		return nil
 	}
-	return snapshot, nil
 }
 
-func (this *Blockchain) LoadNearestSnapshot(targetHeight uint32) (*accounter.Accounter, error) {
-	found := false
-	height := uint32(0)
-	for _, snapshotHeight := range this.storage.ListSnapshots() {
-		if snapshotHeight > targetHeight {
-			continue
-		}
-		if !found || snapshotHeight > height {
-			found = true
-			height = snapshotHeight
+// reorganizeUnsafe disconnects main chain blocks down to the fork point using stored undo data
+// and connects the alternate chain on top, the main chain is left intact on failure
+func (this *Blockchain) reorganizeUnsafe(blocks []safebox.SerializedBlock) error {
+	forkHeight := blocks[0].Header.Index
+	height, _, currentCumulativeDifficulty := this.safebox.GetState()
+	if forkHeight == 0 || forkHeight > height || height-forkHeight > defaults.MaxUndoBlocks {
+		return errUndoUnavailable
+	}
+
+	undo := make([][]byte, 0, height-forkHeight)
+	for index := height; index > forkHeight; index-- {
+		data := this.storage.LoadUndo(index - 1)
+		if data == nil {
+			return errUndoUnavailable
 		}
+		undo = append(undo, data)
 	}
 
-	if !found {
-		return nil, fmt.Errorf("no matching snapshots")
+	parent, err := this.GetBlock(forkHeight - 1)
+	if err != nil {
+		return err
+	}
+
+	fork := this.safebox.GetFork()
+	target := this.target
+
+	this.safebox.Rollback()
+	err = func() error {
+		for each := range undo {
+			if err := this.safebox.Undo(height-1-uint32(each), undo[each]); err != nil {
+				return err
+			}
+		}
+		this.target = common.NewTarget(this.safebox.GetFork().GetNextTarget(parent.GetTarget(), this.safebox.GetLastTimestamps))
+
+		check := cumulativeDifficultyCheck(currentCumulativeDifficulty)
+		return this.processNewBlocksUnsafe(blocks, &check)
+	}()
+	if err != nil {
+		this.safebox.Rollback()
+		this.safebox.SetFork(fork)
+		this.target = target
+		return err
 	}
 
-	return this.LoadSnapshot(height)
+	this.safebox.Merge()
+	_, safeboxHash, _ := this.safebox.GetState()
+	copy(this.prevSafeboxHash, safeboxHash)
+
+	return nil
 }
 
 func (this *Blockchain) AddAlternateChain(blocks []safebox.SerializedBlock) error {
@@ -406,6 +499,15 @@ func (this *Blockchain) AddAlternateChain(blocks []safebox.SerializedBlock) erro
 		return nil
 	}
 
+	// the alternate chain is usually downloaded starting below the fork point, skipping the blocks we already have
+	for len(blocks) > 1 {
+		mainBlock, err := this.GetBlock(blocks[1].Header.Index)
+		if err != nil || !bytes.Equal(mainBlock.GetPrevSafeBoxHash(), blocks[1].Header.PrevSafeboxHash) {
+			break
+		}
+		blocks = blocks[1:]
+	}
+
 	{
 		header := blocks[0].Header
 		mainBlock, err := this.GetBlock(header.Index)
@@ -417,6 +519,23 @@ func (this *Blockchain) AddAlternateChain(blocks []safebox.SerializedBlock) erro
 		}
 	}
 
+	if err := func() error {
+		this.lock.Lock()
+		defer this.lock.Unlock()
+
+		err := this.reorganizeUnsafe(blocks)
+		if err == nil {
+			this.txPoolApplyAndInvalidateUnsafe()
+		}
+		return err
+	}(); err != errUndoUnavailable {
+		if err != nil {
+			utils.Tracef("rejected alt chain: %v", err)
+		}
+		return err
+	}
+	utils.Tracef("Undo data is not available, restoring alt chain from the nearest snapshot")
+
 	snapshot, err := this.LoadNearestSnapshot(blocks[0].Header.Index)
 	if err != nil {
 		return fmt.Errorf("failed to find nearest snapshot: %v", err)
@@ -428,7 +547,7 @@ func (this *Blockchain) AddAlternateChain(blocks []safebox.SerializedBlock) erro
 		return err
 	}
 
-	newBlockchain := newBlockchain(this.newSafeboxCallback, this.storage, snapshot, mainBlock.GetTarget())
+	newBlockchain := newBlockchain(this.newSafeboxCallback, this.storage, snapshot, mainBlock.GetTarget(), this.clock, this.snapshotPolicy)
 	currentTarget := newBlockchain.target
 	for index := snapshotHeight; index < blocks[0].Header.Index; index++ {
 		block, err := this.GetBlock(index)
@@ -446,16 +565,9 @@ func (this *Blockchain) AddAlternateChain(blocks []safebox.SerializedBlock) erro
 	this.lock.Lock()
 	defer this.lock.Unlock()
 
-	cumulativeDifficultyCheck := func(altSafebox safebox.SafeboxBase) error {
-		_, _, cumulativeDifficulty := altSafebox.GetState()
-		_, _, currentCumulativeDifficulty := this.GetState()
-		if currentCumulativeDifficulty.Cmp(cumulativeDifficulty) >= 0 {
-			return fmt.Errorf("cumulative difficulty: main chain %s >= %s alt chain", currentCumulativeDifficulty.String(), cumulativeDifficulty.String())
-		}
-		return nil
-	}
-
-	if err := newBlockchain.ProcessNewBlocks(blocks, &cumulativeDifficultyCheck); err != nil {
+	_, _, currentCumulativeDifficulty := this.GetState()
+	check := cumulativeDifficultyCheck(currentCumulativeDifficulty)
+	if err := newBlockchain.ProcessNewBlocks(blocks, &check); err != nil {
 		utils.Tracef("rejected alt chain: %v", err)
 		return err
 	}
@@ -464,6 +576,10 @@ func (this *Blockchain) AddAlternateChain(blocks []safebox.SerializedBlock) erro
 
 	this.safebox = newBlockchain.safebox
 	this.target = newBlockchain.target
+	copy(this.prevSafeboxHash, newBlockchain.prevSafeboxHash)
+	// the packs changed by the alternate chain aren't tracked since the last snapshot, the next one has to be full
+	this.snapshotBase = nil
+	this.changedSinceSnapshot = make(map[uint32]struct{})
 
 	return nil
 }
@@ -482,7 +598,7 @@ func (this *Blockchain) flushPacks(updatedPacks []uint32) error {
 				return err
 			}
 		}
-		return nil
+		return s.Truncate(ctx, this.safebox.GetHeight())
 	})
 }
 
@@ -594,7 +710,7 @@ func (b *Blockchain) GetTxPool() map[tx.CommonOperation]tx.TxMetadata {
 	result := make(map[tx.CommonOperation]tx.TxMetadata)
 
 	i := uint32(0)
-	time := uint32(time.Now().Unix())
+	time := b.clock.Now()
 	for item := range b.txPool.Iter() {
 		transaction := item.Value.(tx.CommonOperation)
 		result[transaction] = tx.GetMetadata(transaction, i, 0, time)
@@ -614,7 +730,12 @@ func (b *Blockchain) getPendingBlock(miner *crypto.Public, payload []byte, times
 func (b *Blockchain) getPendingBlockUnsafe(miner *crypto.Public, payload []byte, timestamp *uint32, nonce uint32) (safebox.BlockBase, error) {
 	var blockTimestamp uint32
 	if timestamp == nil {
-		blockTimestamp = uint32(time.Now().Unix())
+		// never older than the parent, keeping the templates acceptable by the nodes still enforcing the parent rule
+		lastTimestamps := b.safebox.GetLastTimestamps(defaults.MedianTimeBlocks)
+		blockTimestamp = utils.MaxUint32(b.clock.Now(), common.MedianTimestamp(lastTimestamps))
+		if len(lastTimestamps) > 0 {
+			blockTimestamp = utils.MaxUint32(blockTimestamp, lastTimestamps[0])
+		}
 	} else {
 		blockTimestamp = *timestamp
 	}
@@ -672,6 +793,13 @@ func (this *Blockchain) GetBlock(index uint32) (safebox.BlockBase, error) {
 	return safebox.NewBlock(&meta)
 }
 
+// GetHistoryStart returns the index of the first block stored, the node can't serve the blocks below it
+func (this *Blockchain) GetHistoryStart() uint32 {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	return this.historyStart
+}
+
 func (this *Blockchain) GetHeight() uint32 {
 	return this.safebox.GetHeight()
 }
@@ -741,24 +869,23 @@ func (this *Blockchain) BlockOperationsForEach(index uint32, fn func(meta *tx.Tx
 	return nil
 }
 
-func (b *Blockchain) GetAccountsByPublicKey(public *crypto.Public) []uint32 {
+// GetAccountsByPublicKey returns up to limit account numbers owned by the public key starting from offset, 0 limit means no limit
+func (b *Blockchain) GetAccountsByPublicKey(ctx context.Context, public *crypto.Public, offset uint32, limit uint32) ([]uint32, error) {
 	b.lock.RLock()
 	defer b.lock.RUnlock()
 
-	accounts := make([]uint32, 0)
-
-	total := b.safebox.GetHeight() * defaults.AccountsPerBlock
-	for current := uint32(0); current < total; current++ {
-		account := b.safebox.GetAccount(current)
-		if account == nil {
-			break
-		}
-		if account.IsPublicKeyEqual(public) {
-			accounts = append(accounts, current)
-		}
+	accounts, err := b.safebox.GetAccountsByPublicKey(ctx, public)
+	if err != nil {
+		return nil, err
 	}
-
-	return accounts
+	if offset >= uint32(len(accounts)) {
+		return make([]uint32, 0), nil
+	}
+	accounts = accounts[offset:]
+	if limit != 0 && limit < uint32(len(accounts)) {
+		accounts = accounts[:limit]
+	}
+	return accounts, nil
 }
 
 func (this *Blockchain) ExportSafebox() []byte {
@@ -2,6 +2,7 @@ package blockchain
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
@@ -10,7 +11,9 @@ import (
 	"testing"
 
 	"github.com/pasl-project/pasl/accounter"
+	"github.com/pasl-project/pasl/common"
 	"github.com/pasl-project/pasl/crypto"
+	"github.com/pasl-project/pasl/defaults"
 	"github.com/pasl-project/pasl/safebox/tx"
 
 	"github.com/pasl-project/pasl/safebox"
@@ -18,32 +21,80 @@ import (
 	"github.com/pasl-project/pasl/utils"
 )
 
+type snapshotDelta struct {
+	base       uint32
+	serialized []byte
+}
+
 type MemoryStorage struct {
 	accountPacks map[uint32][]byte
 	blocks       map[uint32][]byte
+	undo         map[uint32][]byte
+	snapshots    map[uint32][]byte
+	deltas       map[uint32]snapshotDelta
 }
 
 func NewMemoryStorage() *MemoryStorage {
 	return &MemoryStorage{
 		accountPacks: make(map[uint32][]byte),
 		blocks:       make(map[uint32][]byte),
+		undo:         make(map[uint32][]byte),
+		snapshots:    make(map[uint32][]byte),
+		deltas:       make(map[uint32]snapshotDelta),
 	}
 }
 
 func (storage *MemoryStorage) Load(callback func(number uint32, serialized []byte) error) (height uint32, err error) {
 	return 0, nil
 }
-func (storage *MemoryStorage) LoadBlocks(toHeight *uint32, callback func(index uint32, serialized []byte) error) error {
-	return fmt.Errorf("not implemented")
+func (storage *MemoryStorage) LoadBlocks(fromHeight uint32, toHeight *uint32, callback func(index uint32, serialized []byte) error) error {
+	height := uint32(0)
+	for index := range storage.blocks {
+		height = utils.MaxUint32(height, index+1)
+	}
+	if toHeight != nil {
+		height = *toHeight
+	}
+	for index := fromHeight; index < height; index++ {
+		data, ok := storage.blocks[index]
+		if !ok {
+			return fmt.Errorf("block %d not found", index)
+		}
+		if err := callback(index, data); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 func (storage *MemoryStorage) LoadPeers(peers func(address []byte, data []byte)) error {
 	return fmt.Errorf("not implemented")
 }
+func (storage *MemoryStorage) LoadBans(bans func(address []byte, data []byte)) error {
+	return fmt.Errorf("not implemented")
+}
 func (storage *MemoryStorage) ListSnapshots() []uint32 {
-	return nil
+	heights := make([]uint32, 0, len(storage.snapshots))
+	for height := range storage.snapshots {
+		heights = append(heights, height)
+	}
+	return heights
+}
+func (storage *MemoryStorage) ListSnapshotDeltas() map[uint32]uint32 {
+	bases := make(map[uint32]uint32, len(storage.deltas))
+	for height, delta := range storage.deltas {
+		bases[height] = delta.base
+	}
+	return bases
 }
 func (storage *MemoryStorage) LoadSnapshot(height uint32) (serialized []byte) {
-	return nil
+	return storage.snapshots[height]
+}
+func (storage *MemoryStorage) LoadSnapshotDelta(height uint32) (base uint32, serialized []byte) {
+	delta := storage.deltas[height]
+	return delta.base, delta.serialized
+}
+func (storage *MemoryStorage) LoadUndo(index uint32) (serialized []byte) {
+	return storage.undo[index]
 }
 func (storage *MemoryStorage) GetBlock(index uint32) (data []byte, err error) {
 	if data, ok := storage.blocks[index]; ok {
@@ -81,11 +132,39 @@ func (storage *MemoryStorage) StoreAccountPack(context interface{}, index uint32
 func (storage *MemoryStorage) StorePeers(context interface{}, peers func(func(address []byte, data []byte))) error {
 	return fmt.Errorf("not implemented")
 }
-func (storage *MemoryStorage) StoreSnapshot(context interface{}, number uint32, serialized []byte) error {
+func (storage *MemoryStorage) StoreBans(context interface{}, bans func(func(address []byte, data []byte))) error {
 	return fmt.Errorf("not implemented")
 }
+func (storage *MemoryStorage) StoreSnapshot(context interface{}, number uint32, serialized []byte) error {
+	storage.snapshots[number] = serialized
+	return nil
+}
+func (storage *MemoryStorage) StoreSnapshotDelta(context interface{}, height uint32, base uint32, serialized []byte) error {
+	storage.deltas[height] = snapshotDelta{base, serialized}
+	return nil
+}
 func (storage *MemoryStorage) DropSnapshot(context interface{}, height uint32) error {
-	return fmt.Errorf("not implemented")
+	delete(storage.snapshots, height)
+	delete(storage.deltas, height)
+	return nil
+}
+func (storage *MemoryStorage) StoreUndo(context interface{}, index uint32, serialized []byte) error {
+	storage.undo[index] = serialized
+	return nil
+}
+func (storage *MemoryStorage) DropUndo(context interface{}, index uint32) error {
+	delete(storage.undo, index)
+	return nil
+}
+func (storage *MemoryStorage) Truncate(context interface{}, height uint32) error {
+	for _, table := range []map[uint32][]byte{storage.blocks, storage.accountPacks, storage.undo} {
+		for index := range table {
+			if index >= height {
+				delete(table, index)
+			}
+		}
+	}
+	return nil
 }
 
 type MockSafebox struct {
@@ -119,6 +198,12 @@ func (s *MockSafebox) Rollback() {}
 func (s *MockSafebox) GetUpdatedPacks() []uint32 {
 	return nil
 }
+func (s *MockSafebox) TakeUndo() ([]byte, error) {
+	return nil, nil
+}
+func (s *MockSafebox) Undo(index uint32, undo []byte) error {
+	return fmt.Errorf("not implemented")
+}
 func (s *MockSafebox) ProcessOperations(miner *crypto.Public, timestamp uint32, operations []tx.CommonOperation, difficulty *big.Int) (map[*accounter.Account]map[uint32]uint32, error) {
 	rand.Read(s.hash)
 	return nil, nil
@@ -132,19 +217,25 @@ func (s *MockSafebox) GetHashrate(blockIndex, blocksCount uint32) uint64 {
 func (s *MockSafebox) GetAccount(number uint32) *accounter.Account {
 	return nil
 }
+func (s *MockSafebox) GetAccountsByPublicKey(ctx context.Context, public *crypto.Public) ([]uint32, error) {
+	return nil, nil
+}
 func (s *MockSafebox) GetAccountPackSerialized(index uint32) ([]byte, error) {
 	return nil, nil
 }
 func (s *MockSafebox) SerializeAccounter() ([]byte, error) {
 	return nil, nil
 }
+func (s *MockSafebox) SerializeAccounterPacks(indexes []uint32) ([]byte, error) {
+	return nil, nil
+}
 
 func TestPendingBlockSafebox(t *testing.T) {
 	blockchain, _ := NewBlockchain(func(accounter *accounter.Accounter) safebox.SafeboxBase {
 		return &MockSafebox{
 			hash: make([]byte, sha256.Size),
 		}
-	}, NewMemoryStorage(), nil)
+	}, NewMemoryStorage(), nil, common.NewSystemClock(), DefaultSnapshotPolicy())
 
 	_, safeboxHash, _ := blockchain.GetState()
 	initialSafeboxHash := make([]byte, sha256.Size)
@@ -174,7 +265,7 @@ func TestPendingBlockSafebox(t *testing.T) {
 }
 
 func TestPendingBlock(t *testing.T) {
-	blockchain, err := NewBlockchain(safebox.NewSafebox, NewMemoryStorage(), nil)
+	blockchain, err := NewBlockchain(safebox.NewSafebox, NewMemoryStorage(), nil, common.NewSystemClock(), DefaultSnapshotPolicy())
 	if err != nil {
 		t.Fatal()
 	}
@@ -196,8 +287,60 @@ func TestPendingBlock(t *testing.T) {
 	}
 }
 
+func TestAlternateChainPrefix(t *testing.T) {
+	mainKey, err := crypto.NewKeyByType(crypto.NIDsecp256k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	altKey, err := crypto.NewKeyByType(crypto.NIDsecp256k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	main, err := NewBlockchain(safebox.NewSafebox, NewMemoryStorage(), nil, common.NewSystemClock(), DefaultSnapshotPolicy())
+	if err != nil {
+		t.Fatal(err)
+	}
+	alt, err := NewBlockchain(safebox.NewSafebox, NewMemoryStorage(), nil, common.NewSystemClock(), DefaultSnapshotPolicy())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mineBlocks(t, main, mainKey.Public, 5)
+	for index := uint32(0); index < main.GetHeight(); index++ {
+		block, err := main.GetBlock(index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := alt.ProcessNewBlock(main.SerializeBlock(block), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mineBlocks(t, main, mainKey.Public, 2)
+	mineBlocks(t, alt, altKey.Public, 3)
+
+	// the alternate chain is fed starting from the genesis block, way below the fork point
+	blocks := make([]safebox.SerializedBlock, 0, alt.GetHeight())
+	for index := uint32(0); index < alt.GetHeight(); index++ {
+		block, err := alt.GetBlock(index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blocks = append(blocks, alt.SerializeBlock(block))
+	}
+	if err := main.AddAlternateChain(blocks); err != nil {
+		t.Fatal(err)
+	}
+
+	mainHeight, mainHash, _ := main.GetState()
+	altHeight, altHash, _ := alt.GetState()
+	if mainHeight != altHeight || !bytes.Equal(mainHash, altHash) {
+		t.Fatalf("alternate chain was not applied, height %d, expected %d", mainHeight, altHeight)
+	}
+}
+
 func TestDeserializeAndPow(t *testing.T) {
-	blockchain, err := NewBlockchain(safebox.NewSafebox, NewMemoryStorage(), nil)
+	blockchain, err := NewBlockchain(safebox.NewSafebox, NewMemoryStorage(), nil, common.NewSystemClock(), DefaultSnapshotPolicy())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -235,3 +378,464 @@ func TestDeserializeAndPow(t *testing.T) {
 		}
 	}
 }
+
+func TestFutureTimestamp(t *testing.T) {
+	clock := &common.FixedClock{}
+	blockchain, err := NewBlockchain(safebox.NewSafebox, NewMemoryStorage(), nil, clock, DefaultSnapshotPolicy())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rawBlock, _ := hex.DecodeString("0201000100000000004600ca02200059a6ef47d508cdd935d9841dc377555697b414c7a9daaa9ba289f9cee6fedd3220004ba82df4966794b2b33e1db8f8d7e18bc0d401012db9a169d22eaaa321cad41e20a107000000000000000000000000009f2f92580000002470a2f7322a004e6577204e6f646520322f312f323031372031313a35363a3333202d20204275696c643a742f312d2d2d2000dc9388917fb00065999f25bde135617677c7020a3aea916098b39ede89e37a222000e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b8552000000000000eae7a91b748c735a5338a11715d815101e0c075f7c60fa52b769ec700000000")
+	var blockSerialized safebox.SerializedBlock
+	if err = utils.Deserialize(&blockSerialized, bytes.NewBuffer(rawBlock)); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Time = blockSerialized.Header.Time - defaults.MaxBlockTimeOffset - 1
+	if err := blockchain.ProcessNewBlock(blockSerialized, false); err != ErrFutureTimestamp {
+		t.Fatalf("expected %v, got %v", ErrFutureTimestamp, err)
+	}
+
+	clock.Time = blockSerialized.Header.Time - defaults.MaxBlockTimeOffset
+	if err := blockchain.ProcessNewBlock(blockSerialized, false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSnapshotPolicyRetained(t *testing.T) {
+	policy := SnapshotPolicy{
+		KeepLast:  2,
+		KeepEvery: 100,
+	}
+	heights := []uint32{50, 120, 150, 210, 260, 310}
+	bases := map[uint32]uint32{
+		260: 210,
+		310: 210,
+		150: 120,
+	}
+
+	retained := policy.retained(heights, bases)
+	expected := []uint32{50, 120, 210, 260, 310}
+	if len(retained) != len(expected) {
+		t.Fatalf("unexpected retained snapshots %v", retained)
+	}
+	for _, height := range expected {
+		if _, ok := retained[height]; !ok {
+			t.Fatalf("snapshot %d should be retained", height)
+		}
+	}
+}
+
+func mineBlock(blockchain *Blockchain, miner *crypto.Public, timestamp uint32) error {
+	block, err := blockchain.getPendingBlock(miner, nil, &timestamp, 0)
+	if err != nil {
+		return err
+	}
+	return blockchain.ProcessNewBlock(blockchain.SerializeBlock(block), false)
+}
+
+func mineBlocks(t *testing.T, blockchain *Blockchain, miner *crypto.Public, count uint32) {
+	for each := uint32(0); each < count; each++ {
+		if err := mineBlock(blockchain, miner, 1500000000+blockchain.GetHeight()*300); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPastTimestamp(t *testing.T) {
+	key, err := crypto.NewKeyByType(crypto.NIDsecp256k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := &common.FixedClock{Time: 2000000000}
+	blockchain, err := NewBlockchain(safebox.NewSafebox, NewMemoryStorage(), nil, clock, DefaultSnapshotPolicy())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mineBlocks(t, blockchain, key.Public, 3)
+
+	// older than the parent but not than the median of the previous blocks
+	if err := mineBlock(blockchain, key.Public, 1500000000+450); err != nil {
+		t.Fatal(err)
+	}
+	// newer than the oldest blocks but older than the median of 0, 300, 450 and 600
+	if err := mineBlock(blockchain, key.Public, 1500000000+400); err != ErrPastTimestamp {
+		t.Fatalf("expected %v, got %v", ErrPastTimestamp, err)
+	}
+	if err := mineBlock(blockchain, key.Public, 1500000000+500); err != nil {
+		t.Fatal(err)
+	}
+
+	// the local clock is behind, templates are never older than the parent nor the median
+	clock.Time = 1500000000
+	block, err := blockchain.getPendingBlock(key.Public, nil, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if block.GetTimestamp() != 1500000000+500 {
+		t.Fatalf("unexpected template timestamp %d", block.GetTimestamp())
+	}
+}
+
+func TestSafeboxImport(t *testing.T) {
+	key, err := crypto.NewKeyByType(crypto.NIDsecp256k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := &common.FixedClock{Time: 2000000000}
+	policy := SnapshotPolicy{
+		Interval:  5,
+		FullEvery: 1,
+		KeepLast:  2,
+	}
+
+	source, err := NewBlockchain(safebox.NewSafebox, NewMemoryStorage(), nil, clock, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mineBlocks(t, source, key.Public, 20)
+
+	height, hash, err := source.GetSafeboxSnapshot(source.GetHeight() - 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if height == 0 || height >= source.GetHeight() {
+		t.Fatalf("unexpected snapshot height %d", height)
+	}
+
+	headers := make([]safebox.SerializedBlockHeader, 0, height+1)
+	for index := uint32(0); index <= height; index++ {
+		block, err := source.GetBlock(index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		headers = append(headers, source.SerializeBlockHeader(block, false, false))
+	}
+
+	destination, err := NewBlockchain(safebox.NewSafebox, NewMemoryStorage(), nil, clock, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := destination.NewSafeboxImport(height, hash, headers[:height]); err == nil {
+		t.Fatalf("incomplete header chain should be rejected")
+	}
+	if _, err := destination.NewSafeboxImport(height, make([]byte, len(hash)), headers); err != ErrSafeboxMismatch {
+		t.Fatalf("safebox hash mismatch should be detected, got %v", err)
+	}
+	imported, err := destination.NewSafeboxImport(height, hash, headers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hashes, err := source.GetSafeboxHashes(height, hash, 0, height)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := imported.AddPacks([][]byte{{}}); err == nil {
+		t.Fatalf("packs should be rejected until hashes are verified")
+	}
+	if err := imported.AddHashes(hashes[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := imported.AddHashes(hashes[1:]); err != nil {
+		t.Fatal(err)
+	}
+
+	packs, err := source.GetSafeboxPacks(height, hash, 0, height)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := imported.AddPacks(packs[1:2]); err == nil {
+		t.Fatalf("out of order pack should be rejected")
+	}
+	if err := imported.AddPacks(packs); err != nil {
+		t.Fatal(err)
+	}
+
+	parent, err := source.GetBlock(height - 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := source.GetBlock(height - 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := destination.ImportSafebox(imported, source.SerializeBlock(other)); err != ErrParentMismatch {
+		t.Fatalf("parent block mismatch should be detected, got %v", err)
+	}
+	if err := destination.ImportSafebox(imported, source.SerializeBlock(parent)); err != nil {
+		t.Fatal(err)
+	}
+	if importedHeight, importedHash, _ := destination.GetState(); importedHeight != height || !bytes.Equal(importedHash, hash) {
+		t.Fatalf("invalid state after import, height %d", importedHeight)
+	}
+	if start := destination.GetHistoryStart(); start != height-1 || source.GetHistoryStart() != 0 {
+		t.Fatalf("unexpected history start %d", start)
+	}
+
+	for index := height; index < source.GetHeight(); index++ {
+		block, err := source.GetBlock(index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := destination.ProcessNewBlock(source.SerializeBlock(block), false); err != nil {
+			t.Fatalf("failed to continue block sync at %d: %v", index, err)
+		}
+	}
+	_, sourceHash, _ := source.GetState()
+	if _, destinationHash, _ := destination.GetState(); !bytes.Equal(sourceHash, destinationHash) {
+		t.Fatalf("state diverged after block sync")
+	}
+}
+
+// forkedChains returns two chains sharing the first blocks, the alternate one is heavier
+func forkedChains(t *testing.T, policy SnapshotPolicy) (main *Blockchain, mainStorage *MemoryStorage, alt *Blockchain, altBlocks []safebox.SerializedBlock) {
+	key, err := crypto.NewKeyByType(crypto.NIDsecp256k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := &common.FixedClock{Time: 2000000000}
+
+	mainStorage = NewMemoryStorage()
+	if main, err = NewBlockchain(safebox.NewSafebox, mainStorage, nil, clock, policy); err != nil {
+		t.Fatal(err)
+	}
+	if alt, err = NewBlockchain(safebox.NewSafebox, NewMemoryStorage(), nil, clock, policy); err != nil {
+		t.Fatal(err)
+	}
+	mineBlocks(t, main, key.Public, 10)
+	for index := uint32(0); index < main.GetHeight(); index++ {
+		block, err := main.GetBlock(index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := alt.ProcessNewBlock(main.SerializeBlock(block), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	forkHeight := main.GetHeight()
+	mineBlocks(t, main, key.Public, 2)
+	for each := uint32(0); each < 3; each++ {
+		if err := mineBlock(alt, key.Public, 1500000000+alt.GetHeight()*300+1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for index := forkHeight; index < alt.GetHeight(); index++ {
+		block, err := alt.GetBlock(index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		altBlocks = append(altBlocks, alt.SerializeBlock(block))
+	}
+	return
+}
+
+func TestReorganize(t *testing.T) {
+	policy := SnapshotPolicy{
+		Interval:  4,
+		FullEvery: 1,
+		KeepLast:  2,
+	}
+	main, _, alt, altBlocks := forkedChains(t, policy)
+	_, mainHash, _ := main.GetState()
+
+	// the lighter chain is rejected and the main one stays intact
+	if err := main.AddAlternateChain(altBlocks[:2]); err == nil {
+		t.Fatalf("lighter alternate chain should be rejected")
+	}
+	if _, hash, _ := main.GetState(); !bytes.Equal(hash, mainHash) {
+		t.Fatalf("main chain changed after rejected reorganization")
+	}
+
+	if err := main.AddAlternateChain(altBlocks); err != nil {
+		t.Fatal(err)
+	}
+	altHeight, altHash, _ := alt.GetState()
+	if height, hash, _ := main.GetState(); height != altHeight || !bytes.Equal(hash, altHash) {
+		t.Fatalf("invalid state after reorganization, height %d", height)
+	}
+}
+
+func TestReorganizeWithoutUndo(t *testing.T) {
+	policy := SnapshotPolicy{
+		Interval:  4,
+		FullEvery: 12,
+		KeepLast:  10,
+	}
+	main, mainStorage, alt, altBlocks := forkedChains(t, policy)
+	for index := range mainStorage.undo {
+		delete(mainStorage.undo, index)
+	}
+
+	if err := main.AddAlternateChain(altBlocks); err != nil {
+		t.Fatal(err)
+	}
+	altHeight, altHash, _ := alt.GetState()
+	if height, hash, _ := main.GetState(); height != altHeight || !bytes.Equal(hash, altHash) {
+		t.Fatalf("invalid state after restoring from the snapshot, height %d", height)
+	}
+
+	// the snapshots taken after switching to the alternate chain cover the packs it has changed
+	key, err := crypto.NewKeyByType(crypto.NIDsecp256k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mineBlocks(t, main, key.Public, 6)
+	verifySnapshots(t, main, mainStorage, altHeight)
+}
+
+// verifySnapshots loads every snapshot taken above the height and compares it with the hash the next block refers to
+func verifySnapshots(t *testing.T, blockchain *Blockchain, storage *MemoryStorage, above uint32) (full, deltas int) {
+	heights, bases := blockchain.listSnapshots()
+	for _, height := range heights {
+		if height <= above || height >= blockchain.GetHeight() {
+			continue
+		}
+		if _, ok := bases[height]; ok {
+			deltas++
+		} else {
+			full++
+		}
+		snapshot, err := blockchain.LoadSnapshot(height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		next, err := blockchain.GetBlock(height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, hash, _ := snapshot.GetState(); !bytes.Equal(hash, next.GetPrevSafeBoxHash()) {
+			t.Fatalf("snapshot %d doesn't match the blockchain", height)
+		}
+	}
+	return
+}
+
+func TestSnapshotDeltas(t *testing.T) {
+	key, err := crypto.NewKeyByType(crypto.NIDsecp256k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := SnapshotPolicy{
+		Interval:  2,
+		FullEvery: 9,
+		KeepLast:  100,
+	}
+	storage := NewMemoryStorage()
+	blockchain, err := NewBlockchain(safebox.NewSafebox, storage, nil, &common.FixedClock{Time: 2000000000}, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mineBlocks(t, blockchain, key.Public, 30)
+
+	full, deltas := verifySnapshots(t, blockchain, storage, 0)
+	if full == 0 || deltas == 0 {
+		t.Fatalf("expected both full and delta snapshots, got %d full and %d deltas", full, deltas)
+	}
+}
+
+func TestVerifySnapshot(t *testing.T) {
+	key, err := crypto.NewKeyByType(crypto.NIDsecp256k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := SnapshotPolicy{
+		Interval:  2,
+		FullEvery: 1,
+		KeepLast:  100,
+	}
+	storage := NewMemoryStorage()
+	blockchain, err := NewBlockchain(safebox.NewSafebox, storage, nil, &common.FixedClock{Time: 2000000000}, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mineBlocks(t, blockchain, key.Public, 10)
+
+	heights, _ := blockchain.listSnapshots()
+	top := uint32(0)
+	for _, height := range heights {
+		top = utils.MaxUint32(top, height)
+	}
+	snapshot, err := blockchain.LoadSnapshot(top)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := blockchain.verifySnapshot(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	delete(storage.blocks, top)
+	if err := blockchain.verifySnapshot(snapshot); err == nil {
+		t.Fatalf("snapshot without the next block should fail verification")
+	}
+}
+
+func TestRestoreFromSnapshot(t *testing.T) {
+	key, err := crypto.NewKeyByType(crypto.NIDsecp256k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := SnapshotPolicy{
+		Interval:  2,
+		FullEvery: 9,
+		KeepLast:  100,
+	}
+	clock := &common.FixedClock{Time: 2000000000}
+	storage := NewMemoryStorage()
+	source, err := NewBlockchain(safebox.NewSafebox, storage, nil, clock, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mineBlocks(t, source, key.Public, 30)
+
+	restore := func(target uint32) {
+		restored, err := NewBlockchain(safebox.NewSafebox, storage, &target, clock, policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		next, err := source.GetBlock(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if height, hash, _ := restored.GetState(); height != target || !bytes.Equal(hash, next.GetPrevSafeBoxHash()) {
+			t.Fatalf("invalid state restored at height %d", height)
+		}
+	}
+
+	heights, bases := source.listSnapshots()
+	full, delta := uint32(0), uint32(0)
+	for _, height := range heights {
+		if height >= source.GetHeight()-1 {
+			continue
+		}
+		if base, ok := bases[height]; ok && base > 0 {
+			delta = utils.MaxUint32(delta, height)
+		} else if !ok {
+			full = utils.MaxUint32(full, height)
+		}
+	}
+	if full == 0 || delta == 0 {
+		t.Fatalf("expected both full and delta snapshots, got %v", heights)
+	}
+	restore(full + 1)
+	restore(delta + 1)
+
+	// the snapshot doesn't match the blocks, the older one is used instead
+	snapshot, err := source.LoadSnapshot(delta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot.BalanceAdd(0, 1, delta)
+	snapshot.Merge()
+	corrupted, err := snapshot.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	delete(storage.deltas, delta)
+	storage.snapshots[delta] = corrupted
+	if err := source.verifySnapshot(snapshot); err == nil {
+		t.Fatalf("corrupted snapshot should fail verification")
+	}
+	restore(delta + 1)
+}
@@ -0,0 +1,331 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+
+	"github.com/pasl-project/pasl/accounter"
+	"github.com/pasl-project/pasl/common"
+	"github.com/pasl-project/pasl/defaults"
+	"github.com/pasl-project/pasl/safebox"
+	"github.com/pasl-project/pasl/storage"
+	"github.com/pasl-project/pasl/utils"
+)
+
+var (
+	ErrSnapshotUnavailable = errors.New("Safebox snapshot is not available")
+	ErrSafeboxMismatch     = errors.New("Safebox doesn't match the header chain")
+	ErrParentMismatch      = errors.New("Parent block doesn't match the header chain")
+)
+
+// servedSnapshot loads the snapshot requested by peers, the last one is cached as the download takes many requests
+func (b *Blockchain) servedSnapshot(height uint32) (*accounter.Accounter, error) {
+	b.servedLock.Lock()
+	defer b.servedLock.Unlock()
+
+	if b.served != nil && b.served.GetHeight() == height {
+		return b.served, nil
+	}
+	snapshot, err := b.LoadSnapshot(height)
+	if err != nil {
+		return nil, err
+	}
+	b.served = snapshot
+	return snapshot, nil
+}
+
+func (b *Blockchain) servedSnapshotWithHash(height uint32, hash []byte) (*accounter.Accounter, error) {
+	snapshot, err := b.servedSnapshot(height)
+	if err != nil {
+		return nil, ErrSnapshotUnavailable
+	}
+	if _, snapshotHash, _ := snapshot.GetState(); !bytes.Equal(snapshotHash, hash) {
+		return nil, ErrSnapshotUnavailable
+	}
+	return snapshot, nil
+}
+
+// GetSafeboxSnapshot returns height and hash of the newest stored snapshot not above the maxHeight
+func (b *Blockchain) GetSafeboxSnapshot(maxHeight uint32) (uint32, []byte, error) {
+	heights, _ := b.listSnapshots()
+	sort.Slice(heights, func(i, j int) bool { return heights[i] > heights[j] })
+
+	for _, height := range heights {
+		if height > maxHeight || height == 0 {
+			continue
+		}
+		snapshot, err := b.servedSnapshot(height)
+		if err != nil {
+			utils.Tracef("Failed to load snapshot %d: %v", height, err)
+			continue
+		}
+		_, hash, _ := snapshot.GetState()
+		return height, hash, nil
+	}
+
+	return 0, nil, ErrSnapshotUnavailable
+}
+
+// GetSafeboxHashes returns hashes of the snapshot packs in the range [from, from + count)
+func (b *Blockchain) GetSafeboxHashes(height uint32, hash []byte, from uint32, count uint32) ([][]byte, error) {
+	snapshot, err := b.servedSnapshotWithHash(height, hash)
+	if err != nil {
+		return nil, err
+	}
+	count = utils.MinUint32(count, defaults.NetworkHashesPerRequest)
+	return snapshot.GetPackHashes(from, from+utils.MinUint32(count, height-utils.MinUint32(from, height))), nil
+}
+
+// GetSafeboxPacks returns serialized snapshot packs in the range [from, from + count)
+func (b *Blockchain) GetSafeboxPacks(height uint32, hash []byte, from uint32, count uint32) ([][]byte, error) {
+	snapshot, err := b.servedSnapshotWithHash(height, hash)
+	if err != nil {
+		return nil, err
+	}
+	count = utils.MinUint32(count, defaults.NetworkPacksPerRequest)
+	to := from + utils.MinUint32(count, height-utils.MinUint32(from, height))
+
+	packs := make([][]byte, 0, to-utils.MinUint32(from, to))
+	for index := from; index < to; index++ {
+		data, err := snapshot.GetAccountPackSerialized(index)
+		if err != nil {
+			return nil, err
+		}
+		packs = append(packs, data)
+	}
+	return packs, nil
+}
+
+// SafeboxImport collects the safebox downloaded from peers, every chunk is verified as soon as it's received
+type SafeboxImport struct {
+	height               uint32
+	hash                 []byte
+	headers              []safebox.SerializedBlockHeader
+	hashes               [][]byte
+	accounter            *accounter.Accounter
+	cumulativeDifficulty *big.Int
+}
+
+// NewSafeboxImport starts the import of the safebox at height, headers of the blocks 0 .. height are verified up front.
+// The safebox hash should match the one the block at height refers to.
+func (b *Blockchain) NewSafeboxImport(height uint32, hash []byte, headers []safebox.SerializedBlockHeader) (*SafeboxImport, error) {
+	if height == 0 || uint32(len(headers)) != height+1 {
+		return nil, fmt.Errorf("expected %d headers, got %d", height+1, len(headers))
+	}
+	if err := b.verifyHeaders(headers); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(headers[height].PrevSafeboxHash, hash) {
+		return nil, ErrSafeboxMismatch
+	}
+
+	return &SafeboxImport{
+		height:               height,
+		hash:                 hash,
+		headers:              headers,
+		hashes:               make([][]byte, 0, height),
+		accounter:            accounter.NewAccounter(),
+		cumulativeDifficulty: big.NewInt(0),
+	}, nil
+}
+
+// verifyHeaders checks the header chain the same way addBlock does, except for the safebox dependent checks
+func (b *Blockchain) verifyHeaders(headers []safebox.SerializedBlockHeader) error {
+	fork := safebox.GetActiveFork(0, defaults.GenesisSafeBox[:])
+	target := common.NewTarget(defaults.MinTarget)
+	timestamps := make([]uint32, 0, len(headers))
+	lastTimestamps := func(count uint32) []uint32 {
+		result := make([]uint32, 0, count)
+		for index := len(timestamps) - 1; index >= 0 && uint32(len(result)) < count; index-- {
+			result = append(result, timestamps[index])
+		}
+		return result
+	}
+
+	now := b.clock.Now()
+	for index := range headers {
+		block, err := safebox.NewBlockFromHeader(&headers[index])
+		if err != nil {
+			return err
+		}
+		if block.GetIndex() != uint32(index) {
+			return ErrInvalidOrder
+		}
+		if block.GetTimestamp() > now+defaults.MaxBlockTimeOffset {
+			return ErrFutureTimestamp
+		}
+		if index > 0 && block.GetTimestamp() < common.MedianTimestamp(lastTimestamps(defaults.MedianTimeBlocks)) {
+			return ErrPastTimestamp
+		}
+		if err := fork.CheckBlock(target, block); err != nil {
+			return fmt.Errorf("Invalid block header %d: %v", index, err)
+		}
+
+		timestamps = append(timestamps, block.GetTimestamp())
+		newTarget := target
+		if activated := safebox.TryActivateFork(block.GetIndex()+1, block.GetPrevSafeBoxHash()); activated != nil {
+			newTarget = block.GetTarget()
+			fork = activated
+		}
+		target = common.NewTarget(fork.GetNextTarget(newTarget, lastTimestamps))
+	}
+
+	return nil
+}
+
+func (i *SafeboxImport) GetHeight() uint32 {
+	return i.height
+}
+
+// Progress returns the number of pack hashes and packs received so far
+func (i *SafeboxImport) Progress() (hashes uint32, packs uint32) {
+	return uint32(len(i.hashes)), i.accounter.GetHeight()
+}
+
+// AddHashes appends the next pack hashes, the safebox hash is checked once all of them are received
+func (i *SafeboxImport) AddHashes(hashes [][]byte) error {
+	if len(hashes) == 0 || uint32(len(hashes)) > i.height-uint32(len(i.hashes)) {
+		return fmt.Errorf("unexpected pack hashes count %d", len(hashes))
+	}
+	for _, hash := range hashes {
+		if len(hash) != sha256.Size {
+			return fmt.Errorf("invalid pack hash length %d", len(hash))
+		}
+		i.hashes = append(i.hashes, hash)
+	}
+
+	if uint32(len(i.hashes)) == i.height {
+		digest := sha256.New()
+		for _, hash := range i.hashes {
+			digest.Write(hash)
+		}
+		if !bytes.Equal(digest.Sum(nil), i.hash) {
+			i.hashes = i.hashes[:0]
+			return ErrSafeboxMismatch
+		}
+	}
+	return nil
+}
+
+// AddPacks appends the next packs, each of them should match its hash and the block header it was created by
+func (i *SafeboxImport) AddPacks(packs [][]byte) error {
+	if uint32(len(i.hashes)) != i.height {
+		return errors.New("pack hashes are not verified yet")
+	}
+	next := i.accounter.GetHeight()
+	if len(packs) == 0 || uint32(len(packs)) > i.height-next {
+		return fmt.Errorf("unexpected packs count %d", len(packs))
+	}
+
+	for _, data := range packs {
+		pack, err := accounter.UnmarshalPack(data)
+		if err != nil {
+			return err
+		}
+		if pack.GetIndex() != next {
+			return fmt.Errorf("unexpected pack %d, expected %d", pack.GetIndex(), next)
+		}
+		if !bytes.Equal(pack.GetHash(), i.hashes[next]) {
+			return fmt.Errorf("pack %d hash mismatch", next)
+		}
+		header := &i.headers[next]
+		if pack.GetAccount(0).GetTimestamp() != header.Time {
+			return fmt.Errorf("pack %d timestamp doesn't match the block header", next)
+		}
+		i.cumulativeDifficulty.Add(i.cumulativeDifficulty, common.NewTarget(header.Target).GetDifficulty())
+		if pack.GetCumulativeDifficulty().Cmp(i.cumulativeDifficulty) != 0 {
+			return fmt.Errorf("pack %d cumulative difficulty doesn't match the block headers", next)
+		}
+		i.accounter.AppendPack(pack)
+		next++
+	}
+	i.accounter.Merge()
+
+	return nil
+}
+
+// ImportSafebox replaces the empty blockchain state with the downloaded safebox.
+// The parent block of the safebox is stored as the only block preceding it, block sync resumes from the safebox height.
+func (b *Blockchain) ImportSafebox(imported *SafeboxImport, parent safebox.SerializedBlock) error {
+	height, hash, _ := imported.accounter.GetState()
+	if height != imported.height || !bytes.Equal(hash, imported.hash) {
+		return ErrSafeboxMismatch
+	}
+
+	parentMeta := blockMetadata(&parent)
+	parentBlock, err := safebox.NewBlock(parentMeta)
+	if err != nil {
+		return ErrParentMismatch
+	}
+	parentHeader, err := safebox.NewBlockFromHeader(&imported.headers[height-1])
+	if err != nil {
+		return err
+	}
+	parentBlob, _ := safebox.GetBlockHashingBlob(parentBlock)
+	headerBlob, _ := safebox.GetBlockHashingBlob(parentHeader)
+	if parentBlock.GetIndex() != height-1 || !bytes.Equal(parentBlob, headerBlob) {
+		return ErrParentMismatch
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.safebox.GetHeight() != 0 {
+		return errors.New("Blockchain is not empty")
+	}
+
+	prevSafebox, prevTarget := b.safebox, b.target
+	b.safebox = b.newSafeboxCallback(imported.accounter)
+	b.target = common.NewTarget(b.safebox.GetFork().GetNextTarget(parentBlock.GetTarget(), b.safebox.GetLastTimestamps))
+
+	if err := b.storage.WithWritable(func(s storage.StorageWritable, ctx interface{}) error {
+		for index := uint32(0); index < height; index++ {
+			data, err := b.safebox.GetAccountPackSerialized(index)
+			if err != nil {
+				return err
+			}
+			if err := s.StoreAccountPack(ctx, index, data); err != nil {
+				return err
+			}
+		}
+		if err := s.StoreBlock(ctx, parentBlock.GetIndex(), utils.Serialize(parentMeta)); err != nil {
+			return err
+		}
+		if err := s.Truncate(ctx, height); err != nil {
+			return err
+		}
+		b.blocksSinceSnapshot = 0
+		return b.storeSnapshotUnsafe(s, ctx)
+	}); err != nil {
+		b.safebox, b.target = prevSafebox, prevTarget
+		return err
+	}
+	copy(b.prevSafeboxHash, hash)
+	b.historyStart = parentBlock.GetIndex()
+
+	utils.Tracef("Imported safebox at height %d", height)
+	return nil
+}
@@ -0,0 +1,246 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package blockchain
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/pasl-project/pasl/accounter"
+	"github.com/pasl-project/pasl/defaults"
+	"github.com/pasl-project/pasl/storage"
+	"github.com/pasl-project/pasl/utils"
+)
+
+// SnapshotPolicy controls how often the safebox snapshots are taken and which of them are retained.
+// Full snapshots are taken every FullEvery blocks, the ones in between store only the packs changed since the last full snapshot.
+type SnapshotPolicy struct {
+	Interval  uint32
+	FullEvery uint32
+	KeepLast  uint32
+	KeepEvery uint32
+}
+
+func NewSnapshotPolicy(keepLast uint32, keepEvery uint32) SnapshotPolicy {
+	return SnapshotPolicy{
+		Interval:  defaults.SnapshotInterval,
+		FullEvery: defaults.SnapshotFullEvery,
+		KeepLast:  keepLast,
+		KeepEvery: keepEvery,
+	}
+}
+
+func DefaultSnapshotPolicy() SnapshotPolicy {
+	return NewSnapshotPolicy(defaults.SnapshotsKeepLast, defaults.SnapshotsKeepEvery)
+}
+
+// retained returns the subset of snapshots that should be kept, deltas always keep their base snapshot
+func (p *SnapshotPolicy) retained(heights []uint32, bases map[uint32]uint32) map[uint32]struct{} {
+	sorted := make([]uint32, len(heights))
+	copy(sorted, heights)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] > sorted[j] })
+
+	keepLast := p.KeepLast
+	if keepLast == 0 {
+		keepLast = 1
+	}
+
+	result := make(map[uint32]struct{})
+	for index, height := range sorted {
+		if uint32(index) < keepLast {
+			result[height] = struct{}{}
+		}
+	}
+
+	if p.KeepEvery != 0 {
+		oldest := make(map[uint32]uint32)
+		for _, height := range sorted {
+			oldest[height/p.KeepEvery] = height
+		}
+		for _, height := range oldest {
+			result[height] = struct{}{}
+		}
+	}
+
+	for height := range result {
+		if base, ok := bases[height]; ok {
+			result[base] = struct{}{}
+		}
+	}
+
+	return result
+}
+
+func (this *Blockchain) listSnapshots() (heights []uint32, bases map[uint32]uint32) {
+	bases = this.storage.ListSnapshotDeltas()
+	if bases == nil {
+		bases = make(map[uint32]uint32)
+	}
+
+	unique := make(map[uint32]struct{})
+	for _, height := range this.storage.ListSnapshots() {
+		unique[height] = struct{}{}
+		delete(bases, height)
+	}
+	for height := range bases {
+		unique[height] = struct{}{}
+	}
+
+	heights = make([]uint32, 0, len(unique))
+	for height := range unique {
+		heights = append(heights, height)
+	}
+	return heights, bases
+}
+
+func (this *Blockchain) storeSnapshotUnsafe(s storage.StorageWritable, ctx interface{}) error {
+	height := this.safebox.GetHeight()
+
+	if err := s.DropSnapshot(ctx, height); err != nil {
+		return err
+	}
+
+	if this.snapshotBase == nil || height-*this.snapshotBase >= this.snapshotPolicy.FullEvery {
+		buffer, err := this.safebox.SerializeAccounter()
+		if err != nil {
+			return fmt.Errorf("failed to serialize accounter: %v", err)
+		}
+		if err := s.StoreSnapshot(ctx, height, buffer); err != nil {
+			return err
+		}
+		this.snapshotBase = &height
+		this.changedSinceSnapshot = make(map[uint32]struct{})
+	} else {
+		packs := make([]uint32, 0, len(this.changedSinceSnapshot))
+		for packIndex := range this.changedSinceSnapshot {
+			if packIndex < height {
+				packs = append(packs, packIndex)
+			}
+		}
+		sort.Slice(packs, func(i, j int) bool { return packs[i] < packs[j] })
+		buffer, err := this.safebox.SerializeAccounterPacks(packs)
+		if err != nil {
+			return fmt.Errorf("failed to serialize accounter packs: %v", err)
+		}
+		if err := s.StoreSnapshotDelta(ctx, height, *this.snapshotBase, buffer); err != nil {
+			return err
+		}
+	}
+
+	heights, bases := this.listSnapshots()
+	if this.snapshotBase != nil {
+		bases[height] = *this.snapshotBase
+	}
+	retained := this.snapshotPolicy.retained(heights, bases)
+	for _, snapshotHeight := range heights {
+		if _, ok := retained[snapshotHeight]; !ok {
+			if err := s.DropSnapshot(ctx, snapshotHeight); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (this *Blockchain) dropSnapshotsAboveUnsafe(s storage.StorageWritable, ctx interface{}, height uint32) error {
+	heights, bases := this.listSnapshots()
+	for _, snapshotHeight := range heights {
+		base, isDelta := bases[snapshotHeight]
+		if snapshotHeight > height || (isDelta && base > height) {
+			if err := s.DropSnapshot(ctx, snapshotHeight); err != nil {
+				return err
+			}
+		}
+	}
+	if this.snapshotBase != nil && *this.snapshotBase > height {
+		this.snapshotBase = nil
+	}
+	return nil
+}
+
+func (this *Blockchain) LoadSnapshot(height uint32) (*accounter.Accounter, error) {
+	if buffer := this.storage.LoadSnapshot(height); buffer != nil {
+		snapshot := accounter.NewAccounter()
+		if _, err := snapshot.Unmarshal(buffer); err != nil {
+			return nil, fmt.Errorf("failed to deserialize snapshot %d", height)
+		}
+		return snapshot, nil
+	}
+
+	base, delta := this.storage.LoadSnapshotDelta(height)
+	if delta == nil {
+		return nil, fmt.Errorf("failed to load snapshot %d", height)
+	}
+	buffer := this.storage.LoadSnapshot(base)
+	if buffer == nil {
+		return nil, fmt.Errorf("failed to load base snapshot %d of snapshot %d", base, height)
+	}
+	snapshot := accounter.NewAccounter()
+	if _, err := snapshot.Unmarshal(buffer); err != nil {
+		return nil, fmt.Errorf("failed to deserialize base snapshot %d", base)
+	}
+	if err := snapshot.ApplyPacks(delta, height); err != nil {
+		return nil, fmt.Errorf("failed to apply snapshot %d: %v", height, err)
+	}
+	return snapshot, nil
+}
+
+func (this *Blockchain) LoadNearestSnapshot(targetHeight uint32) (*accounter.Accounter, error) {
+	heights, _ := this.listSnapshots()
+	sort.Slice(heights, func(i, j int) bool { return heights[i] > heights[j] })
+
+	for _, height := range heights {
+		if height > targetHeight {
+			continue
+		}
+		snapshot, err := this.LoadSnapshot(height)
+		if err == nil {
+			err = this.verifySnapshot(snapshot)
+		}
+		if err == nil {
+			return snapshot, nil
+		}
+		utils.Tracef("Skipping snapshot %d: %v", height, err)
+	}
+
+	return nil, fmt.Errorf("no matching snapshots")
+}
+
+// verifySnapshot checks that the snapshot matches the stored blocks, its parent block should exist and the next block should refer to its hash.
+// Snapshots that can't be verified are rejected.
+func (this *Blockchain) verifySnapshot(snapshot *accounter.Accounter) error {
+	height, hash, _ := snapshot.GetState()
+	if height == 0 {
+		return nil
+	}
+	if _, err := this.GetBlock(height - 1); err != nil {
+		return fmt.Errorf("parent block %d is not available: %v", height-1, err)
+	}
+	next, err := this.GetBlock(height)
+	if err != nil {
+		return fmt.Errorf("next block %d is not available: %v", height, err)
+	}
+	if !bytes.Equal(next.GetPrevSafeBoxHash(), hash) {
+		return fmt.Errorf("safebox hash mismatch at height %d", height)
+	}
+	return nil
+}
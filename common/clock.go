@@ -0,0 +1,144 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package common
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pasl-project/pasl/defaults"
+	"github.com/pasl-project/pasl/utils"
+)
+
+type Clock interface {
+	Now() uint32
+}
+
+type systemClock struct{}
+
+func NewSystemClock() Clock {
+	return &systemClock{}
+}
+
+func (*systemClock) Now() uint32 {
+	return uint32(time.Now().Unix())
+}
+
+// FixedClock always reports the same time, tests and simulations move it manually
+type FixedClock struct {
+	Time uint32
+}
+
+func (c *FixedClock) Now() uint32 {
+	return c.Time
+}
+
+type timeSample struct {
+	offset int64
+	added  uint32
+}
+
+// AdjustedClock shifts the local time by the median offset reported by peers, one sample per remote host
+type AdjustedClock struct {
+	local   Clock
+	lock    sync.RWMutex
+	samples map[string]timeSample
+	offset  int64
+	warned  bool
+}
+
+func NewAdjustedClock(local Clock) *AdjustedClock {
+	return &AdjustedClock{
+		local:   local,
+		samples: make(map[string]timeSample),
+	}
+}
+
+// AddSample replaces the sample previously reported by the host, samples older than TimeSampleLifetime
+// are dropped and the oldest one is evicted once the limit is reached
+func (c *AdjustedClock) AddSample(host string, remoteTime uint32) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := c.local.Now()
+	for source, sample := range c.samples {
+		if now-sample.added > defaults.TimeSampleLifetime {
+			delete(c.samples, source)
+		}
+	}
+	if _, exists := c.samples[host]; !exists && uint32(len(c.samples)) >= defaults.TimeSamplesMax {
+		oldest := ""
+		for source, sample := range c.samples {
+			if oldest == "" || sample.added < c.samples[oldest].added {
+				oldest = source
+			}
+		}
+		delete(c.samples, oldest)
+	}
+	c.samples[host] = timeSample{
+		offset: int64(remoteTime) - int64(now),
+		added:  now,
+	}
+
+	if uint32(len(c.samples)) < defaults.TimeSamplesMin {
+		c.offset = 0
+		return
+	}
+
+	offsets := make([]int64, 0, len(c.samples))
+	for _, sample := range c.samples {
+		offsets = append(offsets, sample.offset)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	median := offsets[len(offsets)/2]
+
+	if utils.MaxInt64(median, -median) <= int64(defaults.MaxTimeOffset) {
+		c.offset = median
+		return
+	}
+
+	c.offset = 0
+	if !c.warned {
+		c.warned = true
+		utils.Tracef("Warning: local clock differs from the network time by %d seconds, please check your computer's date and time", median)
+	}
+}
+
+func (c *AdjustedClock) GetOffset() int64 {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.offset
+}
+
+func (c *AdjustedClock) Now() uint32 {
+	return uint32(int64(c.local.Now()) + c.GetOffset())
+}
+
+func MedianTimestamp(timestamps []uint32) uint32 {
+	if len(timestamps) == 0 {
+		return 0
+	}
+	sorted := make([]uint32, len(timestamps))
+	copy(sorted, timestamps)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[len(sorted)/2]
+}
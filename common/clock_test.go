@@ -0,0 +1,103 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package common
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/pasl-project/pasl/defaults"
+)
+
+func TestAdjustedClock(t *testing.T) {
+	local := &FixedClock{Time: 1000000}
+	clock := NewAdjustedClock(local)
+
+	for each := uint32(0); each < defaults.TimeSamplesMin-1; each++ {
+		clock.AddSample(fmt.Sprintf("peer%d", each), local.Time+60)
+	}
+	if clock.GetOffset() != 0 {
+		t.Fatalf("offset applied with insufficient samples")
+	}
+
+	clock.AddSample("last", local.Time+60)
+	if clock.GetOffset() != 60 {
+		t.Fatalf("invalid offset %d", clock.GetOffset())
+	}
+	if clock.Now() != local.Time+60 {
+		t.Fatalf("invalid adjusted time %d", clock.Now())
+	}
+
+	// a single host reporting over and over again doesn't outweigh the rest
+	for each := 0; each < 10; each++ {
+		clock.AddSample("peer0", local.Time+defaults.MaxTimeOffset)
+	}
+	if clock.GetOffset() != 60 {
+		t.Fatalf("invalid offset %d after repeated samples", clock.GetOffset())
+	}
+
+	far := NewAdjustedClock(local)
+	for each := uint32(0); each < defaults.TimeSamplesMin; each++ {
+		far.AddSample(fmt.Sprintf("peer%d", each), local.Time-defaults.MaxTimeOffset-1)
+	}
+	if far.GetOffset() != 0 {
+		t.Fatalf("offset beyond the limit applied")
+	}
+}
+
+func TestAdjustedClockExpiration(t *testing.T) {
+	local := &FixedClock{Time: 1000000}
+	clock := NewAdjustedClock(local)
+
+	for each := uint32(0); each < defaults.TimeSamplesMax; each++ {
+		clock.AddSample(fmt.Sprintf("peer%d", each), local.Time+100)
+	}
+	if clock.GetOffset() != 100 {
+		t.Fatalf("invalid offset %d", clock.GetOffset())
+	}
+
+	// the earliest samples are evicted once the limit is reached
+	local.Time++
+	for each := uint32(0); each < defaults.TimeSamplesMax/2+1; each++ {
+		clock.AddSample(fmt.Sprintf("late%d", each), local.Time+50)
+	}
+	if clock.GetOffset() != 50 {
+		t.Fatalf("invalid offset %d after eviction", clock.GetOffset())
+	}
+
+	// outdated samples are dropped
+	local.Time += defaults.TimeSampleLifetime + 1
+	clock.AddSample("fresh", local.Time)
+	if clock.GetOffset() != 0 {
+		t.Fatalf("outdated samples are still applied, offset %d", clock.GetOffset())
+	}
+}
+
+func TestMedianTimestamp(t *testing.T) {
+	if MedianTimestamp(nil) != 0 {
+		t.FailNow()
+	}
+	if MedianTimestamp([]uint32{5, 1, 3}) != 3 {
+		t.FailNow()
+	}
+	if MedianTimestamp([]uint32{7, 1, 9, 3}) != 7 {
+		t.FailNow()
+	}
+}
@@ -27,25 +27,76 @@ import (
 
 const (
 	VersionMajor uint16 = 0
-	VersionMinor uint16 = 1
+	VersionMinor uint16 = 2
 )
 
 const (
-	NetId                   uint32        = 0x5891E4FF
-	BootstrapNodes          string        = "tcp://pascallite.ddns.net:4004,tcp://pascallite2.ddns.net:4004,tcp://pascallite3.ddns.net:4004,tcp://pascallite4.dynamic-dns.net:4004,tcp://pascallite5.dynamic-dns.net:4004,tcp://pascallite.dynamic-dns.net:4004,tcp://pascallite2.dynamic-dns.net:4004,tcp://pascallite3.dynamic-dns.net:4004"
-	P2PBindAddress          string        = "0.0.0.0"
-	P2PPort                 uint16        = 4004
-	RPCBindHost             string        = "127.0.0.1"
-	RPCPort                 uint16        = 4003
-	TimeoutConnect          time.Duration = time.Duration(10) * time.Second
-	TimeoutRequest          time.Duration = time.Duration(60) * time.Second
-	MaxAltChainLength       uint32        = 100
-	MaxIncoming             uint32        = 100
-	MaxOutgoing             uint32        = 10
-	MaxBlockTimeOffset      uint32        = 15
-	MaxPayloadLength        int           = 255
-	NetworkBlocksPerRequest uint32        = 500
-	ReconnectionDelayMax    uint32        = 30
+	NetProtocolVersion    uint16 = 3
+	NetProtocolAvailable  uint16 = 4
+	NetProtocolMinVersion uint16 = 3
+)
+
+const (
+	NetId                     uint32        = 0x5891E4FF
+	BootstrapNodes            string        = "tcp://pascallite.ddns.net:4004,tcp://pascallite2.ddns.net:4004,tcp://pascallite3.ddns.net:4004,tcp://pascallite4.dynamic-dns.net:4004,tcp://pascallite5.dynamic-dns.net:4004,tcp://pascallite.dynamic-dns.net:4004,tcp://pascallite2.dynamic-dns.net:4004,tcp://pascallite3.dynamic-dns.net:4004"
+	P2PBindAddress            string        = "0.0.0.0"
+	P2PPort                   uint16        = 4004
+	RPCBindHost               string        = "127.0.0.1"
+	RPCPort                   uint16        = 4003
+	TimeoutConnect            time.Duration = time.Duration(10) * time.Second
+	TimeoutRequest            time.Duration = time.Duration(60) * time.Second
+	TimeoutHandshake          time.Duration = time.Duration(30) * time.Second
+	MaxAltChainLength         uint32        = 100
+	BanDuration               time.Duration = time.Duration(24) * time.Hour
+	BanScoreDecay             uint32        = 60 // seconds to forget a point of the misbehavior score
+	BanScoreThreshold         uint32        = 100
+	AnchorPeers               uint32        = 2
+	FastSyncAttempts          uint32        = 3
+	FastSyncMinHeight         uint32        = 10000
+	ForkMonitorDepth          uint32        = 2
+	ForkMonitorGrace          time.Duration = time.Duration(10) * time.Minute
+	ForkMonitorInterval       time.Duration = time.Duration(1) * time.Minute
+	ForkMonitorShare          uint32        = 50 // percent of the peers
+	LightWalletPeers          uint32        = 3
+	LightWalletQuorum         uint32        = 2
+	MaxUndoBlocks             uint32        = 1000
+	MaxIncoming               uint32        = 100
+	MaxIncomingPerIP          uint32        = 4
+	MaxIncomingPerSubnet      uint32        = 16
+	MaxOrphanBlocks           uint32        = 100
+	MaxOutgoing               uint32        = 10
+	MaxOutgoingPerGroup       uint32        = 2
+	MaxBlockTimeOffset        uint32        = 15
+	MaxTimeOffset             uint32        = 300
+	MaxPayloadLength          int           = 255
+	NetworkAccountsPerRequest uint32        = 100
+	NetworkBlocksPerRequest   uint32        = 500
+	NetworkCompactBlocksQueue uint32        = 16
+	NetworkEventsQueue        uint32        = 1024
+	NetworkHashesPerRequest   uint32        = 100000
+	NetworkInventorySize      uint32        = 10000
+	NetworkIncomingQueue      uint32        = 64
+	NetworkOperationsLimit    uint32        = 5000
+	NetworkOperationsPerPage  uint32        = 500
+	NetworkOutgoingQueue      uint32        = 256
+	NetworkPeersPerHello      uint32        = 10
+	NetworkPacksPerRequest    uint32        = 10000
+	NetworkRelayInterval      time.Duration = time.Duration(200) * time.Millisecond
+	NetworkWorkers            uint32        = 4
+	PeerMaxFailures           uint32        = 10
+	PeerStaleAfter            time.Duration = time.Duration(14*24) * time.Hour
+	PeersPerBucket            uint32        = 8
+	PeersPerSource            uint32        = 64
+	PeersEvictionInterval     time.Duration = time.Duration(1) * time.Minute
+	PeersStoreInterval        time.Duration = time.Duration(5) * time.Minute
+	ReconnectionDelayMax      uint32        = 30
+	SnapshotInterval          uint32        = MaxAltChainLength / 2
+	SnapshotFullEvery         uint32        = 1000
+	SnapshotsKeepLast         uint32        = 2
+	SnapshotsKeepEvery        uint32        = 10000
+	TimeSampleLifetime        uint32        = 24 * 60 * 60
+	TimeSamplesMin            uint32        = 5
+	TimeSamplesMax            uint32        = 200
 )
 
 const (
@@ -58,6 +109,7 @@ const (
 	MinTarget        uint32 = 0x24000000
 	MinTargetBits    uint   = uint(MinTarget >> 24)
 	DifficultyBlocks uint32 = 10
+	MedianTimeBlocks uint32 = 11
 )
 
 const (
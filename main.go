@@ -41,6 +41,7 @@ import (
 
 	"github.com/pasl-project/pasl/api"
 	"github.com/pasl-project/pasl/blockchain"
+	"github.com/pasl-project/pasl/common"
 	"github.com/pasl-project/pasl/crypto"
 	"github.com/pasl-project/pasl/defaults"
 	"github.com/pasl-project/pasl/network"
@@ -56,7 +57,7 @@ func exportMain(ctx *cli.Context) error {
 }
 
 func exportSafebox(ctx *cli.Context) error {
-	return withBlockchain(ctx, func(blockchain *blockchain.Blockchain, _ storage.Storage) error {
+	return withBlockchain(ctx, common.NewSystemClock(), func(blockchain *blockchain.Blockchain, _ storage.Storage) error {
 		blob := blockchain.ExportSafebox()
 		fmt.Fprint(ctx.App.Writer, hex.EncodeToString(blob))
 		return nil
@@ -95,7 +96,7 @@ func getBlock(ctx *cli.Context) error {
 	if !ctx.Args().Present() {
 		return errors.New("invalid block index")
 	}
-	return withBlockchain(ctx, func(_ *blockchain.Blockchain, s storage.Storage) error {
+	return withBlockchain(ctx, common.NewSystemClock(), func(_ *blockchain.Blockchain, s storage.Storage) error {
 		index, err := strconv.ParseUint(ctx.Args().First(), 10, 32)
 		if err != nil {
 			return err
@@ -110,7 +111,7 @@ func getBlock(ctx *cli.Context) error {
 }
 
 func getHeight(ctx *cli.Context) error {
-	return withBlockchain(ctx, func(blockchain *blockchain.Blockchain, _ storage.Storage) error {
+	return withBlockchain(ctx, common.NewSystemClock(), func(blockchain *blockchain.Blockchain, _ storage.Storage) error {
 		height := blockchain.GetHeight()
 		fmt.Fprintf(ctx.App.Writer, "%d\n", height)
 		return nil
@@ -138,6 +139,66 @@ var getCommand = cli.Command{
 	},
 }
 
+var realtimeFlag = cli.BoolFlag{
+	Name:  "realtime",
+	Usage: "Keep the recorded intervals between the packets",
+}
+var lingerFlag = cli.DurationFlag{
+	Name:  "linger",
+	Usage: "How long to keep the connection open once all the recorded packets are replayed",
+	Value: time.Duration(10) * time.Second,
+}
+
+func replayRecording(ctx *cli.Context) error {
+	if !ctx.Args().Present() {
+		return errors.New("recording file is not specified")
+	}
+	file, err := os.Open(ctx.Args().First())
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	transport, err := pasl.NewReplayTransport(file, ctx.Bool(realtimeFlag.GetName()), ctx.Duration(lingerFlag.GetName()))
+	if err != nil {
+		return err
+	}
+
+	clock := common.NewAdjustedClock(common.NewSystemClock())
+	return withBlockchain(ctx, clock, func(blockchain *blockchain.Blockchain, _ storage.Storage) error {
+		key, err := crypto.NewKeyByType(crypto.NIDsecp256k1)
+		if err != nil {
+			return err
+		}
+		peers := network.NewPeersList()
+		peerUpdates := make(chan network.PeerUpdate, defaults.NetworkPeersPerHello)
+		bans := network.NewBansList(defaults.BanScoreThreshold, defaults.BanDuration, func([]network.Ban) {})
+		return pasl.WithManager(utils.Serialize(key.Public), blockchain, 0, peers, bans, peerUpdates, blockchain.BlocksUpdates, blockchain.TxPoolUpdates, pasl.Config{
+			TimeoutRequest: defaults.TimeoutRequest,
+		}, clock, func(manager *pasl.Manager) error {
+			err := manager.OnNewConnection(context.Background(), &network.Connection{
+				Address:        "replay",
+				Outgoing:       transport.Outgoing(),
+				Transport:      transport,
+				OnStateUpdated: func() {},
+			})
+			utils.Ftracef(ctx.App.Writer, "Replay finished: %v, height %d", err, blockchain.GetHeight())
+			return nil
+		})
+	})
+}
+
+var replayCommand = cli.Command{
+	Action:      replayRecording,
+	Name:        "p2p-replay",
+	Usage:       "Replay the packets recorded with --p2p-record against the data directory, the blocks received are stored",
+	ArgsUsage:   "<recording file>",
+	Description: "",
+	Flags: []cli.Flag{
+		realtimeFlag,
+		lingerFlag,
+	},
+}
+
 var p2pPortFlag = cli.UintFlag{
 	Name:  "p2p-bind-port",
 	Usage: "P2P bind port",
@@ -156,6 +217,65 @@ var exclusiveNodesFlag = cli.StringFlag{
 	Name:  "exclusive-nodes",
 	Usage: "Comma-separated ip:port list of exclusive nodes to connect to",
 }
+var p2pAllowFlag = cli.StringFlag{
+	Name:  "p2p-allow",
+	Usage: "Comma-separated CIDR list of the only addresses allowed for P2P connections",
+}
+var p2pDenyFlag = cli.StringFlag{
+	Name:  "p2p-deny",
+	Usage: "Comma-separated CIDR list of addresses denied for P2P connections",
+}
+var allowPrivatePeersFlag = cli.BoolFlag{
+	Name:  "allow-private-peers",
+	Usage: "Allow P2P connections to private, loopback and link-local addresses",
+}
+var proxyFlag = cli.StringFlag{
+	Name:  "proxy",
+	Usage: "Route outgoing P2P connections and host name resolution through the proxy, socks5://[user:password@]host:port",
+}
+var noListenFlag = cli.BoolFlag{
+	Name:  "no-listen",
+	Usage: "Disable inbound P2P connections",
+}
+var maxUploadFlag = cli.UintFlag{
+	Name:  "max-upload",
+	Usage: "P2P upload limit in KiB/s, 0 for unlimited",
+}
+var maxDownloadFlag = cli.UintFlag{
+	Name:  "max-download",
+	Usage: "P2P download limit in KiB/s, 0 for unlimited",
+}
+var maxUploadHistoricalFlag = cli.UintFlag{
+	Name:  "max-upload-historical",
+	Usage: "Limit in KiB/s for serving historical blocks to syncing peers, 0 for unlimited",
+}
+var p2pRecordFlag = cli.StringFlag{
+	Name:  "p2p-record",
+	Usage: "Directory to record the P2P packets of every connection to, for debugging",
+}
+var snapshotsKeepLastFlag = cli.UintFlag{
+	Name:  "snapshots-keep-last",
+	Usage: "Number of the most recent safebox snapshots to keep",
+	Value: uint(defaults.SnapshotsKeepLast),
+}
+var snapshotsKeepEveryFlag = cli.UintFlag{
+	Name:  "snapshots-keep-every",
+	Usage: "Keep one safebox snapshot every specified number of blocks, 0 to disable",
+	Value: uint(defaults.SnapshotsKeepEvery),
+}
+var banDurationFlag = cli.DurationFlag{
+	Name:  "ban-duration",
+	Usage: "How long misbehaving peers stay banned",
+	Value: defaults.BanDuration,
+}
+var fastSyncFlag = cli.BoolFlag{
+	Name:  "fast-sync",
+	Usage: "Download the safebox snapshot from peers instead of replaying all the blocks on the first run",
+}
+var lightFlag = cli.BoolFlag{
+	Name:  "light",
+	Usage: "Light wallet mode, keep no safebox and query account states from multiple peers",
+}
 var walletFileFlag = cli.StringFlag{
 	Name:  "wallet-file",
 	Usage: "File to store encrypted wallet keys",
@@ -222,21 +342,26 @@ func getDataDir(ctx *cli.Context, create bool) (string, error) {
 	return dataDir, nil
 }
 
-func withBlockchain(ctx *cli.Context, fn func(blockchain *blockchain.Blockchain, storage storage.Storage) error) error {
+func withBlockchain(ctx *cli.Context, clock common.Clock, fn func(blockchain *blockchain.Blockchain, storage storage.Storage) error) error {
 	dataDir, err := getDataDir(ctx, true)
 	if err != nil {
 		return err
 	}
 
 	dbFileName := filepath.Join(dataDir, "storage.db")
+	if ctx.GlobalBool(lightFlag.GetName()) {
+		// keeps just the peers and bans, the blockchain stays empty
+		dbFileName = filepath.Join(dataDir, "light.db")
+	}
 	err = storage.WithStorage(&dbFileName, func(storage storage.Storage) (err error) {
 		var blockchainInstance *blockchain.Blockchain
+		policy := blockchain.NewSnapshotPolicy(uint32(ctx.GlobalUint(snapshotsKeepLastFlag.GetName())), uint32(ctx.GlobalUint(snapshotsKeepEveryFlag.GetName())))
 		if ctx.IsSet(heightFlag.GetName()) {
 			var height uint32
 			height = uint32(heightFlagValue)
-			blockchainInstance, err = blockchain.NewBlockchain(safebox.NewSafebox, storage, &height)
+			blockchainInstance, err = blockchain.NewBlockchain(safebox.NewSafebox, storage, &height, clock, policy)
 		} else {
-			blockchainInstance, err = blockchain.NewBlockchain(safebox.NewSafebox, storage, nil)
+			blockchainInstance, err = blockchain.NewBlockchain(safebox.NewSafebox, storage, nil, clock, policy)
 		}
 		if err != nil {
 			return err
@@ -262,16 +387,43 @@ func run(cliContext *cli.Context) error {
 	utils.Ftracef(cliContext.App.Writer, defaults.UserAgent)
 
 	utils.Ftracef(cliContext.App.Writer, "Loading blockchain")
-	return withBlockchain(cliContext, func(blockchain *blockchain.Blockchain, s storage.Storage) error {
+	clock := common.NewAdjustedClock(common.NewSystemClock())
+	return withBlockchain(cliContext, clock, func(blockchain *blockchain.Blockchain, s storage.Storage) error {
 		height, safeboxHash, cumulativeDifficulty := blockchain.GetState()
 		utils.Ftracef(cliContext.App.Writer, "Blockchain loaded, height %d safeboxHash %s cumulativeDifficulty %s", height, hex.EncodeToString(safeboxHash), cumulativeDifficulty.String())
 
+		light := cliContext.GlobalBool(lightFlag.GetName())
 		p2pPort := uint16(cliContext.GlobalUint(p2pPortFlag.GetName()))
+		filter, err := network.NewAddressFilter(
+			strings.Split(cliContext.GlobalString(p2pAllowFlag.GetName()), ","),
+			strings.Split(cliContext.GlobalString(p2pDenyFlag.GetName()), ","),
+			cliContext.GlobalBool(allowPrivatePeersFlag.GetName()),
+		)
+		if err != nil {
+			return err
+		}
+		bandwidth := network.NewBandwidth(
+			uint64(cliContext.GlobalUint(maxUploadFlag.GetName()))*1024,
+			uint64(cliContext.GlobalUint(maxDownloadFlag.GetName()))*1024,
+			uint64(cliContext.GlobalUint(maxUploadHistoricalFlag.GetName()))*1024,
+		)
 		config := network.Config{
-			ListenAddr:     fmt.Sprintf("%s:%d", defaults.P2PBindAddress, p2pPort),
-			MaxIncoming:    defaults.MaxIncoming,
-			MaxOutgoing:    defaults.MaxOutgoing,
-			TimeoutConnect: defaults.TimeoutConnect,
+			ListenAddr:           net.JoinHostPort(defaults.P2PBindAddress, strconv.Itoa(int(p2pPort))),
+			MaxIncoming:          defaults.MaxIncoming,
+			MaxIncomingPerIP:     defaults.MaxIncomingPerIP,
+			MaxIncomingPerSubnet: defaults.MaxIncomingPerSubnet,
+			MaxOutgoing:          defaults.MaxOutgoing,
+			TimeoutConnect:       defaults.TimeoutConnect,
+			TimeoutHandshake:     defaults.TimeoutHandshake,
+			Filter:               filter,
+			Proxy:                cliContext.GlobalString(proxyFlag.GetName()),
+			DisableInbound:       cliContext.GlobalBool(noListenFlag.GetName()),
+			Bandwidth:            bandwidth,
+		}
+		// peers are not invited to connect back when inbound connections are disabled
+		helloPort := p2pPort
+		if config.DisableInbound {
+			helloPort = 0
 		}
 
 		key, err := crypto.NewKeyByType(crypto.NIDsecp256k1)
@@ -281,9 +433,32 @@ func run(cliContext *cli.Context) error {
 		nonce := utils.Serialize(key.Public)
 
 		peers := network.NewPeersList()
-		peerUpdates := make(chan network.PeerInfo)
-		return pasl.WithManager(nonce, blockchain, p2pPort, peers, peerUpdates, blockchain.BlocksUpdates, blockchain.TxPoolUpdates, defaults.TimeoutRequest, func(manager *pasl.Manager) error {
-			return network.WithNode(config, peers, peerUpdates, manager.OnNewConnection, func(node network.Node) error {
+		peerUpdates := make(chan network.PeerUpdate, defaults.NetworkPeersPerHello)
+		bans := network.NewBansList(defaults.BanScoreThreshold, cliContext.GlobalDuration(banDurationFlag.GetName()), func(bans []network.Ban) {
+			if err := s.WithWritable(func(s storage.StorageWritable, ctx interface{}) error {
+				return s.StoreBans(ctx, func(fn func(address []byte, data []byte)) {
+					for index := range bans {
+						fn([]byte(bans[index].Address), utils.Serialize(&bans[index]))
+					}
+				})
+			}); err != nil {
+				utils.Ftracef(cliContext.App.Writer, "Failed to store bans: %v", err)
+			}
+		})
+		if err := s.LoadBans(func(address []byte, data []byte) {
+			if err := bans.AddSerialized(data); err != nil {
+				utils.Ftracef(cliContext.App.Writer, "Failed to load ban: %v", err)
+			}
+		}); err != nil {
+			return err
+		}
+		return pasl.WithManager(nonce, blockchain, helloPort, peers, bans, peerUpdates, blockchain.BlocksUpdates, blockchain.TxPoolUpdates, pasl.Config{
+			TimeoutRequest: defaults.TimeoutRequest,
+			FastSync:       cliContext.GlobalBool(fastSyncFlag.GetName()),
+			Light:          light,
+			RecordDir:      cliContext.GlobalString(p2pRecordFlag.GetName()),
+		}, clock, func(manager *pasl.Manager) error {
+			return network.WithNode(config, peers, bans, peerUpdates, manager.OnNewConnection, func(node network.Node) error {
 				cancel := make(chan os.Signal, 2)
 				coreRPC := api.NewApi(blockchain)
 				RPCBindAddress := fmt.Sprintf("%s:%d", cliContext.GlobalString(rpcIPFlag.GetName()), defaults.RPCPort)
@@ -302,6 +477,7 @@ func run(cliContext *cli.Context) error {
 					utils.Ftracef(cliContext.App.Writer, fmt.Sprintf("Web UI is available at http://%s", ln.Addr().String()))
 					mux := http.NewServeMux()
 					mux.Handle("/", http.FileServer(AssetFile()))
+					mux.Handle("/metrics", network.MetricsHandler(manager))
 					// TODO: handle error
 					http.Serve(ln, mux)
 				}()
@@ -327,20 +503,52 @@ func run(cliContext *cli.Context) error {
 						}
 					})
 					defer populatePeers.StopAndWaitForever()
-					defer func() {
+
+					storePeers := func() {
 						peers := node.GetPeersByNetwork("tcp")
-						s.WithWritable(func(s storage.StorageWritable, ctx interface{}) error {
+						if err := s.WithWritable(func(s storage.StorageWritable, ctx interface{}) error {
 							return s.StorePeers(ctx, func(fn func(address []byte, data []byte)) {
 								for address := range peers {
 									fn([]byte(address), utils.Serialize(peers[address]))
 								}
 							})
-						})
-					}()
+						}); err != nil {
+							utils.Ftracef(cliContext.App.Writer, "Failed to store peers: %v", err)
+						}
+					}
+					// stored periodically so that a crash doesn't lose the peers
+					populatePeers.Go(func(ctx context.Context) {
+						for {
+							select {
+							case <-ctx.Done():
+								return
+							case <-time.After(defaults.PeersStoreInterval):
+								storePeers()
+							}
+						}
+					})
+					defer storePeers()
 				}
 
 				RPCHandlers := coreRPC.GetHandlers()
-				for k, v := range wallet.GetHandlers() {
+				if light {
+					// the wallet is backed by the local blockchain which is left empty in light mode
+					RPCHandlers = api.NewLightApi(manager).GetHandlers()
+				} else {
+					for k, v := range wallet.GetHandlers() {
+						RPCHandlers[k] = v
+					}
+				}
+				for k, v := range bans.GetHandlers() {
+					RPCHandlers[k] = v
+				}
+				for k, v := range manager.GetHandlers() {
+					RPCHandlers[k] = v
+				}
+				for k, v := range node.GetHandlers() {
+					RPCHandlers[k] = v
+				}
+				for k, v := range bandwidth.GetHandlers() {
 					RPCHandlers[k] = v
 				}
 				return network.WithRpcServer(RPCBindAddress, RPCHandlers, func() error {
@@ -363,13 +571,28 @@ func main() {
 	app.Commands = []cli.Command{
 		exportCommand,
 		getCommand,
+		replayCommand,
 	}
 	app.Flags = []cli.Flag{
+		allowPrivatePeersFlag,
+		banDurationFlag,
 		dataDirFlag,
 		exclusiveNodesFlag,
+		fastSyncFlag,
 		heightFlag,
+		lightFlag,
+		maxDownloadFlag,
+		maxUploadFlag,
+		maxUploadHistoricalFlag,
+		noListenFlag,
+		p2pAllowFlag,
+		p2pDenyFlag,
 		p2pPortFlag,
+		p2pRecordFlag,
+		proxyFlag,
 		rpcIPFlag,
+		snapshotsKeepEveryFlag,
+		snapshotsKeepLastFlag,
 
 		walletFileFlag,
 		passwordFlag,
@@ -31,6 +31,51 @@ type Account struct {
 	UpdatedB   uint32  `json:"updated_b"`
 }
 
+type PeerConnection struct {
+	Address         string  `json:"address"`
+	Direction       string  `json:"direction"`
+	Nonce           string  `json:"nonce"`
+	UserAgent       string  `json:"user_agent"`
+	Netver          uint16  `json:"netver"`
+	NetverAvailable uint16  `json:"netver_a"`
+	Capabilities    string  `json:"capabilities"`
+	Block           uint32  `json:"block"`
+	SafeboxHash     string  `json:"sbh"`
+	Connected       uint32  `json:"connected"`
+	LastSeen        uint32  `json:"last_seen"`
+	PingMs          float64 `json:"ping_ms"`
+	BytesRecv       uint64  `json:"bytes_recv"`
+	BytesSent       uint64  `json:"bytes_sent"`
+	PacketsRecv     uint64  `json:"packets_recv"`
+	PacketsSent     uint64  `json:"packets_sent"`
+	BytesHistorical uint64  `json:"bytes_historical"`
+	BanScore        uint32  `json:"ban_score"`
+}
+
+type ChainTip struct {
+	Height uint32 `json:"height"`
+	Hash   string `json:"sbh"`
+	Peers  int    `json:"peers"`
+	Status string `json:"status"`
+}
+
+type ForkStatus struct {
+	Peers   int    `json:"peers"`
+	Forked  int    `json:"forked"`
+	Ahead   int    `json:"ahead"`
+	Warning string `json:"warning"`
+}
+
+type NetTotals struct {
+	TotalBytesRecv       uint64 `json:"totalbytesrecv"`
+	TotalBytesSent       uint64 `json:"totalbytessent"`
+	TotalBytesHistorical uint64 `json:"totalbyteshistorical"`
+	UploadLimit          uint64 `json:"upload_limit"`
+	DownloadLimit        uint64 `json:"download_limit"`
+	HistoricalLimit      uint64 `json:"historical_limit"`
+	TimeMillis           int64  `json:"timemillis"`
+}
+
 type Operation struct {
 	Account        uint32  `json:"account"`
 	Amount         float64 `json:"amount"`
@@ -0,0 +1,201 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package network
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tokenBucket limits the rate to rate bytes per second with up to a second worth of burst, a nil bucket is unlimited
+type tokenBucket struct {
+	lock   sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate uint64) *tokenBucket {
+	if rate == 0 {
+		return nil
+	}
+	return &tokenBucket{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// reserve takes the tokens going into debt if needed, returns how long to wait for the debt to be repaid
+func (this *tokenBucket) reserve(bytes int) time.Duration {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	now := time.Now()
+	this.tokens += now.Sub(this.last).Seconds() * this.rate
+	if this.tokens > this.rate {
+		this.tokens = this.rate
+	}
+	this.last = now
+
+	this.tokens -= float64(bytes)
+	if this.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-this.tokens / this.rate * float64(time.Second))
+}
+
+// wait blocks until the bytes fit the rate, returns false if cancelled earlier
+func (this *tokenBucket) wait(bytes int, cancel <-chan struct{}) bool {
+	if this == nil {
+		return true
+	}
+	delay := this.reserve(bytes)
+	if delay == 0 {
+		return true
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-cancel:
+		return false
+	}
+}
+
+// Bandwidth accounts the traffic of all the connections and enforces the global upload and download limits,
+// serving historical blocks is limited separately on top of the upload limit
+type Bandwidth struct {
+	// counters are accessed atomically, they stay first to keep the 64-bit alignment
+	bytesIn         uint64
+	bytesOut        uint64
+	bytesHistorical uint64
+	upload          *tokenBucket
+	download        *tokenBucket
+	historical      *tokenBucket
+	limitUpload     uint64
+	limitDownload   uint64
+	limitHistorical uint64
+}
+
+// NewBandwidth creates the limits in bytes per second, 0 is unlimited
+func NewBandwidth(upload, download, historical uint64) *Bandwidth {
+	return &Bandwidth{
+		upload:          newTokenBucket(upload),
+		download:        newTokenBucket(download),
+		historical:      newTokenBucket(historical),
+		limitUpload:     upload,
+		limitDownload:   download,
+		limitHistorical: historical,
+	}
+}
+
+// Meter wraps the transport to account and limit its traffic, the transport is left as is without the bandwidth
+func (this *Bandwidth) Meter(transport io.ReadWriteCloser) io.ReadWriteCloser {
+	if this == nil {
+		return transport
+	}
+	return &MeteredTransport{
+		ReadWriteCloser: transport,
+		bandwidth:       this,
+		closed:          make(chan struct{}),
+	}
+}
+
+func (this *Bandwidth) Totals() NetTotals {
+	return NetTotals{
+		TotalBytesRecv:       atomic.LoadUint64(&this.bytesIn),
+		TotalBytesSent:       atomic.LoadUint64(&this.bytesOut),
+		TotalBytesHistorical: atomic.LoadUint64(&this.bytesHistorical),
+		UploadLimit:          this.limitUpload,
+		DownloadLimit:        this.limitDownload,
+		HistoricalLimit:      this.limitHistorical,
+		TimeMillis:           time.Now().UnixNano() / int64(time.Millisecond),
+	}
+}
+
+func (this *Bandwidth) GetHandlers() map[string]interface{} {
+	return map[string]interface{}{
+		"getnettotals": this.GetNetTotals,
+	}
+}
+
+func (this *Bandwidth) GetNetTotals(context.Context, *struct{}) (NetTotals, error) {
+	return this.Totals(), nil
+}
+
+// MeteredTransport counts the bytes of a single connection and throttles it according to the shared limits
+type MeteredTransport struct {
+	// counters are accessed atomically, they stay first to keep the 64-bit alignment
+	bytesIn         uint64
+	bytesOut        uint64
+	bytesHistorical uint64
+	io.ReadWriteCloser
+	bandwidth *Bandwidth
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (this *MeteredTransport) Read(p []byte) (int, error) {
+	n, err := this.ReadWriteCloser.Read(p)
+	if n > 0 {
+		atomic.AddUint64(&this.bytesIn, uint64(n))
+		atomic.AddUint64(&this.bandwidth.bytesIn, uint64(n))
+		this.bandwidth.download.wait(n, this.closed)
+	}
+	return n, err
+}
+
+func (this *MeteredTransport) Write(p []byte) (int, error) {
+	if !this.bandwidth.upload.wait(len(p), this.closed) {
+		return 0, io.ErrClosedPipe
+	}
+	n, err := this.ReadWriteCloser.Write(p)
+	atomic.AddUint64(&this.bytesOut, uint64(n))
+	atomic.AddUint64(&this.bandwidth.bytesOut, uint64(n))
+	return n, err
+}
+
+func (this *MeteredTransport) Close() error {
+	this.closeOnce.Do(func() {
+		close(this.closed)
+	})
+	return this.ReadWriteCloser.Close()
+}
+
+// WaitHistorical accounts the historical blocks about to be sent and blocks until they fit the historical limit,
+// returns false if the connection was closed while waiting
+func (this *MeteredTransport) WaitHistorical(bytes int) bool {
+	if this == nil {
+		return true
+	}
+	atomic.AddUint64(&this.bytesHistorical, uint64(bytes))
+	atomic.AddUint64(&this.bandwidth.bytesHistorical, uint64(bytes))
+	return this.bandwidth.historical.wait(bytes, this.closed)
+}
+
+// Traffic returns the bytes received, sent and sent serving historical blocks over the connection
+func (this *MeteredTransport) Traffic() (bytesIn, bytesOut, bytesHistorical uint64) {
+	return atomic.LoadUint64(&this.bytesIn), atomic.LoadUint64(&this.bytesOut), atomic.LoadUint64(&this.bytesHistorical)
+}
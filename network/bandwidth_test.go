@@ -0,0 +1,80 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package network
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+type bufferTransport struct {
+	bytes.Buffer
+}
+
+func (*bufferTransport) Close() error {
+	return nil
+}
+
+func TestTokenBucket(t *testing.T) {
+	if newTokenBucket(0) != nil || !newTokenBucket(0).wait(1<<20, nil) {
+		t.Fatal("zero rate must be unlimited")
+	}
+
+	bucket := newTokenBucket(1000)
+	if delay := bucket.reserve(1000); delay != 0 {
+		t.Fatalf("burst is not allowed, delay %v", delay)
+	}
+	if delay := bucket.reserve(500); delay < 400*time.Millisecond || delay > 500*time.Millisecond {
+		t.Fatalf("unexpected delay %v", delay)
+	}
+}
+
+func TestMeteredTransport(t *testing.T) {
+	bandwidth := NewBandwidth(0, 0, 100)
+	underlying := &bufferTransport{}
+	transport := bandwidth.Meter(underlying).(*MeteredTransport)
+
+	transport.Write(make([]byte, 10))
+	transport.Read(make([]byte, 4))
+	if !transport.WaitHistorical(100) {
+		t.Fatal("historical burst is not allowed")
+	}
+	if in, out, historical := transport.Traffic(); in != 4 || out != 10 || historical != 100 {
+		t.Fatalf("unexpected connection traffic %d %d %d", in, out, historical)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		transport.Close()
+	}()
+	started := time.Now()
+	if transport.WaitHistorical(1000) || time.Since(started) > 5*time.Second {
+		t.Fatal("closing the connection doesn't interrupt the wait")
+	}
+
+	totals := bandwidth.Totals()
+	if totals.TotalBytesRecv != 4 || totals.TotalBytesSent != 10 || totals.TotalBytesHistorical != 1100 || totals.HistoricalLimit != 100 {
+		t.Fatalf("unexpected totals %+v", totals)
+	}
+	if (*Bandwidth)(nil).Meter(underlying) != underlying {
+		t.Fatal("transport is wrapped without the bandwidth")
+	}
+}
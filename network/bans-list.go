@@ -0,0 +1,337 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package network
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pasl-project/pasl/defaults"
+	"github.com/pasl-project/pasl/utils"
+)
+
+type Offense int
+
+const (
+	OffenseInvalidPacket Offense = iota
+	OffenseInvalidBlock
+	OffenseInvalidOperation
+	OffenseOversizedFrame
+)
+
+func (o Offense) String() string {
+	switch o {
+	case OffenseInvalidPacket:
+		return "invalid packet"
+	case OffenseInvalidBlock:
+		return "invalid block"
+	case OffenseInvalidOperation:
+		return "invalid operation"
+	case OffenseOversizedFrame:
+		return "oversized frame"
+	default:
+		return "unknown offense"
+	}
+}
+
+func (o Offense) Score() uint32 {
+	switch o {
+	case OffenseInvalidPacket:
+		return 20
+	case OffenseInvalidBlock:
+		return 100
+	case OffenseInvalidOperation:
+		return 10
+	case OffenseOversizedFrame:
+		return 50
+	default:
+		return 0
+	}
+}
+
+type Ban struct {
+	Address string
+	Until   uint32
+	Reason  string
+}
+
+type BannedPeer struct {
+	Address      string `json:"address"`
+	Banned_until uint32 `json:"banned_until"`
+	Reason       string `json:"reason"`
+}
+
+type misbehavior struct {
+	score   uint32
+	updated uint32
+}
+
+// decayed returns the score left after forgetting a point every BanScoreDecay seconds since the last offense
+func (m misbehavior) decayed(current uint32) uint32 {
+	if current <= m.updated {
+		return m.score
+	}
+	forgiven := (current - m.updated) / defaults.BanScoreDecay
+	if forgiven >= m.score {
+		return 0
+	}
+	return m.score - forgiven
+}
+
+// BansList accumulates misbehavior scores of remote addresses and nonces and bans them once the threshold is crossed,
+// the scores decay over time so that occasional offenses of long-lived peers don't add up to a ban
+type BansList struct {
+	lock      sync.Mutex
+	scores    map[string]misbehavior
+	banned    map[string]Ban
+	threshold uint32
+	duration  time.Duration
+	onUpdate  func(bans []Ban)
+}
+
+func NewBansList(threshold uint32, duration time.Duration, onUpdate func(bans []Ban)) *BansList {
+	return &BansList{
+		scores:    make(map[string]misbehavior),
+		banned:    make(map[string]Ban),
+		threshold: threshold,
+		duration:  duration,
+		onUpdate:  onUpdate,
+	}
+}
+
+// BanKeyFromAddress strips the scheme and port, bans are applied to the remote host regardless of the port
+func BanKeyFromAddress(address string) string {
+	host := address
+	if parsed, err := url.Parse(address); err == nil && parsed.Host != "" {
+		host = parsed.Host
+	}
+	if hostOnly, _, err := net.SplitHostPort(host); err == nil {
+		return hostOnly
+	}
+	return host
+}
+
+func BanKeyFromNonce(nonce []byte) string {
+	return "nonce:" + hex.EncodeToString(nonce)
+}
+
+func (this *BansList) AddSerialized(serialized []byte) error {
+	ban := Ban{}
+	if err := utils.Deserialize(&ban, bytes.NewBuffer(serialized)); err != nil {
+		return fmt.Errorf("Failed to deserialize ban %v", ban.Address)
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if ban.Until > uint32(time.Now().Unix()) {
+		this.banned[ban.Address] = ban
+	}
+	return nil
+}
+
+// Misbehaving increases the score of every address, returns true if they got banned
+func (this *BansList) Misbehaving(offense Offense, addresses ...string) bool {
+	this.lock.Lock()
+
+	current := uint32(time.Now().Unix())
+	for address, entry := range this.scores {
+		if entry.decayed(current) == 0 {
+			delete(this.scores, address)
+		}
+	}
+
+	banned := false
+	for _, address := range addresses {
+		score := this.scores[address].decayed(current) + offense.Score()
+		this.scores[address] = misbehavior{
+			score:   score,
+			updated: current,
+		}
+		if score >= this.threshold {
+			banned = true
+		}
+	}
+	if banned {
+		until := uint32(time.Now().Add(this.duration).Unix())
+		for _, address := range addresses {
+			delete(this.scores, address)
+			this.banned[address] = Ban{
+				Address: address,
+				Until:   until,
+				Reason:  offense.String(),
+			}
+		}
+	}
+
+	this.lock.Unlock()
+
+	if banned {
+		this.notify()
+	}
+	return banned
+}
+
+// Score returns the highest misbehavior score accumulated by any of the addresses
+func (this *BansList) Score(addresses ...string) uint32 {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	current := uint32(time.Now().Unix())
+	score := uint32(0)
+	for _, address := range addresses {
+		score = utils.MaxUint32(score, this.scores[address].decayed(current))
+	}
+	return score
+}
+
+func (this *BansList) IsBanned(addresses ...string) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	current := uint32(time.Now().Unix())
+	for _, address := range addresses {
+		if ban, ok := this.banned[address]; ok {
+			if current < ban.Until {
+				return true
+			}
+			delete(this.banned, address)
+		}
+	}
+	return false
+}
+
+func (this *BansList) Ban(address string, duration time.Duration, reason string) {
+	this.lock.Lock()
+	delete(this.scores, address)
+	this.banned[address] = Ban{
+		Address: address,
+		Until:   uint32(time.Now().Add(duration).Unix()),
+		Reason:  reason,
+	}
+	this.lock.Unlock()
+
+	this.notify()
+}
+
+func (this *BansList) Unban(address string) bool {
+	this.lock.Lock()
+	_, exists := this.banned[address]
+	delete(this.banned, address)
+	this.lock.Unlock()
+
+	if exists {
+		this.notify()
+	}
+	return exists
+}
+
+func (this *BansList) Clear() {
+	this.lock.Lock()
+	this.scores = make(map[string]misbehavior)
+	this.banned = make(map[string]Ban)
+	this.lock.Unlock()
+
+	this.notify()
+}
+
+func (this *BansList) List() []Ban {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	current := uint32(time.Now().Unix())
+	result := make([]Ban, 0, len(this.banned))
+	for address, ban := range this.banned {
+		if current >= ban.Until {
+			delete(this.banned, address)
+			continue
+		}
+		result = append(result, ban)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Address < result[j].Address })
+	return result
+}
+
+func (this *BansList) notify() {
+	if this.onUpdate != nil {
+		this.onUpdate(this.List())
+	}
+}
+
+func (this *BansList) GetHandlers() map[string]interface{} {
+	return map[string]interface{}{
+		"listbanned":  this.ListBanned,
+		"setban":      this.SetBan,
+		"clearbanned": this.ClearBanned,
+	}
+}
+
+func (this *BansList) ListBanned(context.Context, *struct{}) ([]BannedPeer, error) {
+	bans := this.List()
+	result := make([]BannedPeer, 0, len(bans))
+	for _, ban := range bans {
+		result = append(result, BannedPeer{
+			Address:      ban.Address,
+			Banned_until: ban.Until,
+			Reason:       ban.Reason,
+		})
+	}
+	return result, nil
+}
+
+func (this *BansList) SetBan(_ context.Context, params *struct {
+	Address string
+	Command string
+	Bantime uint32
+}) (bool, error) {
+	address := BanKeyFromAddress(params.Address)
+	if address == "" {
+		return false, fmt.Errorf("invalid address")
+	}
+
+	switch params.Command {
+	case "add":
+		duration := this.duration
+		if params.Bantime != 0 {
+			duration = time.Duration(params.Bantime) * time.Second
+		}
+		this.Ban(address, duration, "manually banned")
+		return true, nil
+	case "remove":
+		if !this.Unban(address) {
+			return false, fmt.Errorf("address %s is not banned", address)
+		}
+		return true, nil
+	default:
+		return false, fmt.Errorf("unknown command '%s', expecting 'add' or 'remove'", params.Command)
+	}
+}
+
+func (this *BansList) ClearBanned(context.Context, *struct{}) (bool, error) {
+	this.Clear()
+	return true, nil
+}
@@ -0,0 +1,111 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package network
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pasl-project/pasl/defaults"
+	"github.com/pasl-project/pasl/utils"
+)
+
+func TestBansList(t *testing.T) {
+	var stored []Ban
+	bans := NewBansList(100, time.Hour, func(bans []Ban) {
+		stored = bans
+	})
+
+	address := BanKeyFromAddress("tcp://10.0.0.1:4004")
+	if address != "10.0.0.1" {
+		t.Fatalf("unexpected ban key %s", address)
+	}
+	nonce := BanKeyFromNonce([]byte{1, 2, 3})
+
+	for each := 0; each < 9; each++ {
+		if bans.Misbehaving(OffenseInvalidOperation, address, nonce) {
+			t.Fatalf("banned too early")
+		}
+	}
+	if score := bans.Score(address, nonce); score != 9*OffenseInvalidOperation.Score() {
+		t.Fatalf("unexpected score %d", score)
+	}
+	if !bans.Misbehaving(OffenseInvalidOperation, address, nonce) {
+		t.Fatalf("should be banned")
+	}
+	if !bans.IsBanned(address) || !bans.IsBanned(nonce) {
+		t.Fatalf("ban is not applied")
+	}
+	if len(stored) != 2 {
+		t.Fatalf("bans are not stored")
+	}
+
+	restored := NewBansList(100, time.Hour, nil)
+	for index := range stored {
+		if err := restored.AddSerialized(utils.Serialize(&stored[index])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !restored.IsBanned(address) || restored.List()[0].Reason != OffenseInvalidOperation.String() {
+		t.Fatalf("failed to restore bans")
+	}
+
+	if !bans.Unban(address) || bans.IsBanned(address) {
+		t.Fatalf("failed to unban")
+	}
+	bans.Ban(address, -time.Second, "expired")
+	if bans.IsBanned(address) {
+		t.Fatalf("expired ban is still active")
+	}
+	bans.Clear()
+	if len(bans.List()) != 0 || len(stored) != 0 {
+		t.Fatalf("failed to clear bans")
+	}
+}
+
+func TestBanScoreDecay(t *testing.T) {
+	bans := NewBansList(100, time.Hour, nil)
+	address := BanKeyFromAddress("10.0.0.1:4004")
+	stale := BanKeyFromAddress("10.0.0.2:4004")
+
+	bans.Misbehaving(OffenseOversizedFrame, address)
+	bans.Misbehaving(OffenseInvalidOperation, stale)
+
+	// move the offenses back in time
+	bans.lock.Lock()
+	for key, entry := range bans.scores {
+		entry.updated -= 40 * defaults.BanScoreDecay
+		bans.scores[key] = entry
+	}
+	bans.lock.Unlock()
+
+	if score := bans.Score(address); score != OffenseOversizedFrame.Score()-40 {
+		t.Fatalf("unexpected decayed score %d", score)
+	}
+	if bans.Misbehaving(OffenseOversizedFrame, address) {
+		t.Fatalf("decayed offenses shouldn't add up to a ban")
+	}
+	bans.lock.Lock()
+	_, exists := bans.scores[stale]
+	bans.lock.Unlock()
+	if exists {
+		t.Fatalf("fully decayed score is not pruned")
+	}
+}
@@ -0,0 +1,112 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package network
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// AddressFilter decides which remote IP addresses are allowed for inbound and outbound connections
+type AddressFilter struct {
+	allow        []*net.IPNet
+	deny         []*net.IPNet
+	allowPrivate bool
+}
+
+// NewAddressFilter parses the allow and deny lists of CIDRs, single IP addresses are accepted as well
+func NewAddressFilter(allow []string, deny []string, allowPrivate bool) (*AddressFilter, error) {
+	allowNets, err := parseNetworks(allow)
+	if err != nil {
+		return nil, err
+	}
+	denyNets, err := parseNetworks(deny)
+	if err != nil {
+		return nil, err
+	}
+	return &AddressFilter{
+		allow:        allowNets,
+		deny:         denyNets,
+		allowPrivate: allowPrivate,
+	}, nil
+}
+
+func parseNetworks(networks []string) ([]*net.IPNet, error) {
+	result := make([]*net.IPNet, 0, len(networks))
+	for _, network := range networks {
+		network = strings.TrimSpace(network)
+		if network == "" {
+			continue
+		}
+		if !strings.Contains(network, "/") {
+			ip := net.ParseIP(network)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid IP address '%s'", network)
+			}
+			if ip.To4() != nil {
+				network += "/32"
+			} else {
+				network += "/128"
+			}
+		}
+		_, parsed, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid CIDR '%s': %v", network, err)
+		}
+		result = append(result, parsed)
+	}
+	return result, nil
+}
+
+func contains(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allowed rejects the denied addresses, the explicitly allowed ones pass, otherwise only global unicast addresses
+// are allowed unless private mode accepts private, loopback and link-local addresses too
+func (this *AddressFilter) Allowed(ip net.IP) bool {
+	if ip == nil || ip.IsUnspecified() || ip.IsMulticast() {
+		return false
+	}
+	if this == nil {
+		return ip.IsGlobalUnicast() && !ip.IsPrivate()
+	}
+	if contains(this.deny, ip) {
+		return false
+	}
+	if len(this.allow) > 0 {
+		return contains(this.allow, ip)
+	}
+	if this.allowPrivate && (ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast()) {
+		return true
+	}
+	return ip.IsGlobalUnicast() && !ip.IsPrivate()
+}
+
+// AllowedAddress checks the IP address of the tcp://host:port address, unresolved hosts are not allowed
+func (this *AddressFilter) AllowedAddress(address string) bool {
+	return this.Allowed(net.ParseIP(BanKeyFromAddress(address)))
+}
@@ -0,0 +1,148 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package network
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrTooManyConnections = errors.New("Too many inbound connections")
+)
+
+type inboundConnection struct {
+	ip        string
+	subnet    string
+	transport io.Closer
+	lastSeen  int64
+}
+
+func (c *inboundConnection) seen() {
+	atomic.StoreInt64(&c.lastSeen, time.Now().Unix())
+}
+
+func (c *inboundConnection) getLastSeen() int64 {
+	return atomic.LoadInt64(&c.lastSeen)
+}
+
+// inboundSlots limits inbound connections in total, per IP and per subnet (/24 for IPv4, /64 for IPv6)
+type inboundSlots struct {
+	lock         sync.Mutex
+	connections  map[*inboundConnection]struct{}
+	maxTotal     uint32
+	maxPerIP     uint32
+	maxPerSubnet uint32
+}
+
+func newInboundSlots(maxTotal, maxPerIP, maxPerSubnet uint32) *inboundSlots {
+	return &inboundSlots{
+		connections:  make(map[*inboundConnection]struct{}),
+		maxTotal:     maxTotal,
+		maxPerIP:     maxPerIP,
+		maxPerSubnet: maxPerSubnet,
+	}
+}
+
+func getSubnet(ip net.IP) string {
+	if ipv4 := ip.To4(); ipv4 != nil {
+		return ipv4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String()
+}
+
+func newInboundConnection(remote net.Addr, transport io.Closer) *inboundConnection {
+	host := remote.String()
+	if hostOnly, _, err := net.SplitHostPort(host); err == nil {
+		host = hostOnly
+	}
+	subnet := host
+	if ip := net.ParseIP(host); ip != nil {
+		subnet = getSubnet(ip)
+	}
+	return &inboundConnection{
+		ip:        host,
+		subnet:    subnet,
+		transport: transport,
+	}
+}
+
+// acquire reserves a slot for the connection, evicting the least useful inbound peer if all the slots are taken
+func (s *inboundSlots) acquire(conn *inboundConnection) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	perIP := uint32(0)
+	bySubnet := make(map[string][]*inboundConnection)
+	for each := range s.connections {
+		if each.ip == conn.ip {
+			perIP++
+		}
+		bySubnet[each.subnet] = append(bySubnet[each.subnet], each)
+	}
+	if perIP >= s.maxPerIP || uint32(len(bySubnet[conn.subnet])) >= s.maxPerSubnet {
+		return ErrTooManyConnections
+	}
+
+	if uint32(len(s.connections)) >= s.maxTotal {
+		evicted := s.selectEvictionUnsafe(bySubnet, conn.subnet)
+		if evicted == nil {
+			return ErrTooManyConnections
+		}
+		delete(s.connections, evicted)
+		evicted.transport.Close()
+	}
+
+	s.connections[conn] = struct{}{}
+	return nil
+}
+
+// selectEvictionUnsafe picks a peer from the most represented subnet, preferring the ones that haven't completed the handshake or stayed silent the longest.
+// Nothing is evicted if the newcomer's subnet would become the most represented one.
+func (s *inboundSlots) selectEvictionUnsafe(bySubnet map[string][]*inboundConnection, subnet string) *inboundConnection {
+	var group []*inboundConnection
+	for _, connections := range bySubnet {
+		if len(connections) > len(group) {
+			group = connections
+		}
+	}
+	if len(group) == 0 || len(bySubnet[subnet])+1 >= len(group) {
+		return nil
+	}
+
+	var result *inboundConnection
+	for _, each := range group {
+		if result == nil || each.getLastSeen() < result.getLastSeen() {
+			result = each
+		}
+	}
+	return result
+}
+
+func (s *inboundSlots) release(conn *inboundConnection) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.connections, conn)
+}
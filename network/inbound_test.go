@@ -0,0 +1,86 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package network
+
+import (
+	"net"
+	"testing"
+)
+
+type closer struct {
+	closed bool
+}
+
+func (c *closer) Close() error {
+	c.closed = true
+	return nil
+}
+
+func newTestConnection(address string) (*inboundConnection, *closer) {
+	transport := &closer{}
+	return newInboundConnection(&net.TCPAddr{IP: net.ParseIP(address), Port: 4004}, transport), transport
+}
+
+func TestInboundSlots(t *testing.T) {
+	slots := newInboundSlots(4, 2, 3)
+
+	first, firstTransport := newTestConnection("10.0.0.1")
+	if err := slots.acquire(first); err != nil {
+		t.Fatal(err)
+	}
+	second, _ := newTestConnection("10.0.0.1")
+	if err := slots.acquire(second); err != nil {
+		t.Fatal(err)
+	}
+	if conn, _ := newTestConnection("10.0.0.1"); slots.acquire(conn) != ErrTooManyConnections {
+		t.Fatalf("per IP limit is not enforced")
+	}
+	third, _ := newTestConnection("10.0.0.2")
+	if err := slots.acquire(third); err != nil {
+		t.Fatal(err)
+	}
+	if conn, _ := newTestConnection("10.0.0.3"); slots.acquire(conn) != ErrTooManyConnections {
+		t.Fatalf("per subnet limit is not enforced")
+	}
+	if conn, _ := newTestConnection("10.0.1.1"); slots.acquire(conn) != nil {
+		t.Fatalf("failed to acquire a slot from another subnet")
+	}
+
+	second.seen()
+	third.seen()
+	if conn, _ := newTestConnection("10.0.2.1"); slots.acquire(conn) != nil {
+		t.Fatalf("failed to evict")
+	}
+	if !firstTransport.closed {
+		t.Fatalf("the least useful peer should be evicted")
+	}
+
+	if conn, _ := newTestConnection("10.0.3.1"); slots.acquire(conn) != nil {
+		t.Fatalf("failed to evict from the most represented subnet")
+	}
+	if conn, _ := newTestConnection("10.0.4.1"); slots.acquire(conn) != ErrTooManyConnections {
+		t.Fatalf("diverse peers should not be evicted")
+	}
+	slots.release(second)
+	slots.release(third)
+	if conn, _ := newTestConnection("10.0.4.1"); slots.acquire(conn) != nil {
+		t.Fatalf("failed to acquire a released slot")
+	}
+}
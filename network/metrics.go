@@ -0,0 +1,54 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package network
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// MetricsSource reports the current values of its gauges and counters
+type MetricsSource interface {
+	Metrics() map[string]uint64
+}
+
+// MetricsHandler serves the metrics of all the sources in the Prometheus text format
+func MetricsHandler(sources ...MetricsSource) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		metrics := make(map[string]uint64)
+		for _, source := range sources {
+			for name, value := range source.Metrics() {
+				metrics[name] = value
+			}
+		}
+
+		names := make([]string, 0, len(metrics))
+		for name := range metrics {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		for _, name := range names {
+			fmt.Fprintf(w, "pasl_%s %d\n", name, metrics[name])
+		}
+	})
+}
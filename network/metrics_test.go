@@ -0,0 +1,39 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package network
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+type staticMetrics map[string]uint64
+
+func (m staticMetrics) Metrics() map[string]uint64 {
+	return m
+}
+
+func TestMetricsHandler(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	MetricsHandler(staticMetrics{"b": 2, "a": 1}, staticMetrics{"c": 3}).ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if body := recorder.Body.String(); body != "pasl_a 1\npasl_b 2\npasl_c 3\n" {
+		t.Fatalf("unexpected metrics %q", body)
+	}
+}
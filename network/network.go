@@ -26,28 +26,43 @@ import (
 	"io"
 	"net"
 	"net/url"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/modern-go/concurrent"
+	"github.com/pasl-project/pasl/defaults"
 	"github.com/pasl-project/pasl/utils"
 )
 
 var (
 	ErrDuplicateConnection = errors.New("Duplicate connection")
 	ErrLoopbackConnection  = errors.New("Loopback connection")
+	ErrBannedPeer          = errors.New("Banned peer")
 )
 
 type Config struct {
-	ListenAddr     string
-	MaxIncoming    uint32
-	MaxOutgoing    uint32
-	TimeoutConnect time.Duration
+	ListenAddr           string
+	MaxIncoming          uint32
+	MaxIncomingPerIP     uint32
+	MaxIncomingPerSubnet uint32
+	MaxOutgoing          uint32
+	TimeoutConnect       time.Duration
+	TimeoutHandshake     time.Duration
+	Filter               *AddressFilter // nil allows global unicast addresses only
+	Proxy                string         // socks5://[user:password@]host:port for outbound connections, empty to connect directly
+	DisableInbound       bool
+	Bandwidth            *Bandwidth // nil to neither account nor limit the traffic
 }
 
 type Node struct {
-	config Config
-	peers  *PeersList
+	config      Config
+	peers       *PeersList
+	bans        *BansList
+	connections *sync.Map
+	dial        dialer
 }
 
 type Peer struct {
@@ -55,6 +70,13 @@ type Peer struct {
 	LastConnectTimestamp uint32
 	ReconnectPenalty     uint32
 	LastSeen             uint64
+	Successes            uint32
+	Failures             uint32
+	FailuresInRow        uint32
+	Latency              uint32 // moving average of the connection setup time in milliseconds
+	Source               string // network group of the peer that announced the address, empty for the trusted ones
+	ConnectedSince       uint32
+	Anchor               bool // long-lived good outbound peer, reconnected first after restart
 }
 
 type Connection struct {
@@ -70,52 +92,112 @@ type PeerInfo struct {
 	LastConnect uint32
 }
 
-func WithNode(config Config, peers *PeersList, peerUpdates <-chan PeerInfo, onNewConnection func(context.Context, *Connection) error, fn func(node Node) error) error {
+// PeerUpdate is the peer address learned from the Source connection
+type PeerUpdate struct {
+	Peer   PeerInfo
+	Source string
+}
+
+func WithNode(config Config, peers *PeersList, bans *BansList, peerUpdates <-chan PeerUpdate, onNewConnection func(context.Context, *Connection) error, fn func(node Node) error) error {
 	node := Node{
-		config: config,
-		peers:  peers,
+		config:      config,
+		peers:       peers,
+		bans:        bans,
+		connections: &sync.Map{},
 	}
-
-	l, err := net.Listen("tcp", config.ListenAddr)
+	dial, err := newDialer(config.Proxy, config.TimeoutConnect)
 	if err != nil {
 		return err
 	}
-	utils.Tracef("Node listening %v", config.ListenAddr)
+	node.dial = dial
 
-	handler := concurrent.NewUnboundedExecutor()
-	handler.Go(func(ctx context.Context) {
-		wg := sync.WaitGroup{}
-		defer wg.Wait()
+	if config.DisableInbound {
+		utils.Tracef("Inbound connections are disabled")
+	} else {
+		inbound := newInboundSlots(config.MaxIncoming, config.MaxIncomingPerIP, config.MaxIncomingPerSubnet)
 
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			default:
-				break
-			}
+		l, err := net.Listen("tcp", config.ListenAddr)
+		if err != nil {
+			return err
+		}
+		utils.Tracef("Node listening %v", config.ListenAddr)
+
+		handler := concurrent.NewUnboundedExecutor()
+		handler.Go(func(ctx context.Context) {
+			wg := sync.WaitGroup{}
+			defer wg.Wait()
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				default:
+					break
+				}
+
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+
+				if node.bans.IsBanned(BanKeyFromAddress(conn.RemoteAddr().String())) {
+					conn.Close()
+					continue
+				}
+				if !node.config.Filter.AllowedAddress(conn.RemoteAddr().String()) {
+					utils.Tracef("Rejected inbound connection %s: address is not allowed", conn.RemoteAddr().String())
+					conn.Close()
+					continue
+				}
+
+				slot := newInboundConnection(conn.RemoteAddr(), conn)
+				if err := inbound.acquire(slot); err != nil {
+					utils.Tracef("Rejected inbound connection %s: %v", conn.RemoteAddr().String(), err)
+					conn.Close()
+					continue
+				}
 
-			conn, err := l.Accept()
-			if err != nil {
-				return
-			}
+				wg.Add(1)
+				go func(conn net.Conn) {
+					defer wg.Done()
+					defer inbound.release(slot)
 
-			onNewConnection(ctx, &Connection{
-				Address:        "tcp://" + conn.RemoteAddr().String(),
-				Outgoing:       false,
-				Transport:      conn,
-				OnStateUpdated: nil,
-			})
-		}
-	})
-	defer handler.StopAndWaitForever()
-	defer l.Close()
+					handshakeDone := uint32(0)
+					deadline := time.AfterFunc(node.config.TimeoutHandshake, func() {
+						if atomic.LoadUint32(&handshakeDone) == 0 {
+							utils.Tracef("Handshake timeout %s", conn.RemoteAddr().String())
+							conn.Close()
+						}
+					})
+					defer deadline.Stop()
+
+					address := "tcp://" + conn.RemoteAddr().String()
+					transport := node.config.Bandwidth.Meter(conn)
+					node.connections.Store(address, transport)
+					defer node.connections.Delete(address)
+
+					onNewConnection(ctx, &Connection{
+						Address:   address,
+						Outgoing:  false,
+						Transport: transport,
+						OnStateUpdated: func() {
+							atomic.StoreUint32(&handshakeDone, 1)
+							slot.seen()
+						},
+					})
+				}(conn)
+			}
+		})
+		defer handler.StopAndWaitForever()
+		defer l.Close()
+	}
 
 	scheduler := concurrent.NewUnboundedExecutor()
 	scheduler.Go(func(ctx context.Context) {
 		wg := sync.WaitGroup{}
 		defer wg.Wait()
 
+		lastEviction := time.Now()
 		for {
 			select {
 			case <-ctx.Done():
@@ -124,6 +206,14 @@ func WithNode(config Config, peers *PeersList, peerUpdates <-chan PeerInfo, onNe
 				break
 			}
 
+			if time.Since(lastEviction) >= defaults.PeersEvictionInterval {
+				lastEviction = time.Now()
+				if evicted := node.peers.Evict(defaults.PeerStaleAfter, defaults.PeerMaxFailures); evicted > 0 {
+					utils.Tracef("Evicted %d stale peers", evicted)
+				}
+				node.peers.UpdateAnchors(defaults.AnchorPeers)
+			}
+
 			for _, peer := range node.peers.ScheduleReconnect((int)(node.config.MaxOutgoing)) {
 				wg.Add(1)
 				go func(peer *Peer) {
@@ -134,20 +224,44 @@ func WithNode(config Config, peers *PeersList, peerUpdates <-chan PeerInfo, onNe
 					if err != nil {
 						return
 					}
+					if node.bans.IsBanned(BanKeyFromAddress(peer.Address)) {
+						return
+					}
+					if !node.allowed(peer.Address) {
+						return
+					}
 
-					d := net.Dialer{Timeout: node.config.TimeoutConnect}
-					conn, err := d.DialContext(ctx, "tcp", parsed.Host)
+					started := time.Now()
+					conn, err := node.dial.DialContext(ctx, "tcp", parsed.Host)
 					if err != nil {
 						// utils.Tracef("Connection failed: %v", err)
+						node.peers.SetFailed(peer)
 						return
 					}
+					latency := time.Since(started)
 
 					address := "tcp://" + conn.RemoteAddr().String()
+					transport := node.config.Bandwidth.Meter(conn)
+					node.connections.Store(address, transport)
+					defer node.connections.Delete(address)
+
+					handshakeDone := uint32(0)
+					defer func() {
+						if atomic.LoadUint32(&handshakeDone) == 0 {
+							node.peers.SetFailed(peer)
+						}
+					}()
+
 					switch err = onNewConnection(ctx, &Connection{
-						Address:        address,
-						Outgoing:       true,
-						Transport:      conn,
-						OnStateUpdated: func() { peer.LastSeen = uint64(time.Now().Unix()) },
+						Address:   address,
+						Outgoing:  true,
+						Transport: transport,
+						OnStateUpdated: func() {
+							if atomic.CompareAndSwapUint32(&handshakeDone, 0, 1) {
+								node.peers.SetSucceeded(peer, latency)
+							}
+							node.peers.SetSeen(peer)
+						},
 					}); err {
 					case ErrLoopbackConnection:
 						node.peers.Forbid(peer.Address)
@@ -163,8 +277,8 @@ func WithNode(config Config, peers *PeersList, peerUpdates <-chan PeerInfo, onNe
 	updatesListener.Go(func(ctx context.Context) {
 		for {
 			select {
-			case peer := <-peerUpdates:
-				node.AddPeer(fmt.Sprintf("tcp://%s:%d", peer.Host, peer.Port))
+			case update := <-peerUpdates:
+				node.addLearnedPeer("tcp://"+net.JoinHostPort(update.Peer.Host, strconv.Itoa(int(update.Peer.Port))), update.Source)
 			case <-ctx.Done():
 				return
 			}
@@ -180,27 +294,116 @@ func (node *Node) GetPeersByNetwork(network string) map[string]Peer {
 }
 
 func (node *Node) AddPeer(address string) error {
-	parsed, err := url.Parse(address)
+	resolved, err := node.resolvePeer(address)
 	if err != nil {
 		return err
 	}
 
+	node.peers.Add(resolved, nil)
+	return nil
+}
+
+func (node *Node) addLearnedPeer(address string, source string) error {
+	resolved, err := node.resolvePeer(address)
+	if err != nil {
+		return err
+	}
+
+	node.peers.AddLearned(resolved, source)
+	return nil
+}
+
+func (node *Node) resolvePeer(address string) (string, error) {
+	parsed, err := url.Parse(address)
+	if err != nil {
+		return "", err
+	}
+
 	if parsed.Scheme != "tcp" {
-		return fmt.Errorf("Unsupported network '%v'", parsed.Scheme)
+		return "", fmt.Errorf("Unsupported network '%v'", parsed.Scheme)
+	}
+
+	// host names are resolved by the proxy
+	if node.config.Proxy != "" && net.ParseIP(parsed.Hostname()) == nil {
+		if parsed.Port() == "" {
+			return "", fmt.Errorf("Port is not specified %s", address)
+		}
+		return "tcp://" + parsed.Host, nil
 	}
 
 	tcp, err := net.ResolveTCPAddr("tcp", parsed.Host)
 	if err != nil {
-		return fmt.Errorf("Failed to resolve TCP addresss %s %v", address, err)
+		return "", fmt.Errorf("Failed to resolve TCP addresss %s %v", address, err)
 	}
-	if !tcp.IP.IsGlobalUnicast() {
-		return fmt.Errorf("IP Address %s didn't pass the validation", address)
+	if !node.config.Filter.Allowed(tcp.IP) {
+		return "", fmt.Errorf("IP Address %s didn't pass the validation", address)
 	}
 
-	node.peers.Add("tcp://"+tcp.String(), nil)
-	return nil
+	return "tcp://" + tcp.String(), nil
+}
+
+// allowed checks the address against the filter, unresolved host names are only possible when connecting through the proxy
+func (node *Node) allowed(address string) bool {
+	if node.config.Proxy != "" && net.ParseIP(BanKeyFromAddress(address)) == nil {
+		return true
+	}
+	return node.config.Filter.AllowedAddress(address)
 }
 
 func (node *Node) AddPeerSerialized(serialized []byte) error {
 	return node.peers.AddSerialized(serialized)
 }
+
+// Disconnect closes the connections to the address, the address without a port matches all the connections to the host
+func (node *Node) Disconnect(address string) bool {
+	if !strings.Contains(address, "://") {
+		address = "tcp://" + address
+	}
+	host := BanKeyFromAddress(address)
+	_, _, err := net.SplitHostPort(strings.TrimPrefix(address, "tcp://"))
+	hostOnly := err != nil
+
+	disconnected := false
+	node.connections.Range(func(connected, conn interface{}) bool {
+		if connected.(string) == address || (hostOnly && BanKeyFromAddress(connected.(string)) == host) {
+			conn.(io.Closer).Close()
+			disconnected = true
+		}
+		return true
+	})
+	return disconnected
+}
+
+func (node *Node) GetHandlers() map[string]interface{} {
+	return map[string]interface{}{
+		"addnode":        node.AddNode,
+		"disconnectnode": node.DisconnectNode,
+	}
+}
+
+// AddNode queues the semicolon separated host:port list for connection, returns the number of accepted addresses
+func (node *Node) AddNode(_ context.Context, params *struct{ Nodes string }) (int, error) {
+	added := 0
+	var lastErr error
+	for _, address := range strings.FieldsFunc(params.Nodes, func(r rune) bool { return r == ';' || r == ',' || r == ' ' }) {
+		if !strings.Contains(address, "://") {
+			address = "tcp://" + address
+		}
+		if err := node.AddPeer(address); err != nil {
+			lastErr = err
+			continue
+		}
+		added++
+	}
+	if added == 0 && lastErr != nil {
+		return 0, lastErr
+	}
+	return added, nil
+}
+
+func (node *Node) DisconnectNode(_ context.Context, params *struct{ Address string }) (bool, error) {
+	if !node.Disconnect(params.Address) {
+		return false, fmt.Errorf("not connected to %s", params.Address)
+	}
+	return true, nil
+}
@@ -0,0 +1,198 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package network
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pasl-project/pasl/defaults"
+)
+
+type closerFunc func() error
+
+func (fn closerFunc) Close() error {
+	return fn()
+}
+
+func TestNodeManagement(t *testing.T) {
+	node := Node{
+		peers:       NewPeersList(),
+		connections: &sync.Map{},
+	}
+
+	added, err := node.AddNode(context.Background(), &struct{ Nodes string }{"8.8.8.8:4004;tcp://8.8.4.4:4004;invalid"})
+	if err != nil || added != 2 {
+		t.Fatalf("unexpected result %d %v", added, err)
+	}
+	if node.peers.Queued.Len() != 2 {
+		t.Fatalf("peers are not queued")
+	}
+
+	closed := make(map[string]bool)
+	for _, address := range []string{"tcp://10.0.0.1:4004", "tcp://10.0.0.1:5005", "tcp://10.0.0.2:4004"} {
+		address := address
+		node.connections.Store(address, closerFunc(func() error {
+			closed[address] = true
+			return nil
+		}))
+	}
+	if !node.Disconnect("10.0.0.2:4004") || len(closed) != 1 || !closed["tcp://10.0.0.2:4004"] {
+		t.Fatalf("unexpected connections closed %v", closed)
+	}
+	if !node.Disconnect("10.0.0.1") || len(closed) != 3 {
+		t.Fatalf("host connections are not closed %v", closed)
+	}
+	if _, err := node.DisconnectNode(context.Background(), &struct{ Address string }{"10.0.0.3:4004"}); err == nil {
+		t.Fatal("unknown address is disconnected")
+	}
+}
+
+func TestPeersHealth(t *testing.T) {
+	peers := NewPeersList()
+	for _, address := range []string{"tcp://10.0.0.1:4004", "tcp://10.0.0.2:4004", "tcp://10.0.0.3:4004"} {
+		peers.Add(address, nil)
+	}
+	get := func(address string) *Peer {
+		peer, _ := peers.Queued.Get(address)
+		return peer.(*Peer)
+	}
+
+	unreliable := get("tcp://10.0.0.1:4004")
+	peers.SetFailed(unreliable)
+	reliable := get("tcp://10.0.0.3:4004")
+	peers.SetSucceeded(reliable, 100*time.Millisecond)
+	peers.SetSucceeded(reliable, 200*time.Millisecond)
+	if reliable.Latency != 125 || reliable.FailuresInRow != 0 {
+		t.Fatalf("unexpected peer stats %+v", reliable)
+	}
+
+	scheduled := peers.ScheduleReconnect(2)
+	if len(scheduled) != 2 || scheduled[0] != reliable || scheduled[1].Address != "tcp://10.0.0.2:4004" {
+		t.Fatalf("reliable peers are not preferred %v", scheduled)
+	}
+	for _, peer := range scheduled {
+		peers.SetDisconnected(peer)
+	}
+
+	for each := uint32(1); each < 3; each++ {
+		peers.SetFailed(unreliable)
+	}
+	get("tcp://10.0.0.2:4004").LastSeen = uint64(time.Now().Add(-2 * time.Hour).Unix())
+	reliable.LastSeen = uint64(time.Now().Unix())
+	if evicted := peers.Evict(time.Hour, 3); evicted != 2 || peers.Queued.Len() != 1 {
+		t.Fatalf("unexpected eviction, %d evicted %d left", evicted, peers.Queued.Len())
+	}
+	if _, ok := peers.Queued.Get("tcp://10.0.0.3:4004"); !ok {
+		t.Fatal("reliable peer was evicted")
+	}
+}
+
+func TestEclipseResistance(t *testing.T) {
+	if group := addressGroup("tcp://10.1.2.3:4004"); group != "10.1.0.0/16" {
+		t.Fatalf("unexpected group %s", group)
+	}
+	if group := addressGroup("tcp://[2001:db8:1::1]:4004"); group != "2001:db8::/32" {
+		t.Fatalf("unexpected group %s", group)
+	}
+
+	peers := NewPeersList()
+	added := 0
+	for each := 0; each < 20; each++ {
+		if peers.AddLearned(fmt.Sprintf("tcp://10.1.0.%d:4004", each+1), "tcp://20.0.0.1:4004") {
+			added++
+		}
+	}
+	if uint32(added) != defaults.PeersPerBucket {
+		t.Fatalf("bucket limit is not enforced, %d added", added)
+	}
+	if !peers.AddLearned("tcp://10.1.0.100:4004", "tcp://30.0.0.1:4004") {
+		t.Fatal("address from another source is rejected")
+	}
+
+	scheduled := peers.ScheduleReconnect(10)
+	if uint32(len(scheduled)) != defaults.MaxOutgoingPerGroup {
+		t.Fatalf("outgoing group limit is not enforced, %d scheduled", len(scheduled))
+	}
+
+	peers.Add("tcp://40.0.0.1:4004", nil)
+	peers.SetSucceeded(scheduled[1], time.Millisecond)
+	peers.UpdateAnchors(1)
+	for _, peer := range scheduled {
+		peers.SetDisconnected(peer)
+	}
+	if !scheduled[1].Anchor || scheduled[0].Anchor {
+		t.Fatalf("unexpected anchors %+v", scheduled)
+	}
+	scheduled[1].LastConnectTimestamp = 0
+	scheduled[1].ReconnectPenalty = 0
+	if next := peers.ScheduleReconnect(1); len(next) != 1 || next[0] != scheduled[1] {
+		t.Fatalf("anchor is not reconnected first %v", next)
+	}
+}
+
+func TestAddressFilter(t *testing.T) {
+	var strict *AddressFilter
+	if strict.AllowedAddress("tcp://127.0.0.1:4004") || strict.AllowedAddress("tcp://192.168.1.1:4004") || !strict.AllowedAddress("tcp://[2001:4860::1]:4004") {
+		t.Fatal("default filter allows non-global addresses")
+	}
+
+	private, err := NewAddressFilter(nil, []string{"192.168.2.0/24", "fd00::1"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for address, allowed := range map[string]bool{
+		"tcp://127.0.0.1:4004":   true,
+		"tcp://192.168.1.1:4004": true,
+		"tcp://192.168.2.1:4004": false,
+		"tcp://[fd00::2]:4004":   true,
+		"tcp://[fd00::1]:4004":   false,
+		"tcp://0.0.0.0:4004":     false,
+	} {
+		if private.AllowedAddress(address) != allowed {
+			t.Fatalf("unexpected filter result for %s", address)
+		}
+	}
+
+	allowList, err := NewAddressFilter([]string{"10.0.0.0/8"}, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !allowList.AllowedAddress("tcp://10.1.1.1:4004") || allowList.AllowedAddress("tcp://8.8.8.8:4004") {
+		t.Fatal("allow list is not enforced")
+	}
+	if _, err := NewAddressFilter([]string{"10.0.0.0/33"}, nil, false); err == nil {
+		t.Fatal("invalid CIDR is accepted")
+	}
+
+	node := Node{peers: NewPeersList(), config: Config{Filter: private}}
+	if err := node.AddPeer("tcp://[::1]:4004"); err != nil {
+		t.Fatal(err)
+	}
+	if err := node.AddPeer("tcp://192.168.2.5:4004"); err == nil {
+		t.Fatal("denied address is added")
+	}
+	if _, ok := node.peers.Queued.Get("tcp://[::1]:4004"); !ok {
+		t.Fatal("IPv6 peer is not queued")
+	}
+}
@@ -0,0 +1,93 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package pasl
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pasl-project/pasl/common"
+)
+
+// capability is the optional protocol extension, PascalCoin peers support none of them
+type capability uint32
+
+const (
+	capabilityCompactBlocks capability = 1 << iota
+	capabilitySafebox
+	capabilityPendingOperations
+	capabilityAccounts
+)
+
+// capabilitiesSince lists the first PASL release supporting every capability, the release is advertised in the user agent
+var capabilitiesSince = map[capability]common.Version{
+	capabilityCompactBlocks:     {Major: 0, Minor: 2},
+	capabilitySafebox:           {Major: 0, Minor: 2},
+	capabilityPendingOperations: {Major: 0, Minor: 2},
+	capabilityAccounts:          {Major: 0, Minor: 2},
+}
+
+var capabilityNames = map[capability]string{
+	capabilityCompactBlocks:     "compact-blocks",
+	capabilitySafebox:           "safebox",
+	capabilityPendingOperations: "pending-operations",
+	capabilityAccounts:          "accounts",
+}
+
+func (c capability) String() string {
+	names := make([]string, 0)
+	for bit := capability(1); bit != 0 && bit <= c; bit <<= 1 {
+		if c&bit == 0 {
+			continue
+		}
+		if name, ok := capabilityNames[bit]; ok {
+			names = append(names, name)
+		} else {
+			names = append(names, fmt.Sprintf("%#x", uint32(bit)))
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// parseUserAgent extracts the PASL release from the user agent, ok is false for the other implementations
+func parseUserAgent(userAgent string) (version common.Version, ok bool) {
+	if _, err := fmt.Sscanf(userAgent, "PASL v%d.%d", &version.Major, &version.Minor); err != nil {
+		return version, false
+	}
+	return version, true
+}
+
+// capabilitiesOf negotiates the capabilities with the peer by its user agent
+func capabilitiesOf(userAgent string) capability {
+	version, ok := parseUserAgent(userAgent)
+	if !ok {
+		return 0
+	}
+	result := capability(0)
+	for each, since := range capabilitiesSince {
+		if version.Major > since.Major || (version.Major == since.Major && version.Minor >= since.Minor) {
+			result |= each
+		}
+	}
+	return result
+}
@@ -0,0 +1,178 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package pasl
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/pasl-project/pasl/safebox"
+	"github.com/pasl-project/pasl/safebox/tx"
+	"github.com/pasl-project/pasl/utils"
+)
+
+// shortId is the truncated hash of the operation key, collisions only cost an extra round trip
+func shortId(key string) uint64 {
+	hash := sha256.Sum256([]byte(key))
+	return binary.LittleEndian.Uint64(hash[:8])
+}
+
+func newCompactBlock(block *safebox.SerializedBlock) packetNewBlockCompact {
+	shortIds := make([]uint64, 0, len(block.Operations))
+	for index := range block.Operations {
+		shortIds = append(shortIds, shortId(operationKey(block.Operations[index].CommonOperation)))
+	}
+	return packetNewBlockCompact{
+		Header:   block.Header,
+		ShortIds: shortIds,
+	}
+}
+
+func (this *PascalConnection) onNewBlockCompactNotification(request *requestResponse, payload []byte) ([]byte, error) {
+	var packet packetNewBlockCompact
+	if err := utils.Deserialize(&packet, bytes.NewBuffer(payload)); err != nil {
+		return nil, err
+	}
+
+	utils.Tracef("[P2P %s] New compact block %d, %d operations", this.logPrefix, packet.Header.Index, len(packet.ShortIds))
+	this.knownBlocks.Add(blockKey(&safebox.SerializedBlock{Header: packet.Header}))
+	// the missing operations are requested from the peer by compactBlocksLoop, the connection keeps on reading meanwhile
+	select {
+	case this.compactBlocks <- &packet:
+	default:
+		utils.Tracef("[P2P %s] Compact blocks queue is full, block %d dropped", this.logPrefix, packet.Header.Index)
+	}
+
+	return nil, nil
+}
+
+// compactBlocksLoop rebuilds the compact blocks announced by the peer one at a time
+func (this *PascalConnection) compactBlocksLoop(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case packet := <-this.compactBlocks:
+			block, err := this.rebuildBlock(ctx, packet)
+			if err != nil {
+				utils.Tracef("[P2P %s] Failed to rebuild compact block %d: %v", this.logPrefix, packet.Header.Index, err)
+				continue
+			}
+			select {
+			case this.onNewBlock <- &eventNewBlock{
+				event:           event{this},
+				SerializedBlock: *block,
+				shouldBroadcast: true,
+			}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// rebuildBlock restores the block from the pool and the operations fetched from the peer, falls back to the full block download
+func (this *PascalConnection) rebuildBlock(ctx context.Context, packet *packetNewBlockCompact) (*safebox.SerializedBlock, error) {
+	pool := this.blockchain.GetTxPool()
+	byShortId := make(map[uint64]tx.CommonOperation, len(pool))
+	for operation := range pool {
+		byShortId[shortId(operationKey(operation))] = operation
+	}
+
+	operations := make([]tx.CommonOperation, len(packet.ShortIds))
+	missing := make([]uint32, 0)
+	for index, id := range packet.ShortIds {
+		if operation, ok := byShortId[id]; ok {
+			operations[index] = operation
+		} else {
+			missing = append(missing, uint32(index))
+		}
+	}
+
+	rebuilt := len(missing) == 0
+	if !rebuilt {
+		var response packetGetBlockOperationsResponse
+		err := this.request(ctx, getBlockOperations, utils.Serialize(packetGetBlockOperationsRequest{
+			Index:          packet.Header.Index,
+			OperationsHash: packet.Header.OperationsHash,
+			Indices:        missing,
+		}), &response)
+		if err == nil && len(response.Fetched.Operations) == len(missing) {
+			for index := range missing {
+				operations[missing[index]] = response.Fetched.Operations[index]
+			}
+			rebuilt = true
+		}
+	}
+	if rebuilt {
+		if hash := safebox.GetOperationsHash(operations); bytes.Equal(hash[:], packet.Header.OperationsHash) {
+			return &safebox.SerializedBlock{
+				Header:     packet.Header,
+				Operations: tx.ToTxSerialized(operations),
+			}, nil
+		}
+	}
+
+	utils.Tracef("[P2P %s] Compact block %d mismatch, downloading the full block", this.logPrefix, packet.Header.Index)
+	var response packetGetBlocksResponse
+	err := this.request(ctx, getBlocks, utils.Serialize(packetGetBlocksRequest{
+		FromIndex: packet.Header.Index,
+		ToIndex:   packet.Header.Index,
+	}), &response)
+	if err != nil || len(response.Blocks) != 1 || !bytes.Equal(response.Blocks[0].Header.OperationsHash, packet.Header.OperationsHash) {
+		return nil, fmt.Errorf("block %d is unavailable", packet.Header.Index)
+	}
+	return &response.Blocks[0], nil
+}
+
+func (this *PascalConnection) onGetBlockOperationsRequest(request *requestResponse, payload []byte) ([]byte, error) {
+	utils.Tracef("[P2P %s] %s", this.logPrefix, request.GetType())
+
+	var packet packetGetBlockOperationsRequest
+	if err := utils.Deserialize(&packet, bytes.NewBuffer(payload)); err != nil {
+		return nil, err
+	}
+
+	block, err := this.blockchain.GetBlock(packet.Index)
+	if err != nil || !bytes.Equal(block.GetOperationsHash(), packet.OperationsHash) {
+		// the block might be replaced by a competing one already
+		request.result.setError(internalServerError)
+		return nil, nil
+	}
+
+	operations := block.GetOperations()
+	response := packetGetBlockOperationsResponse{
+		Fetched: tx.OperationsNetwork{
+			Operations: make([]tx.CommonOperation, 0, len(packet.Indices)),
+		},
+	}
+	for _, index := range packet.Indices {
+		if index >= uint32(len(operations)) {
+			return nil, fmt.Errorf("Operation index %d is out of range", index)
+		}
+		response.Fetched.Operations = append(response.Fetched.Operations, operations[index])
+	}
+
+	request.result.setError(success)
+	return utils.Serialize(&response), nil
+}
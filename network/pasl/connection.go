@@ -25,13 +25,17 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"math/rand"
 	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/modern-go/concurrent"
+	"github.com/pasl-project/pasl/accounter"
 	"github.com/pasl-project/pasl/blockchain"
+	"github.com/pasl-project/pasl/common"
+	"github.com/pasl-project/pasl/crypto"
 	"github.com/pasl-project/pasl/defaults"
 	"github.com/pasl-project/pasl/network"
 	"github.com/pasl-project/pasl/safebox"
@@ -43,11 +47,12 @@ type PascalConnection struct {
 	logPrefix      string
 	underlying     *protocol
 	blockchain     *blockchain.Blockchain
+	clock          *common.AdjustedClock
 	p2pPort        uint16
 	peers          *network.PeersList
 	nonce          []byte
 	remoteNonce    []byte
-	peerUpdates    chan<- network.PeerInfo
+	peerUpdates    chan<- network.PeerUpdate
 	onStateUpdate  chan<- eventConnectionState
 	onNewBlock     chan *eventNewBlock
 	onNewOperation chan<- *eventNewOperation
@@ -56,18 +61,48 @@ type PascalConnection struct {
 	postHandshake  func(*PascalConnection) error
 	handshakeDone  uint32
 	outgoing       bool
+	light          bool
 	periodic       *concurrent.UnboundedExecutor
+	workers        *workerPool
+	knownBlocks    *inventory
+	knownOps       *inventory
+	relay          chan tx.CommonOperation
+	compactBlocks  chan *packetNewBlockCompact
+	capabilities   uint32
+	infoLock       sync.Mutex
+	userAgent      string
+	version        common.Version
+	topBlockIndex  uint32
+	safeboxHash    []byte
+	connectedAt    time.Time
+	meter          *network.MeteredTransport
+	lastSeen       uint32
+	pingRtt        uint32
+	historyStart   uint32
 }
 
 func (p *PascalConnection) OnOpen() error {
 	p.underlying.knownOperations[hello] = p.onHelloRequest
 	p.underlying.knownOperations[errorReport] = p.onErrorReport
 	p.underlying.knownOperations[message] = p.onMessageRequest
-	p.underlying.knownOperations[getBlocks] = p.onGetBlocksRequest
-	p.underlying.knownOperations[getHeaders] = p.onGetHeadersRequest
+	p.underlying.knownOperations[getBlocks] = p.historical(p.heavy(p.onGetBlocksRequest))
+	p.underlying.knownOperations[getHeaders] = p.heavy(p.onGetHeadersRequest)
+	p.underlying.knownOperations[getSafebox] = p.requires(capabilitySafebox, p.heavy(p.onGetSafeboxRequest))
+	p.underlying.knownOperations[getPendingOperations] = p.requires(capabilityPendingOperations, p.heavy(p.onGetPendingOperationsRequest))
+	p.underlying.knownOperations[getAccount] = p.requires(capabilityAccounts, p.onGetAccountRequest)
+	p.underlying.knownOperations[getBlockOperations] = p.requires(capabilityCompactBlocks, p.heavy(p.onGetBlockOperationsRequest))
 	p.underlying.knownOperations[newBlock] = p.onNewBlockNotification
+	p.underlying.knownOperations[newBlockCompact] = p.requires(capabilityCompactBlocks, p.onNewBlockCompactNotification)
 	p.underlying.knownOperations[newOperations] = p.onNewOperationsNotification
+	p.knownBlocks = newInventory(defaults.NetworkInventorySize)
+	p.knownOps = newInventory(defaults.NetworkInventorySize)
+	p.relay = make(chan tx.CommonOperation, defaults.NetworkEventsQueue)
+	p.compactBlocks = make(chan *packetNewBlockCompact, defaults.NetworkCompactBlocksQueue)
 	p.periodic = concurrent.NewUnboundedExecutor()
+	p.periodic.Go(p.underlying.dispatchLoop)
+	p.periodic.Go(p.underlying.writeLoop)
+	p.periodic.Go(p.relayLoop)
+	p.periodic.Go(p.compactBlocksLoop)
 
 	if p.outgoing {
 		p.periodic.Go(p.PeriodicPing)
@@ -77,14 +112,42 @@ func (p *PascalConnection) OnOpen() error {
 }
 
 func (this *PascalConnection) OnData(data []byte) error {
+	atomic.StoreUint32(&this.lastSeen, uint32(time.Now().Unix()))
 	return this.underlying.OnData(data)
 }
 
 func (p *PascalConnection) OnClose() {
 	p.periodic.StopAndWaitForever()
+	// the requests still waiting for the response are failed right away instead of timing out
+	p.underlying.Close()
 	p.closed <- p
 }
 
+// heavy offloads the handler to the shared worker pool, the connection keeps on reading meanwhile
+func (p *PascalConnection) heavy(handler requestHandler) requestHandler {
+	if p.workers == nil {
+		return handler
+	}
+	return func(request *requestResponse, payload []byte) (out []byte, err error) {
+		p.workers.Do(func() {
+			out, err = handler(request, payload)
+		})
+		return
+	}
+}
+
+// historical holds the response back until it fits the historical blocks limit, the worker serving the request
+// is released by then so that throttled peers don't stall the rest
+func (p *PascalConnection) historical(handler requestHandler) requestHandler {
+	return func(request *requestResponse, payload []byte) ([]byte, error) {
+		out, err := handler(request, payload)
+		if err == nil && !p.meter.WaitHistorical(len(out)) {
+			return nil, errClosed
+		}
+		return out, err
+	}
+}
+
 func (p *PascalConnection) PeriodicPing(ctx context.Context) {
 	interval := time.Duration(30) * time.Second
 	for {
@@ -96,7 +159,13 @@ func (p *PascalConnection) PeriodicPing(ctx context.Context) {
 
 		if topBlock, err := p.blockchain.GetTopBlock(); err == nil {
 			payload := generateHello(p.p2pPort, p.nonce, p.blockchain.SerializeBlockHeader(topBlock, false, false), p.peers.GetAllSeen(), defaults.UserAgent)
-			p.underlying.sendRequest(hello, payload, p.onHelloCommon)
+			sent := time.Now()
+			p.underlying.sendRequest(hello, payload, func(response *requestResponse, payload []byte) error {
+				if response != nil {
+					atomic.StoreUint32(&p.pingRtt, uint32(time.Since(sent)/time.Microsecond))
+				}
+				return p.onHelloCommon(response, payload)
+			})
 		}
 
 		select {
@@ -112,6 +181,70 @@ func (p *PascalConnection) GetRemoteNonce() []byte {
 	return p.remoteNonce
 }
 
+func (p *PascalConnection) GetUserAgent() string {
+	p.infoLock.Lock()
+	defer p.infoLock.Unlock()
+	return p.userAgent
+}
+
+// GetVersion returns the protocol version the peer speaks and the newest one it's aware of
+func (p *PascalConnection) GetVersion() common.Version {
+	p.infoLock.Lock()
+	defer p.infoLock.Unlock()
+	return p.version
+}
+
+// supports tells whether the capability was negotiated during the handshake
+func (p *PascalConnection) supports(c capability) bool {
+	return capability(atomic.LoadUint32(&p.capabilities))&c != 0
+}
+
+// requires serves the request only if the peer has advertised the capability, the rest are answered with notImplemented
+// so that PascalCoin peers aren't disconnected
+func (p *PascalConnection) requires(c capability, handler requestHandler) requestHandler {
+	return func(request *requestResponse, payload []byte) ([]byte, error) {
+		if !p.supports(c) {
+			request.result.setError(notImplemented)
+			return nil, nil
+		}
+		return handler(request, payload)
+	}
+}
+
+// lacksHistory remembers the peer has refused the block, fast synced peers don't store the blocks preceding their safebox
+func (p *PascalConnection) lacksHistory(index uint32) {
+	for {
+		start := atomic.LoadUint32(&p.historyStart)
+		if index < start || atomic.CompareAndSwapUint32(&p.historyStart, start, index+1) {
+			return
+		}
+	}
+}
+
+// servesHistory tells whether the peer is expected to serve the blocks starting from the index
+func (p *PascalConnection) servesHistory(from uint32) bool {
+	return from >= atomic.LoadUint32(&p.historyStart)
+}
+
+// refusesHistory answers the requests for the blocks the node doesn't store with historyUnavailable
+// instead of an empty list which the peer can't tell apart from the end of the chain
+func (p *PascalConnection) refusesHistory(request *requestResponse, from uint32) bool {
+	if from >= p.blockchain.GetHistoryStart() {
+		return false
+	}
+	utils.Tracef("[P2P %s] Refused %s starting from block %d, the blocks below %d are not stored", p.logPrefix, request.GetType(), from, p.blockchain.GetHistoryStart())
+	request.result.setError(historyUnavailable)
+	return true
+}
+
+func (p *PascalConnection) banKeys() []string {
+	keys := []string{network.BanKeyFromAddress(p.logPrefix)}
+	if nonce := p.GetRemoteNonce(); nonce != nil {
+		keys = append(keys, network.BanKeyFromNonce(nonce))
+	}
+	return keys
+}
+
 func (this *PascalConnection) BlocksGet(from, to uint32) []safebox.SerializedBlock {
 	packet := utils.Serialize(packetGetBlocksRequest{
 		FromIndex: from,
@@ -128,6 +261,10 @@ func (this *PascalConnection) BlocksGet(from, to uint32) []safebox.SerializedBlo
 		if response == nil {
 			return errors.New("GetBlocks request failed")
 		}
+		if response.result.getError() == historyUnavailable {
+			this.lacksHistory(from)
+			return nil
+		}
 
 		var packet packetGetBlocksResponse
 		if err := utils.Deserialize(&packet, bytes.NewBuffer(payload)); err != nil {
@@ -145,19 +282,179 @@ func (this *PascalConnection) BlocksGet(from, to uint32) []safebox.SerializedBlo
 	return blocks
 }
 
-func (this *PascalConnection) BroadcastTx(operation tx.CommonOperation) {
-	packet := packetNewOperations{
-		OperationsNetwork: tx.OperationsNetwork{
-			Operations: []tx.CommonOperation{operation},
-		},
+// request sends the request and decodes the response into out, waits until the response is received or the context is done
+func (this *PascalConnection) request(ctx context.Context, operation operationId, payload []byte, out interface{}) error {
+	var result error
+
+	finished := make(chan struct{})
+	err := this.underlying.sendRequest(operation, payload, func(response *requestResponse, payload []byte) error {
+		defer close(finished)
+
+		if response == nil {
+			result = errors.New("Request failed")
+			return result
+		}
+		switch errorId := response.result.getError(); errorId {
+		case success:
+		case historyUnavailable:
+			result = errHistoryUnavailable
+			return nil
+		default:
+			result = fmt.Errorf("Request refused with error %d", errorId)
+			return nil
+		}
+
+		result = utils.Deserialize(out, bytes.NewBuffer(payload))
+		return result
+	})
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-finished:
+		return result
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (this *PascalConnection) HeadersGet(ctx context.Context, from, to uint32) ([]safebox.SerializedBlockHeader, error) {
+	var packet packetGetHeadersResponse
+	if err := this.request(ctx, getHeaders, utils.Serialize(packetGetBlocksRequest{
+		FromIndex: from,
+		ToIndex:   to,
+	}), &packet); err != nil {
+		if err == errHistoryUnavailable {
+			this.lacksHistory(from)
+		}
+		return nil, err
+	}
+	sort.Slice(packet.BlockHeaders, func(i, j int) bool { return packet.BlockHeaders[i].Index < packet.BlockHeaders[j].Index })
+	return packet.BlockHeaders, nil
+}
+
+func (this *PascalConnection) SafeboxGet(ctx context.Context, kind uint8, height uint32, safeboxHash []byte, from, count uint32) (*packetGetSafeboxResponse, error) {
+	var packet packetGetSafeboxResponse
+	if err := this.request(ctx, getSafebox, utils.Serialize(packetGetSafeboxRequest{
+		Kind:        kind,
+		Height:      height,
+		SafeboxHash: safeboxHash,
+		From:        from,
+		Count:       count,
+	}), &packet); err != nil {
+		return nil, err
+	}
+	return &packet, nil
+}
+
+// AccountsGet requests the states of the accounts taken at the reported height and safebox hash, the accounts unknown to the peer are omitted
+func (this *PascalConnection) AccountsGet(ctx context.Context, numbers []uint32) (height uint32, safeboxHash []byte, accounts []accounter.Account, err error) {
+	if len(numbers) > int(defaults.NetworkAccountsPerRequest) {
+		return 0, nil, nil, fmt.Errorf("Too many accounts requested %d", len(numbers))
+	}
+
+	var packet packetGetAccountResponse
+	if err := this.request(ctx, getAccount, utils.Serialize(packetGetAccountRequest{
+		Numbers: numbers,
+	}), &packet); err != nil {
+		return 0, nil, nil, err
+	}
+
+	accounts = make([]accounter.Account, 0, len(packet.Accounts))
+	for index := range packet.Accounts {
+		state := &packet.Accounts[index]
+		var publicKey crypto.Public
+		if err := crypto.PublicFromSerialized(&publicKey, state.PublicKey.TypeId, state.PublicKey.X, state.PublicKey.Y); err != nil {
+			return 0, nil, nil, fmt.Errorf("Invalid account %d public key: %v", state.Number, err)
+		}
+		accounts = append(accounts, accounter.NewAccount(state.Number, &publicKey, state.Balance, state.UpdatedIndex, state.Operations, state.OperationsTotal, state.Timestamp))
+	}
+	return packet.Height, packet.SafeboxHash, accounts, nil
+}
+
+// fetchPendingOperations pulls the peer's pending operations page by page, they are merged into the pool as if broadcasted
+func (this *PascalConnection) fetchPendingOperations(ctx context.Context) {
+	for start := uint32(0); start < defaults.NetworkOperationsLimit; {
+		var packet packetGetPendingOperationsResponse
+		if err := this.request(ctx, getPendingOperations, utils.Serialize(packetGetPendingOperationsRequest{
+			Start: start,
+			Max:   utils.MinUint32(defaults.NetworkOperationsPerPage, defaults.NetworkOperationsLimit-start),
+		}), &packet); err != nil {
+			utils.Tracef("[P2P %s] Failed to get pending operations: %v", this.logPrefix, err)
+			return
+		}
+
+		for _, op := range packet.Pending.Operations {
+			this.knownOps.Add(operationKey(op))
+			select {
+			case this.onNewOperation <- &eventNewOperation{event{this}, op, true}:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		start += uint32(len(packet.Pending.Operations))
+		if len(packet.Pending.Operations) == 0 || start >= packet.Total {
+			break
+		}
 	}
-	this.underlying.sendRequest(newOperations, utils.Serialize(&packet), nil)
 }
 
-func (this *PascalConnection) BroadcastBlock(block *safebox.SerializedBlock) {
+// BroadcastTx queues the operation unless the peer has it already, queued operations are announced in batches
+func (this *PascalConnection) BroadcastTx(operation tx.CommonOperation, key string) {
+	if !this.knownOps.Add(key) {
+		return
+	}
+	select {
+	case this.relay <- operation:
+	default:
+		utils.Tracef("[P2P %s] Relay queue is full, operation dropped", this.logPrefix)
+	}
+}
+
+// BroadcastBlock announces the block unless the peer has it already, compact is sent to the peers supporting it
+func (this *PascalConnection) BroadcastBlock(block *safebox.SerializedBlock, key string, compact []byte) {
+	if !this.knownBlocks.Add(key) {
+		return
+	}
+	if this.supports(capabilityCompactBlocks) {
+		this.underlying.sendRequest(newBlockCompact, compact, nil)
+		return
+	}
 	this.underlying.sendRequest(newBlock, utils.Serialize(packetNewBlock{*block}), nil)
 }
 
+// relayLoop flushes the queued operations every NetworkRelayInterval or as soon as the batch is full
+func (this *PascalConnection) relayLoop(ctx context.Context) {
+	ticker := time.NewTicker(defaults.NetworkRelayInterval)
+	defer ticker.Stop()
+
+	batch := make([]tx.CommonOperation, 0, defaults.NetworkOperationsPerPage)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case operation := <-this.relay:
+			if batch = append(batch, operation); len(batch) < int(defaults.NetworkOperationsPerPage) {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+
+		packet := packetNewOperations{
+			OperationsNetwork: tx.OperationsNetwork{
+				Operations: batch,
+			},
+		}
+		this.underlying.sendRequest(newOperations, utils.Serialize(&packet), nil)
+		batch = batch[:0]
+	}
+}
+
 func (this *PascalConnection) onHelloCommon(request *requestResponse, payload []byte) error {
 	if request == nil {
 		return fmt.Errorf("[P2P %s] Refused by remote side", this.logPrefix)
@@ -170,17 +467,40 @@ func (this *PascalConnection) onHelloCommon(request *requestResponse, payload []
 	}
 
 	utils.Tracef("[P2P %s] Top block %d SafeboxHash %s", this.logPrefix, packet.Block.Index, hex.EncodeToString(packet.Block.PrevSafeboxHash))
+	this.infoLock.Lock()
+	this.topBlockIndex = packet.Block.Index
+	this.safeboxHash = packet.Block.PrevSafeboxHash
+	this.infoLock.Unlock()
 	this.onStateUpdate <- eventConnectionState{event{this}, packet.Block.Index}
 
 	if atomic.CompareAndSwapUint32(&this.handshakeDone, 0, 1) {
 		this.remoteNonce = packet.Nonce
+		capabilities := capabilitiesOf(packet.UserAgent)
+		atomic.StoreUint32(&this.capabilities, uint32(capabilities))
+		this.infoLock.Lock()
+		this.userAgent = packet.UserAgent
+		this.version = request.version
+		this.infoLock.Unlock()
+		utils.Tracef("[P2P %s] User agent '%s', protocol %d.%d, capabilities %s", this.logPrefix, packet.UserAgent, request.version.Major, request.version.Minor, capabilities)
+		// one sample per remote host, reconnecting with a new nonce must not move the median
+		this.clock.AddSample(network.BanKeyFromAddress(this.logPrefix), packet.Time)
 		if err := this.postHandshake(this); err != nil {
 			return err
 		}
+		if !this.light && this.supports(capabilityPendingOperations) {
+			this.periodic.Go(this.fetchPendingOperations)
+		}
 	}
 
-	for _, peer := range packet.Peers {
-		this.peerUpdates <- peer
+	// a random sample of the announced peers is taken, the rest is dropped if the node is busy processing the previous ones
+	for taken, index := range rand.Perm(len(packet.Peers)) {
+		if uint32(taken) >= defaults.NetworkPeersPerHello {
+			break
+		}
+		select {
+		case this.peerUpdates <- network.PeerUpdate{Peer: packet.Peers[index], Source: this.logPrefix}:
+		default:
+		}
 	}
 
 	return nil
@@ -219,6 +539,10 @@ func (this *PascalConnection) onGetBlocksRequest(request *requestResponse, paylo
 		packet.ToIndex = packet.FromIndex + total
 	}
 
+	if this.refusesHistory(request, packet.FromIndex) {
+		return nil, nil
+	}
+
 	serialized := make([]safebox.SerializedBlock, 0, total)
 	for index := packet.FromIndex; index <= packet.ToIndex; index++ {
 		if block, err := this.blockchain.GetBlock(index); err == nil {
@@ -229,12 +553,11 @@ func (this *PascalConnection) onGetBlocksRequest(request *requestResponse, paylo
 		}
 	}
 
-	out := utils.Serialize(packetGetBlocksResponse{
-		Blocks: serialized,
-	})
 	request.result.setError(success)
 
-	return out, nil
+	return utils.Serialize(packetGetBlocksResponse{
+		Blocks: serialized,
+	}), nil
 }
 
 func (this *PascalConnection) onErrorReport(request *requestResponse, payload []byte) ([]byte, error) {
@@ -271,6 +594,10 @@ func (this *PascalConnection) onGetHeadersRequest(request *requestResponse, payl
 		packet.ToIndex = packet.FromIndex + total
 	}
 
+	if this.refusesHistory(request, packet.FromIndex) {
+		return nil, nil
+	}
+
 	serialized := make([]safebox.SerializedBlockHeader, 0, total)
 	for index := packet.FromIndex; index <= packet.ToIndex; index++ {
 		if block, err := this.blockchain.GetBlock(index); err == nil {
@@ -289,6 +616,104 @@ func (this *PascalConnection) onGetHeadersRequest(request *requestResponse, payl
 	return out, nil
 }
 
+func (this *PascalConnection) onGetSafeboxRequest(request *requestResponse, payload []byte) ([]byte, error) {
+	utils.Tracef("[P2P %s] %s", this.logPrefix, request.GetType())
+
+	var packet packetGetSafeboxRequest
+	if err := utils.Deserialize(&packet, bytes.NewBuffer(payload)); err != nil {
+		return nil, err
+	}
+
+	response := packetGetSafeboxResponse{
+		Height:      packet.Height,
+		SafeboxHash: packet.SafeboxHash,
+	}
+	var err error
+	switch packet.Kind {
+	case safeboxInfo:
+		response.Height, response.SafeboxHash, err = this.blockchain.GetSafeboxSnapshot(packet.Height)
+	case safeboxHashes:
+		response.Chunks, err = this.blockchain.GetSafeboxHashes(packet.Height, packet.SafeboxHash, packet.From, packet.Count)
+	case safeboxPacks:
+		response.Chunks, err = this.blockchain.GetSafeboxPacks(packet.Height, packet.SafeboxHash, packet.From, packet.Count)
+	default:
+		return nil, fmt.Errorf("Unknown safebox request %d", packet.Kind)
+	}
+	if err != nil {
+		utils.Tracef("[P2P %s] Failed to serve safebox %d: %v", this.logPrefix, packet.Height, err)
+		request.result.setError(internalServerError)
+		return nil, nil
+	}
+
+	request.result.setError(success)
+	return utils.Serialize(response), nil
+}
+
+func (this *PascalConnection) onGetPendingOperationsRequest(request *requestResponse, payload []byte) ([]byte, error) {
+	utils.Tracef("[P2P %s] %s", this.logPrefix, request.GetType())
+
+	var packet packetGetPendingOperationsRequest
+	if err := utils.Deserialize(&packet, bytes.NewBuffer(payload)); err != nil {
+		return nil, err
+	}
+
+	pool := this.blockchain.GetTxPool()
+	operations := make([]tx.CommonOperation, 0, len(pool))
+	for operation := range pool {
+		operations = append(operations, operation)
+	}
+	sort.Slice(operations, func(i, j int) bool { return pool[operations[i]].Index < pool[operations[j]].Index })
+
+	total := uint32(len(operations))
+	from := utils.MinUint32(packet.Start, total)
+	to := from + utils.MinUint32(utils.MinUint32(packet.Max, defaults.NetworkOperationsPerPage), total-from)
+
+	out := utils.Serialize(&packetGetPendingOperationsResponse{
+		Total: total,
+		Pending: tx.OperationsNetwork{
+			Operations: operations[from:to],
+		},
+	})
+	request.result.setError(success)
+
+	return out, nil
+}
+
+func (this *PascalConnection) onGetAccountRequest(request *requestResponse, payload []byte) ([]byte, error) {
+	utils.Tracef("[P2P %s] %s", this.logPrefix, request.GetType())
+
+	var packet packetGetAccountRequest
+	if err := utils.Deserialize(&packet, bytes.NewBuffer(payload)); err != nil {
+		return nil, err
+	}
+	if len(packet.Numbers) > int(defaults.NetworkAccountsPerRequest) {
+		return nil, fmt.Errorf("Too many accounts requested %d", len(packet.Numbers))
+	}
+
+	response := packetGetAccountResponse{
+		Accounts: make([]packetAccount, 0, len(packet.Numbers)),
+	}
+	response.Height, response.SafeboxHash, _ = this.blockchain.GetState()
+	for _, number := range packet.Numbers {
+		account := this.blockchain.GetAccount(number)
+		if account == nil {
+			continue
+		}
+		response.Accounts = append(response.Accounts, packetAccount{
+			Number:          account.GetNumber(),
+			PublicKey:       account.GetPublicKeySerialized(),
+			Balance:         account.GetBalance(),
+			UpdatedIndex:    account.GetUpdatedIndex(),
+			Operations:      account.GetOperationsCount(),
+			OperationsTotal: account.GetOperationsTotal(),
+			Timestamp:       account.GetTimestamp(),
+		})
+	}
+
+	request.result.setError(success)
+	return utils.Serialize(response), nil
+}
+
 func (this *PascalConnection) onNewBlockNotification(request *requestResponse, payload []byte) ([]byte, error) {
 	var packet packetNewBlock
 	if err := utils.Deserialize(&packet, bytes.NewBuffer(payload)); err != nil {
@@ -296,6 +721,7 @@ func (this *PascalConnection) onNewBlockNotification(request *requestResponse, p
 	}
 
 	utils.Tracef("[P2P %s] New block %d", this.logPrefix, packet.Header.Index)
+	this.knownBlocks.Add(blockKey(&packet.SerializedBlock))
 	this.onNewBlock <- &eventNewBlock{
 		event:           event{this},
 		SerializedBlock: packet.SerializedBlock,
@@ -313,7 +739,8 @@ func (this *PascalConnection) onNewOperationsNotification(request *requestRespon
 
 	utils.Tracef("[P2P %s] New operations %d", this.logPrefix, len(packet.Operations))
 	for _, op := range packet.Operations {
-		this.onNewOperation <- &eventNewOperation{event{this}, op}
+		this.knownOps.Add(operationKey(op))
+		this.onNewOperation <- &eventNewOperation{event{this}, op, false}
 	}
 
 	return nil, nil
@@ -0,0 +1,132 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package pasl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/pasl-project/pasl/blockchain"
+	"github.com/pasl-project/pasl/defaults"
+	"github.com/pasl-project/pasl/network"
+	"github.com/pasl-project/pasl/safebox"
+	"github.com/pasl-project/pasl/utils"
+)
+
+// selectFastSyncPeer picks the connection serving safebox snapshots and reporting the highest top block,
+// the headers are downloaded from genesis so the fast synced peers are skipped once they refuse them
+func (m *Manager) selectFastSyncPeer() (*PascalConnection, uint32) {
+	var selected *PascalConnection
+	var selectedTop uint32
+	m.initializedConnections.Range(func(conn, topBlockIndex interface{}) bool {
+		if !conn.(*PascalConnection).supports(capabilitySafebox) || !conn.(*PascalConnection).servesHistory(0) {
+			return true
+		}
+		if selected == nil || topBlockIndex.(uint32) > selectedTop {
+			selected = conn.(*PascalConnection)
+			selectedTop = topBlockIndex.(uint32)
+		}
+		return true
+	})
+	return selected, selectedTop
+}
+
+// fastSync downloads the safebox snapshot from the peer instead of replaying the blocks preceding it.
+// Headers are downloaded and verified first, then pack hashes and packs, every chunk is checked as soon as it's received.
+func (m *Manager) fastSync(ctx context.Context, conn *PascalConnection, topBlockIndex uint32) error {
+	below := utils.MaxUint32(topBlockIndex, defaults.MaxAltChainLength) - defaults.MaxAltChainLength
+	info, err := conn.SafeboxGet(ctx, safeboxInfo, below, nil, 0, 0)
+	if err != nil {
+		return err
+	}
+	height := info.Height
+	if height == 0 || height > topBlockIndex {
+		return fmt.Errorf("unexpected snapshot height %d", height)
+	}
+	utils.Tracef("[P2P %s] Fast sync, downloading safebox at height %d", conn.logPrefix, height)
+
+	headers := make([]safebox.SerializedBlockHeader, 0, height+1)
+	for next := uint32(0); next <= height; next = uint32(len(headers)) {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		chunk, err := conn.HeadersGet(ctx, next, utils.MinUint32(next+defaults.NetworkBlocksPerRequest-1, height))
+		if err != nil {
+			return err
+		}
+		if len(chunk) == 0 || chunk[0].Index != next {
+			return errors.New("unexpected headers received")
+		}
+		headers = append(headers, chunk[:utils.MinUint32(uint32(len(chunk)), height+1-next)]...)
+	}
+
+	imported, err := m.blockchain.NewSafeboxImport(height, info.SafeboxHash, headers)
+	if err != nil {
+		// headers from the future might be caused by our clock
+		if isInvalidBlock(err) {
+			m.misbehaving(conn, network.OffenseInvalidBlock)
+		}
+		return err
+	}
+
+	for received, _ := imported.Progress(); received < height; received, _ = imported.Progress() {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		chunk, err := conn.SafeboxGet(ctx, safeboxHashes, height, info.SafeboxHash, received, defaults.NetworkHashesPerRequest)
+		if err != nil {
+			return err
+		}
+		if err := imported.AddHashes(chunk.Chunks); err != nil {
+			m.misbehaving(conn, network.OffenseInvalidBlock)
+			return err
+		}
+	}
+
+	for _, received := imported.Progress(); received < height; _, received = imported.Progress() {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		chunk, err := conn.SafeboxGet(ctx, safeboxPacks, height, info.SafeboxHash, received, defaults.NetworkPacksPerRequest)
+		if err != nil {
+			return err
+		}
+		if err := imported.AddPacks(chunk.Chunks); err != nil {
+			m.misbehaving(conn, network.OffenseInvalidBlock)
+			return err
+		}
+		utils.Tracef("[P2P %s] Fast sync, downloaded %d of %d packs", conn.logPrefix, received+uint32(len(chunk.Chunks)), height)
+	}
+
+	parent := conn.BlocksGet(height-1, height-1)
+	if len(parent) == 0 {
+		return fmt.Errorf("failed to download block %d", height-1)
+	}
+	if err := m.blockchain.ImportSafebox(imported, parent[0]); err != nil {
+		// the rest of the failures are ours, e.g. storage ones
+		if err == blockchain.ErrParentMismatch {
+			m.misbehaving(conn, network.OffenseInvalidBlock)
+		}
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,222 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package pasl
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pasl-project/pasl/defaults"
+	"github.com/pasl-project/pasl/network"
+	"github.com/pasl-project/pasl/utils"
+)
+
+const (
+	tipActive = "active"
+	tipBehind = "behind"
+	tipAhead  = "ahead"
+	tipFork   = "fork"
+)
+
+// tipStatus compares the peer's top block and its previous safebox hash with our chain of height blocks,
+// blockHash returns the previous safebox hash of our block by its index
+func tipStatus(height uint32, safeboxHash []byte, blockHash func(index uint32) ([]byte, error), index uint32, hash []byte) string {
+	var expected []byte
+	switch {
+	case index > height:
+		return tipAhead
+	case index == height:
+		expected = safeboxHash
+	default:
+		ours, err := blockHash(index)
+		if err != nil {
+			return tipFork
+		}
+		expected = ours
+	}
+
+	if !bytes.Equal(expected, hash) {
+		return tipFork
+	}
+	switch {
+	case index == height:
+		return tipAhead
+	case index+1 == height:
+		return tipActive
+	default:
+		return tipBehind
+	}
+}
+
+// forkMonitor keeps the warning raised by the latest check and since when the peers are ahead of us
+type forkMonitor struct {
+	lock       sync.Mutex
+	aheadSince time.Time
+	warning    string
+}
+
+// update raises the warning if the share of the peers on a different chain is significant or the peers
+// are far ahead of us for too long, returns whether the warning has changed
+func (this *forkMonitor) update(status *network.ForkStatus, now time.Time) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	warning := ""
+	significant := func(count int) bool {
+		return status.Peers > 0 && uint32(count)*100 >= uint32(status.Peers)*defaults.ForkMonitorShare
+	}
+	if significant(status.Ahead) {
+		if this.aheadSince.IsZero() {
+			this.aheadSince = now
+		}
+	} else {
+		this.aheadSince = time.Time{}
+	}
+
+	switch {
+	case significant(status.Forked):
+		warning = fmt.Sprintf("%d of %d peers are on a different chain, the node might be on a minority fork", status.Forked, status.Peers)
+	case !this.aheadSince.IsZero() && now.Sub(this.aheadSince) >= defaults.ForkMonitorGrace:
+		warning = fmt.Sprintf("%d of %d peers are more than %d blocks ahead for %v, the node failed to switch to the heavier chain", status.Ahead, status.Peers, defaults.ForkMonitorDepth, now.Sub(this.aheadSince).Truncate(time.Second))
+	case status.Forked > 0:
+		warning = fmt.Sprintf("%d of %d peers are on a different chain", status.Forked, status.Peers)
+	}
+	status.Warning = warning
+
+	changed := warning != this.warning
+	this.warning = warning
+	return changed
+}
+
+// chainTips groups the peers by their top blocks, our own tip goes first
+func (m *Manager) chainTips() ([]network.ChainTip, network.ForkStatus) {
+	height, safeboxHash, _ := m.blockchain.GetState()
+	blockHash := func(index uint32) ([]byte, error) {
+		block, err := m.blockchain.GetBlock(index)
+		if err != nil {
+			return nil, err
+		}
+		return block.GetPrevSafeBoxHash(), nil
+	}
+
+	tips := make(map[string]*network.ChainTip)
+	order := make([]string, 0)
+	addTip := func(index uint32, hash []byte, status string) *network.ChainTip {
+		key := fmt.Sprintf("%d:%x", index, hash)
+		tip, ok := tips[key]
+		if !ok {
+			tip = &network.ChainTip{
+				Height: index,
+				Hash:   hex.EncodeToString(hash),
+				Status: status,
+			}
+			tips[key] = tip
+			order = append(order, key)
+		}
+		return tip
+	}
+	if height > 0 {
+		if hash, err := blockHash(height - 1); err == nil {
+			addTip(height-1, hash, tipActive)
+		}
+	}
+
+	status := network.ForkStatus{}
+	m.forEachConnection(func(conn *PascalConnection) {
+		conn.infoLock.Lock()
+		index, hash := conn.topBlockIndex, conn.safeboxHash
+		conn.infoLock.Unlock()
+		if hash == nil {
+			return
+		}
+
+		tipState := tipStatus(height, safeboxHash, blockHash, index, hash)
+		status.Peers++
+		switch {
+		case tipState == tipFork:
+			status.Forked++
+		case tipState == tipAhead && index >= height+defaults.ForkMonitorDepth:
+			status.Ahead++
+		}
+		addTip(index, hash, tipState).Peers++
+	}, nil)
+
+	result := make([]network.ChainTip, 0, len(order))
+	for _, key := range order {
+		result = append(result, *tips[key])
+	}
+	if len(result) > 1 {
+		sort.SliceStable(result[1:], func(i, j int) bool { return result[1+i].Height > result[1+j].Height })
+	}
+	return result, status
+}
+
+// monitorForks periodically checks the peers' chains and warns once the node might have forked off the network
+func (m *Manager) monitorForks(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(defaults.ForkMonitorInterval):
+		}
+
+		_, status := m.chainTips()
+		if m.forks.update(&status, time.Now()) {
+			if status.Warning != "" {
+				utils.Tracef("Warning: %s", status.Warning)
+			} else {
+				utils.Tracef("Fork warning cleared, the peers agree with our chain")
+			}
+		}
+	}
+}
+
+func (m *Manager) GetChainTips(context.Context, *struct{}) ([]network.ChainTip, error) {
+	tips, _ := m.chainTips()
+	return tips, nil
+}
+
+func (m *Manager) GetForkStatus(context.Context, *struct{}) (network.ForkStatus, error) {
+	_, status := m.chainTips()
+	m.forks.lock.Lock()
+	status.Warning = m.forks.warning
+	m.forks.lock.Unlock()
+	return status, nil
+}
+
+// Metrics exposes the fork status counters, fork_warning is 1 while the warning is raised
+func (m *Manager) Metrics() map[string]uint64 {
+	status, _ := m.GetForkStatus(context.Background(), nil)
+	warning := uint64(0)
+	if status.Warning != "" {
+		warning = 1
+	}
+	return map[string]uint64{
+		"fork_peers":        uint64(status.Peers),
+		"fork_forked_peers": uint64(status.Forked),
+		"fork_ahead_peers":  uint64(status.Ahead),
+		"fork_warning":      warning,
+	}
+}
@@ -0,0 +1,75 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package pasl
+
+import (
+	"crypto/sha256"
+	"sync"
+
+	"github.com/pasl-project/pasl/safebox"
+	"github.com/pasl-project/pasl/safebox/tx"
+	"github.com/pasl-project/pasl/utils"
+)
+
+// inventory is the bounded set of items the peer is known to have, the oldest items are forgotten first
+type inventory struct {
+	lock  sync.Mutex
+	items map[string]struct{}
+	order []string
+	next  int
+}
+
+func newInventory(limit uint32) *inventory {
+	return &inventory{
+		items: make(map[string]struct{}, limit),
+		order: make([]string, limit),
+	}
+}
+
+// Add marks the item as known, returns false if it was known already
+func (i *inventory) Add(key string) bool {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if _, ok := i.items[key]; ok {
+		return false
+	}
+	if len(i.order) == 0 {
+		return true
+	}
+	if evicted := i.order[i.next]; evicted != "" {
+		delete(i.items, evicted)
+	}
+	i.items[key] = struct{}{}
+	i.order[i.next] = key
+	i.next = (i.next + 1) % len(i.order)
+	return true
+}
+
+// operationKey is the operation hash
+func operationKey(operation tx.CommonOperation) string {
+	return string(tx.GetTxId(operation))
+}
+
+// blockKey is the hash of the block header, which covers the index as well
+func blockKey(block *safebox.SerializedBlock) string {
+	hash := sha256.Sum256(utils.Serialize(&block.Header))
+	return string(hash[:])
+}
@@ -0,0 +1,150 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package pasl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+
+	"github.com/pasl-project/pasl/accounter"
+	"github.com/pasl-project/pasl/defaults"
+	"github.com/pasl-project/pasl/utils"
+)
+
+var (
+	ErrNotEnoughPeers = errors.New("Not enough peers to cross-check the answers")
+	ErrNoQuorum       = errors.New("Peers disagree on the account state")
+)
+
+// GetAccounts asks several random peers for the account states, a state is accepted only once reported by the quorum of them.
+// Unknown accounts are returned as nil.
+func (m *Manager) GetAccounts(ctx context.Context, numbers []uint32) ([]*accounter.Account, error) {
+	connections := make([]*PascalConnection, 0)
+	m.forEachConnection(func(conn *PascalConnection) {
+		if conn.supports(capabilityAccounts) {
+			connections = append(connections, conn)
+		}
+	}, nil)
+	if len(connections) < int(defaults.LightWalletQuorum) {
+		return nil, ErrNotEnoughPeers
+	}
+	rand.Shuffle(len(connections), func(i, j int) { connections[i], connections[j] = connections[j], connections[i] })
+	if len(connections) > int(defaults.LightWalletPeers) {
+		connections = connections[:defaults.LightWalletPeers]
+	}
+
+	answers := make([]*accountsAnswer, len(connections))
+	var wg sync.WaitGroup
+	for index := range connections {
+		wg.Add(1)
+		go func(index int) {
+			defer wg.Done()
+			height, safeboxHash, accounts, err := connections[index].AccountsGet(ctx, numbers)
+			if err != nil {
+				// failed peers don't vote
+				utils.Tracef("[P2P %s] Failed to get accounts: %v", connections[index].logPrefix, err)
+				return
+			}
+			answers[index] = &accountsAnswer{
+				height:      height,
+				safeboxHash: safeboxHash,
+				accounts:    accounts,
+			}
+		}(index)
+	}
+	wg.Wait()
+
+	agreed, ok := agreedAnswers(answers, defaults.LightWalletQuorum)
+	if !ok {
+		return nil, ErrNoQuorum
+	}
+	result := make([]*accounter.Account, len(numbers))
+	for index, number := range numbers {
+		state, ok := agreedState(number, agreed, defaults.LightWalletQuorum)
+		if !ok {
+			return nil, ErrNoQuorum
+		}
+		result[index] = state
+	}
+
+	return result, nil
+}
+
+// accountsAnswer holds the account states reported by a peer at its height and safebox hash
+type accountsAnswer struct {
+	height      uint32
+	safeboxHash []byte
+	accounts    []accounter.Account
+}
+
+// agreedAnswers returns the answers taken at the newest safebox state reported by at least quorum peers,
+// the peers lagging behind or ahead of the quorum don't vote. nil answers stand for the failed peers
+func agreedAnswers(answers []*accountsAnswer, quorum uint32) ([]*accountsAnswer, bool) {
+	groups := make(map[string][]*accountsAnswer)
+	for _, answer := range answers {
+		if answer == nil {
+			continue
+		}
+		key := fmt.Sprintf("%d:%x", answer.height, answer.safeboxHash)
+		groups[key] = append(groups[key], answer)
+	}
+
+	var agreed []*accountsAnswer
+	conflict := false
+	for _, group := range groups {
+		if len(group) < int(quorum) {
+			continue
+		}
+		switch {
+		case agreed == nil || group[0].height > agreed[0].height:
+			agreed = group
+			conflict = false
+		case group[0].height == agreed[0].height:
+			// the quorums disagree on the safebox at the same height
+			conflict = true
+		}
+	}
+	return agreed, agreed != nil && !conflict
+}
+
+// agreedState returns the account state reported by at least quorum answers
+func agreedState(number uint32, answers []*accountsAnswer, quorum uint32) (*accounter.Account, bool) {
+	votes := make(map[string]uint32)
+	for _, answer := range answers {
+		// the key of the unknown account is empty
+		var key string
+		var state *accounter.Account
+		for index := range answer.accounts {
+			if answer.accounts[index].GetNumber() == number {
+				state = &answer.accounts[index]
+				hashBuffer := state.GetHashBuffer()
+				key = string(utils.Serialize(&hashBuffer))
+				break
+			}
+		}
+		if votes[key]++; votes[key] >= quorum {
+			return state, true
+		}
+	}
+	return nil, false
+}
@@ -29,6 +29,7 @@ import (
 
 	"github.com/modern-go/concurrent"
 	"github.com/pasl-project/pasl/blockchain"
+	"github.com/pasl-project/pasl/common"
 	"github.com/pasl-project/pasl/defaults"
 	"github.com/pasl-project/pasl/network"
 	"github.com/pasl-project/pasl/safebox"
@@ -49,6 +50,7 @@ type eventNewBlock struct {
 type eventNewOperation struct {
 	event
 	tx.CommonOperation
+	pending bool
 }
 
 type eventConnectionState struct {
@@ -63,25 +65,45 @@ const (
 	syncing           = iota
 )
 
+type Config struct {
+	TimeoutRequest time.Duration
+	// FastSync downloads the safebox snapshot instead of the blocks when starting from scratch
+	FastSync bool
+	// Light keeps no safebox, blocks and operations are neither synchronized nor processed, accounts are queried from the peers
+	Light bool
+	// RecordDir is the directory to record the packets of every connection to, empty to disable recording
+	RecordDir string
+}
+
 type Manager struct {
 	blockchain             *blockchain.Blockchain
 	blocksUpdates          <-chan safebox.SerializedBlock
+	clock                  *common.AdjustedClock
 	closed                 chan *PascalConnection
 	doSync                 *sync.Cond
 	doSyncValue            bool
+	fastSyncAttempts       uint32
+	forks                  forkMonitor
 	initializedConnections sync.Map
+	light                  bool
 	nonce                  []byte
+	orphans                *orphanPool
+	orphanHint             *eventConnectionState
+	orphanHintLock         sync.Mutex
 	onNewBlock             chan *eventNewBlock
 	onNewOperation         chan *eventNewOperation
 	onStateUpdate          chan eventConnectionState
 	onSyncState            chan syncState
 	p2pPort                uint16
 	peers                  *network.PeersList
-	peerUpdates            chan<- network.PeerInfo
+	bans                   *network.BansList
+	peerUpdates            chan<- network.PeerUpdate
 	prevSyncState          syncState
+	recordDir              string
 	timeoutRequest         time.Duration
 	txPoolUpdates          <-chan tx.CommonOperation
 	waitGroup              sync.WaitGroup
+	workers                *workerPool
 }
 
 func WithManager(
@@ -89,38 +111,44 @@ func WithManager(
 	blockchain *blockchain.Blockchain,
 	p2pPort uint16,
 	peers *network.PeersList,
-	peerUpdates chan<- network.PeerInfo,
+	bans *network.BansList,
+	peerUpdates chan<- network.PeerUpdate,
 	blocksUpdates <-chan safebox.SerializedBlock,
 	txPoolUpdates <-chan tx.CommonOperation,
-	timeoutRequest time.Duration,
+	config Config,
+	clock *common.AdjustedClock,
 	callback func(m *Manager) error,
 ) error {
 	manager := &Manager{
 		blockchain:     blockchain,
 		blocksUpdates:  blocksUpdates,
+		clock:          clock,
 		closed:         make(chan *PascalConnection),
 		doSync:         sync.NewCond(&sync.Mutex{}),
+		light:          config.Light,
 		nonce:          nonce,
-		onNewBlock:     make(chan *eventNewBlock),
-		onNewOperation: make(chan *eventNewOperation),
+		orphans:        newOrphanPool(defaults.MaxOrphanBlocks),
+		onNewBlock:     make(chan *eventNewBlock, defaults.NetworkEventsQueue),
+		onNewOperation: make(chan *eventNewOperation, defaults.NetworkEventsQueue),
 		onStateUpdate:  make(chan eventConnectionState),
 		onSyncState:    make(chan syncState),
 		p2pPort:        p2pPort,
 		peers:          peers,
+		bans:           bans,
 		peerUpdates:    peerUpdates,
 		prevSyncState:  syncing,
-		timeoutRequest: timeoutRequest,
+		recordDir:      config.RecordDir,
+		timeoutRequest: config.TimeoutRequest,
 		txPoolUpdates:  txPoolUpdates,
+		workers:        newWorkerPool(defaults.NetworkWorkers),
+	}
+	if config.FastSync {
+		manager.fastSyncAttempts = defaults.FastSyncAttempts
 	}
+	defer manager.workers.Stop()
 	defer manager.waitGroup.Wait()
 
-	signalSync := func() {
-		manager.doSync.L.Lock()
-		manager.doSyncValue = true
-		manager.doSync.Broadcast()
-		manager.doSync.L.Unlock()
-	}
-	defer signalSync()
+	defer manager.signalSync()
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -142,24 +170,42 @@ func WithManager(
 		}
 	}()
 
+	// blocks and operations are processed separately so that slow validation doesn't delay connection state events
 	manager.waitGroup.Add(1)
 	go func() {
 		defer manager.waitGroup.Done()
 		for {
 			select {
 			case event := <-manager.onNewBlock:
-				if err := manager.blockchain.ProcessNewBlock(event.SerializedBlock, false); err != nil {
-					utils.Tracef("[P2P %s] AddBlockSerialized %d failed %v", event.source.logPrefix, event.SerializedBlock.Header.Index, err)
-				} else if event.shouldBroadcast {
-					manager.broadcastBlock(&event.SerializedBlock, event.source)
+				if manager.light {
+					break
 				}
+				manager.processBlock(event)
 			case event := <-manager.onNewOperation:
+				if manager.light {
+					break
+				}
 				new, err := manager.blockchain.TxPoolAddOperation(event.CommonOperation, false)
 				if err != nil {
 					utils.Tracef("[P2P %s] Tx validation failed: %v", event.source.logPrefix, err)
+					// operations pulled from the peer's pool might be already included in our blocks
+					if !event.pending {
+						manager.misbehaving(event.source, network.OffenseInvalidOperation)
+					}
 				} else if new {
 					manager.broadcastTx(event.CommonOperation, event.source)
 				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	manager.waitGroup.Add(1)
+	go func() {
+		defer manager.waitGroup.Done()
+		for {
+			select {
 			case conn := <-manager.closed:
 				manager.initializedConnections.Delete(conn)
 			case event := <-manager.onStateUpdate:
@@ -167,7 +213,7 @@ func WithManager(
 				if event.source.onStateUpdated != nil {
 					event.source.onStateUpdated()
 				}
-				signalSync()
+				manager.signalSync()
 			case state := <-manager.onSyncState:
 				if state != manager.prevSyncState {
 					manager.prevSyncState = state
@@ -184,6 +230,16 @@ func WithManager(
 		}
 	}()
 
+	if manager.light {
+		return callback(manager)
+	}
+
+	manager.waitGroup.Add(1)
+	go func() {
+		defer manager.waitGroup.Done()
+		manager.monitorForks(ctx)
+	}()
+
 	manager.waitGroup.Add(1)
 	go func() {
 		defer manager.waitGroup.Done()
@@ -208,10 +264,107 @@ func WithManager(
 	return callback(manager)
 }
 
+func (m *Manager) signalSync() {
+	m.doSync.L.Lock()
+	m.doSyncValue = true
+	m.doSync.Broadcast()
+	m.doSync.L.Unlock()
+}
+
+// processBlock connects the announced block, the blocks ahead of our chain are buffered until their parents are fetched
+func (m *Manager) processBlock(event *eventNewBlock) {
+	err := m.blockchain.ProcessNewBlock(event.SerializedBlock, false)
+	if err == nil {
+		if event.shouldBroadcast {
+			m.broadcastBlock(&event.SerializedBlock, event.source)
+		}
+		m.connectOrphans()
+		return
+	}
+
+	utils.Tracef("[P2P %s] AddBlockSerialized %d failed %v", event.source.logPrefix, event.SerializedBlock.Header.Index, err)
+	index := event.SerializedBlock.Header.Index
+	height := m.blockchain.GetHeight()
+	switch {
+	case err == blockchain.ErrInvalidOrder && index > height && index-height <= defaults.NetworkBlocksPerRequest,
+		err == blockchain.ErrParentNotFound:
+		if m.orphans.Add(&event.SerializedBlock, event.source) {
+			utils.Tracef("[P2P %s] Buffered orphan block %d, fetching blocks %d .. %d", event.source.logPrefix, index, height, index)
+			// the sync fetches the missing range from the announcing peer
+			m.orphanHintLock.Lock()
+			m.orphanHint = &eventConnectionState{event.event, index}
+			m.orphanHintLock.Unlock()
+			m.signalSync()
+		}
+	case isInvalidBlock(err):
+		m.misbehaving(event.source, network.OffenseInvalidBlock)
+	}
+}
+
+// connectOrphans processes the buffered orphans as soon as their parent becomes our top block
+func (m *Manager) connectOrphans() {
+	for {
+		height, safeboxHash, _ := m.blockchain.GetState()
+		children := m.orphans.Take(safeboxHash, height)
+		if len(children) == 0 {
+			return
+		}
+
+		connected := false
+		for _, child := range children {
+			if err := m.blockchain.ProcessNewBlock(child.SerializedBlock, false); err != nil {
+				utils.Tracef("[P2P %s] Orphan block %d failed %v", child.source.logPrefix, child.Header.Index, err)
+				if isInvalidBlock(err) {
+					m.misbehaving(child.source, network.OffenseInvalidBlock)
+				}
+				continue
+			}
+			utils.Tracef("[P2P %s] Connected orphan block %d", child.source.logPrefix, child.Header.Index)
+			m.broadcastBlock(&child.SerializedBlock, child.source)
+			connected = true
+			break
+		}
+		if !connected {
+			return
+		}
+	}
+}
+
+// takeOrphanHint returns the peer that announced the latest orphan if it's still connected
+func (m *Manager) takeOrphanHint() (*PascalConnection, uint32) {
+	m.orphanHintLock.Lock()
+	hint := m.orphanHint
+	m.orphanHint = nil
+	m.orphanHintLock.Unlock()
+
+	if hint == nil {
+		return nil, 0
+	}
+	topBlockIndex, ok := m.initializedConnections.Load(hint.source)
+	if !ok {
+		return nil, 0
+	}
+	return hint.source, utils.MaxUint32(topBlockIndex.(uint32), hint.topBlockIndex)
+}
+
 func (this *Manager) sync(ctx context.Context) bool {
 	result := false
 
 	nodeHeight := this.blockchain.GetHeight()
+	if nodeHeight == 0 && this.fastSyncAttempts > 0 {
+		if conn, topBlockIndex := this.selectFastSyncPeer(); conn != nil && topBlockIndex >= defaults.FastSyncMinHeight {
+			this.fastSyncAttempts--
+			if err := this.fastSync(ctx, conn, topBlockIndex); err != nil {
+				utils.Tracef("[P2P %s] Fast sync failed: %v", conn.logPrefix, err)
+				// retry with another peer, falling back to the block sync once attempts are exhausted
+				if this.fastSyncAttempts > 0 {
+					return false
+				}
+			}
+			nodeHeight = this.blockchain.GetHeight()
+		}
+	}
+
 	for {
 		select {
 		case <-ctx.Done():
@@ -220,43 +373,53 @@ func (this *Manager) sync(ctx context.Context) bool {
 			break
 		}
 
-		candidates := make([]*PascalConnection, 0)
-		connections := 0
-		this.initializedConnections.Range(func(conn, topBlockIndex interface{}) bool {
-			connections++
-			if topBlockIndex.(uint32) >= nodeHeight {
-				candidates = append(candidates, conn.(*PascalConnection))
-			}
-			return true
-		})
+		conn, topBlockIndex := this.takeOrphanHint()
+		if conn == nil || topBlockIndex < nodeHeight {
+			candidates := make([]*PascalConnection, 0)
+			connections := 0
+			ahead := false
+			this.initializedConnections.Range(func(conn, topBlockIndex interface{}) bool {
+				connections++
+				if topBlockIndex.(uint32) >= nodeHeight {
+					ahead = true
+					// fast synced peers refuse the blocks preceding their safebox
+					if conn.(*PascalConnection).servesHistory(nodeHeight) {
+						candidates = append(candidates, conn.(*PascalConnection))
+					}
+				}
+				return true
+			})
 
-		candidatesTotal := len(candidates)
-		if candidatesTotal == 0 {
-			if connections > 0 {
-				this.onSyncState <- synced
+			candidatesTotal := len(candidates)
+			if candidatesTotal == 0 {
+				if connections > 0 && !ahead {
+					this.onSyncState <- synced
+				}
+				break
+			} else {
+				this.onSyncState <- syncing
 			}
-			break
-		} else {
-			this.onSyncState <- syncing
-		}
 
-		selected := rand.Int() % candidatesTotal
-		conn := candidates[selected]
+			selected := rand.Int() % candidatesTotal
+			conn = candidates[selected]
 
-		topBlockIndex, ok := this.initializedConnections.Load(conn)
-		if !ok {
-			continue
+			top, ok := this.initializedConnections.Load(conn)
+			if !ok {
+				continue
+			}
+			topBlockIndex = top.(uint32)
 		}
 
-		to := utils.MinUint32(nodeHeight+defaults.NetworkBlocksPerRequest-1, topBlockIndex.(uint32))
-		ahead := topBlockIndex.(uint32) + 1 - nodeHeight
+		to := utils.MinUint32(nodeHeight+defaults.NetworkBlocksPerRequest-1, topBlockIndex)
+		ahead := topBlockIndex + 1 - nodeHeight
 		utils.Tracef("[P2P %s] Fetching blocks %d .. %d (%d blocks ~%d days ahead)", conn.logPrefix, nodeHeight, to, ahead, ahead/288)
 
 		blocks := conn.BlocksGet(nodeHeight, to)
 		switch err := this.blockchain.ProcessNewBlocks(blocks, nil); err {
 		case nil:
 			{
-				nodeHeight += uint32(len(blocks))
+				this.connectOrphans()
+				nodeHeight = this.blockchain.GetHeight()
 			}
 		case blockchain.ErrParentNotFound:
 			{
@@ -271,10 +434,21 @@ func (this *Manager) sync(ctx context.Context) bool {
 					return false
 				}
 				utils.Tracef("[P2P %s] Switched to alternate chain", conn.logPrefix)
+				this.connectOrphans()
+				nodeHeight = this.blockchain.GetHeight()
 			}
 		default:
 			{
 				utils.Tracef("[P2P %s] Verification failed %v", conn.logPrefix, err)
+				if isInvalidBlock(err) {
+					this.misbehaving(conn, network.OffenseInvalidBlock)
+					return false
+				}
+				// a relayed block might have been connected while the blocks were being downloaded
+				if height := this.blockchain.GetHeight(); err == blockchain.ErrInvalidOrder && height != nodeHeight {
+					nodeHeight = height
+					continue
+				}
 				return false
 			}
 		}
@@ -285,6 +459,34 @@ func (this *Manager) sync(ctx context.Context) bool {
 	return result
 }
 
+// isInvalidBlock tells apart invalid blocks from the stale, orphaned or early ones honest peers might relay
+func isInvalidBlock(err error) bool {
+	switch err {
+	case blockchain.ErrInvalidOrder, blockchain.ErrParentNotFound, blockchain.ErrFutureTimestamp:
+		return false
+	default:
+		return true
+	}
+}
+
+// isInvalidPacket tells apart protocol violations from handshake rejections and responses arriving after our request has timed out,
+// e.g. two nodes dialing each other end up with a duplicate connection
+func isInvalidPacket(err error) bool {
+	switch err {
+	case network.ErrDuplicateConnection, network.ErrLoopbackConnection, network.ErrBannedPeer, errUnexpectedResponse:
+		return false
+	default:
+		return true
+	}
+}
+
+func (m *Manager) misbehaving(conn *PascalConnection, offense network.Offense) {
+	if m.bans.Misbehaving(offense, conn.banKeys()...) {
+		utils.Tracef("[P2P %s] Banned, %s", conn.logPrefix, offense)
+		conn.underlying.Close()
+	}
+}
+
 func (this *Manager) forEachConnection(fn func(*PascalConnection), except *PascalConnection) {
 	this.initializedConnections.Range(func(conn, height interface{}) bool {
 		if conn != except {
@@ -295,14 +497,17 @@ func (this *Manager) forEachConnection(fn func(*PascalConnection), except *Pasca
 }
 
 func (m *Manager) broadcastBlock(block *safebox.SerializedBlock, except *PascalConnection) {
+	key := blockKey(block)
+	compact := utils.Serialize(newCompactBlock(block))
 	m.forEachConnection(func(conn *PascalConnection) {
-		conn.BroadcastBlock(block)
+		conn.BroadcastBlock(block, key, compact)
 	}, except)
 }
 
 func (m *Manager) broadcastTx(transaction tx.CommonOperation, except *PascalConnection) {
+	key := operationKey(transaction)
 	m.forEachConnection(func(conn *PascalConnection) {
-		conn.BroadcastTx(transaction)
+		conn.BroadcastTx(transaction, key)
 	}, except)
 }
 
@@ -328,6 +533,9 @@ func (m *Manager) OnNewConnection(ctx context.Context, c *network.Connection) er
 			if p.outgoing && bytes.Equal(m.nonce, p.GetRemoteNonce()) {
 				return network.ErrLoopbackConnection
 			}
+			if m.bans.IsBanned(p.banKeys()...) {
+				return network.ErrBannedPeer
+			}
 
 			err := error(nil)
 			m.forEachConnection(func(conn *PascalConnection) {
@@ -347,11 +555,30 @@ func (m *Manager) OnNewConnection(ctx context.Context, c *network.Connection) er
 	buf := make([]byte, 10*1024)
 	for {
 		read, err := c.Transport.Read(buf)
-		if err != nil {
+		if err == nil {
+			err = m.OnData(link, buf[:read])
+		} else if failure := link.(*PascalConnection).underlying.Err(); failure != nil {
+			// the connection was closed as the queued packet processing failed
+			err = failure
+		} else {
+			return err
+		}
+		if err == errClosed {
+			return err
+		}
+		if err == errInvalidProtocolVersion {
+			// outdated peers are honest, just incompatible
+			utils.Tracef("[P2P %s] %v", c.Address, err)
 			return err
 		}
-		if err = m.OnData(link, buf[:read]); err != nil {
+		if err != nil {
 			utils.Tracef("OnData failed: %v", err)
+			switch {
+			case err == errFrameTooLarge:
+				m.misbehaving(link.(*PascalConnection), network.OffenseOversizedFrame)
+			case isInvalidPacket(err):
+				m.misbehaving(link.(*PascalConnection), network.OffenseInvalidPacket)
+			}
 			return err
 		}
 	}
@@ -368,6 +595,7 @@ func (this *Manager) OnOpen(
 		underlying:     NewProtocol(transport, this.timeoutRequest),
 		logPrefix:      address,
 		blockchain:     this.blockchain,
+		clock:          this.clock,
 		p2pPort:        this.p2pPort,
 		peers:          this.peers,
 		nonce:          this.nonce,
@@ -379,6 +607,17 @@ func (this *Manager) OnOpen(
 		onStateUpdated: onStateUpdated,
 		postHandshake:  postHandshake,
 		outgoing:       isOutgoing,
+		connectedAt:    time.Now(),
+		light:          this.light,
+		workers:        this.workers,
+	}
+	conn.meter, _ = transport.(*network.MeteredTransport)
+	if this.recordDir != "" {
+		recorder, err := newRecorder(this.recordDir, address)
+		if err != nil {
+			utils.Tracef("[P2P %s] Failed to start recording: %v", address, err)
+		}
+		conn.underlying.recorder = recorder
 	}
 
 	if err := conn.OnOpen(); err != nil {
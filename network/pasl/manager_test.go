@@ -21,9 +21,25 @@ package pasl
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/pasl-project/pasl/accounter"
+	"github.com/pasl-project/pasl/blockchain"
+	"github.com/pasl-project/pasl/common"
+	"github.com/pasl-project/pasl/crypto"
+	"github.com/pasl-project/pasl/defaults"
+	"github.com/pasl-project/pasl/network"
+	"github.com/pasl-project/pasl/safebox"
+	"github.com/pasl-project/pasl/storage"
 	"github.com/pasl-project/pasl/utils"
 )
 
@@ -49,3 +65,549 @@ func TestDeserializeBlocks(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestAgreedState(t *testing.T) {
+	key, err := crypto.NewKeyByType(crypto.NIDsecp256k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := crypto.NewKeyByType(crypto.NIDsecp256k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	honest := []accounter.Account{accounter.NewAccount(1, key.Public, 100, 5, 1, 1, 0)}
+	forged := []accounter.Account{accounter.NewAccount(1, key.Public, 999, 5, 1, 1, 0)}
+	stolen := []accounter.Account{accounter.NewAccount(1, other.Public, 100, 5, 1, 1, 0)}
+
+	at := func(height uint32, accounts []accounter.Account) *accountsAnswer {
+		return &accountsAnswer{height: height, safeboxHash: []byte{byte(height)}, accounts: accounts}
+	}
+
+	if state, ok := agreedState(1, []*accountsAnswer{at(1, honest), at(1, forged), at(1, honest)}, 2); !ok || state.GetBalance() != 100 {
+		t.Fatalf("honest majority is not accepted %v %v", state, ok)
+	}
+	if _, ok := agreedState(1, []*accountsAnswer{at(1, honest), at(1, forged)}, 2); ok {
+		t.Fatal("conflicting answers are accepted")
+	}
+	if _, ok := agreedState(1, []*accountsAnswer{at(1, honest), at(1, stolen)}, 2); ok {
+		t.Fatal("answers with different keys are accepted")
+	}
+	if state, ok := agreedState(2, []*accountsAnswer{at(1, honest), at(1, forged)}, 2); !ok || state != nil {
+		t.Fatalf("unknown account is not agreed %v %v", state, ok)
+	}
+
+	// a peer a block behind doesn't break the quorum of the others
+	agreed, ok := agreedAnswers([]*accountsAnswer{at(2, forged), at(1, honest), at(2, forged)}, 2)
+	if !ok || len(agreed) != 2 || agreed[0].height != 2 {
+		t.Fatalf("lagging peer breaks the quorum %v %v", agreed, ok)
+	}
+	if state, ok := agreedState(1, agreed, 2); !ok || state.GetBalance() != 999 {
+		t.Fatalf("newest state is not accepted %v %v", state, ok)
+	}
+	// the newest height with a quorum wins
+	agreed, ok = agreedAnswers([]*accountsAnswer{at(1, honest), at(2, forged), at(1, honest), at(2, forged), at(3, forged), nil}, 2)
+	if !ok || agreed[0].height != 2 {
+		t.Fatalf("newest agreed height is not picked %v %v", agreed, ok)
+	}
+	if _, ok := agreedAnswers([]*accountsAnswer{at(1, honest), at(2, forged), nil}, 2); ok {
+		t.Fatal("answers at different heights are agreed")
+	}
+	conflicting := &accountsAnswer{height: 1, safeboxHash: []byte{0xff}, accounts: forged}
+	if _, ok := agreedAnswers([]*accountsAnswer{at(1, honest), at(1, honest), conflicting, conflicting}, 2); ok {
+		t.Fatal("different safeboxes at the same height are agreed")
+	}
+}
+
+func TestOrphanPool(t *testing.T) {
+	block := func(index uint32, parent byte) *safebox.SerializedBlock {
+		return &safebox.SerializedBlock{
+			Header: safebox.SerializedBlockHeader{
+				Index:           index,
+				PrevSafeboxHash: []byte{parent},
+			},
+		}
+	}
+
+	pool := newOrphanPool(3)
+	if !pool.Add(block(10, 1), nil) || pool.Add(block(10, 1), nil) {
+		t.Fatal("duplicate orphan is buffered")
+	}
+	pool.Add(block(10, 2), nil)
+	pool.Add(block(11, 3), nil)
+	pool.Add(block(12, 4), nil)
+	if pool.Len() != 3 {
+		t.Fatalf("pool isn't bounded, %d orphans", pool.Len())
+	}
+	if children := pool.Take([]byte{1}, 0); len(children) != 0 {
+		t.Fatal("the oldest orphan wasn't evicted")
+	}
+
+	if children := pool.Take([]byte{3}, 0); len(children) != 1 || children[0].Header.Index != 11 {
+		t.Fatalf("unexpected children %v", children)
+	}
+	if pool.Len() != 2 {
+		t.Fatalf("taken orphan is still buffered, %d orphans", pool.Len())
+	}
+
+	if children := pool.Take([]byte{4}, 11); len(children) != 1 || pool.Len() != 0 {
+		t.Fatalf("stale orphans aren't dropped, %d orphans", pool.Len())
+	}
+}
+
+func TestMisbehaviorClassification(t *testing.T) {
+	for _, err := range []error{blockchain.ErrInvalidOrder, blockchain.ErrParentNotFound, blockchain.ErrFutureTimestamp} {
+		if isInvalidBlock(err) {
+			t.Fatalf("honest peers might relay blocks failing with %v", err)
+		}
+	}
+	if !isInvalidBlock(blockchain.ErrPastTimestamp) {
+		t.Fatalf("blocks older than the median time are invalid")
+	}
+
+	for _, err := range []error{network.ErrDuplicateConnection, network.ErrLoopbackConnection, network.ErrBannedPeer, errUnexpectedResponse} {
+		if isInvalidPacket(err) {
+			t.Fatalf("honest peers might trigger %v", err)
+		}
+	}
+	if !isInvalidPacket(errors.New("Invalid network id")) {
+		t.Fatalf("protocol violations should be scored")
+	}
+}
+
+func TestChainTips(t *testing.T) {
+	hashes := [][]byte{{0}, {1}, {2}, {3}}
+	blockHash := func(index uint32) ([]byte, error) {
+		if index >= uint32(len(hashes)) {
+			return nil, errors.New("Block not found")
+		}
+		return hashes[index], nil
+	}
+	current := []byte{4}
+
+	cases := []struct {
+		index  uint32
+		hash   []byte
+		status string
+	}{
+		{3, []byte{3}, tipActive},
+		{1, []byte{1}, tipBehind},
+		{4, current, tipAhead},
+		{10, []byte{10}, tipAhead},
+		{2, []byte{9}, tipFork},
+		{4, []byte{9}, tipFork},
+	}
+	for _, c := range cases {
+		if status := tipStatus(4, current, blockHash, c.index, c.hash); status != c.status {
+			t.Fatalf("tip %d %x: expected %s, got %s", c.index, c.hash, c.status, status)
+		}
+	}
+
+	monitor := forkMonitor{}
+	now := time.Now()
+	if monitor.update(&network.ForkStatus{Peers: 4}, now) {
+		t.Fatal("no warning expected")
+	}
+	status := network.ForkStatus{Peers: 4, Forked: 1}
+	if !monitor.update(&status, now) || status.Warning == "" {
+		t.Fatal("forked peer warning expected")
+	}
+	status = network.ForkStatus{Peers: 4, Ahead: 2}
+	if !monitor.update(&status, now) || status.Warning != "" {
+		t.Fatal("warning expected to be cleared until the grace period is over")
+	}
+	status = network.ForkStatus{Peers: 4, Ahead: 2}
+	if !monitor.update(&status, now.Add(defaults.ForkMonitorGrace)) || status.Warning == "" {
+		t.Fatal("heavier chain warning expected")
+	}
+	status = network.ForkStatus{Peers: 4, Ahead: 1}
+	if !monitor.update(&status, now.Add(2*defaults.ForkMonitorGrace)) || status.Warning != "" {
+		t.Fatal("warning expected to be cleared")
+	}
+}
+
+// withManager runs fn against the manager of a node with a single block mined, stored in a temporary directory
+func withManager(t *testing.T, config Config, fn func(m *Manager)) {
+	dir, err := ioutil.TempDir("", "pasl-manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "storage.db")
+	err = storage.WithStorage(&filename, func(s storage.Storage) error {
+		clock := &common.FixedClock{Time: uint32(time.Now().Unix())}
+		blockchainInstance, err := blockchain.NewBlockchain(safebox.NewSafebox, s, nil, clock, blockchain.DefaultSnapshotPolicy())
+		if err != nil {
+			return err
+		}
+		key, err := crypto.NewKeyByType(crypto.NIDsecp256k1)
+		if err != nil {
+			return err
+		}
+		block, _, _, err := blockchainInstance.GetBlockTemplate(key.Public, nil, &clock.Time, 0)
+		if err != nil {
+			return err
+		}
+		if err := blockchainInstance.ProcessNewBlock(blockchainInstance.SerializeBlock(block), false); err != nil {
+			return err
+		}
+
+		peers := network.NewPeersList()
+		peerUpdates := make(chan network.PeerUpdate, defaults.NetworkPeersPerHello)
+		bans := network.NewBansList(defaults.BanScoreThreshold, defaults.BanDuration, func([]network.Ban) {})
+		return WithManager(utils.Serialize(key.Public), blockchainInstance, 0, peers, bans, peerUpdates, blockchainInstance.BlocksUpdates, blockchainInstance.TxPoolUpdates, config, common.NewAdjustedClock(clock), func(m *Manager) error {
+			fn(m)
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// fakePeer serves the requests coming through the transport with the handlers, hello is answered unless overridden
+func fakePeer(transport io.ReadWriteCloser, handlers map[operationId]requestHandler) (stop func()) {
+	peer := NewProtocol(transport, time.Minute)
+	peer.knownOperations[hello] = func(*requestResponse, []byte) ([]byte, error) {
+		return helloPayload(), nil
+	}
+	for operation, handler := range handlers {
+		peer.knownOperations[operation] = handler
+	}
+	stopLoops := startProtocol(peer)
+	reading := make(chan struct{})
+	go func() {
+		defer close(reading)
+		buffer := make([]byte, 1024)
+		for {
+			read, err := transport.Read(buffer)
+			if err != nil || peer.OnData(buffer[:read]) != nil {
+				return
+			}
+		}
+	}()
+	return func() {
+		peer.Close()
+		stopLoops()
+		<-reading
+	}
+}
+
+// connect runs the outgoing connection to the fake peer and waits for the handshake to complete
+func connect(t *testing.T, m *Manager, handlers map[operationId]requestHandler) (conn *PascalConnection, closed <-chan error, stop func()) {
+	local, remote := net.Pipe()
+	stopPeer := fakePeer(remote, handlers)
+	done := make(chan error, 1)
+	go func() {
+		done <- m.OnNewConnection(context.Background(), &network.Connection{
+			Address:        "tcp://127.0.0.1:4004",
+			Outgoing:       true,
+			Transport:      local,
+			OnStateUpdated: func() {},
+		})
+	}()
+
+	for deadline := time.Now().Add(5 * time.Second); conn == nil && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		m.forEachConnection(func(each *PascalConnection) {
+			conn = each
+		}, nil)
+	}
+	if conn == nil {
+		stopPeer()
+		t.Fatal("handshake timed out")
+	}
+	return conn, done, stopPeer
+}
+
+func TestDisconnectFailsPendingRequests(t *testing.T) {
+	withManager(t, Config{TimeoutRequest: time.Minute}, func(m *Manager) {
+		conn, closed, stop := connect(t, m, map[operationId]requestHandler{
+			// the peer drops the connection instead of answering
+			getBlocks: func(*requestResponse, []byte) ([]byte, error) {
+				return nil, errors.New("Disconnecting")
+			},
+		})
+		defer stop()
+
+		fetched := make(chan []safebox.SerializedBlock, 1)
+		go func() {
+			fetched <- conn.BlocksGet(0, 1)
+		}()
+		select {
+		case blocks := <-fetched:
+			if len(blocks) != 0 {
+				t.Fatalf("unexpected blocks %v", blocks)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("pending request wasn't failed on disconnect")
+		}
+		<-closed
+	})
+}
+
+func TestRecordingClosedWithConnection(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pasl-record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	withManager(t, Config{TimeoutRequest: time.Minute, RecordDir: dir}, func(m *Manager) {
+		_, closed, stop := connect(t, m, nil)
+		// the remote side disconnects
+		stop()
+		<-closed
+	})
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.p2p"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("unexpected recordings %v %v", files, err)
+	}
+	recording, err := os.Open(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recording.Close()
+
+	directions := make([]recordDirection, 0)
+	if err := readRecording(recording, func(frame *recordedFrame) error {
+		directions = append(directions, frame.Direction)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// hello request and the response at least
+	if len(directions) < 2 || directions[0] != recordOutgoing || directions[1] != recordIncoming {
+		t.Fatalf("recording is incomplete %v", directions)
+	}
+}
+
+func TestReplayOutgoingSession(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pasl-record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	withManager(t, Config{TimeoutRequest: time.Minute}, func(m *Manager) {
+		key, err := crypto.NewKeyByType(crypto.NIDsecp256k1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block, _, _, err := m.blockchain.GetBlockTemplate(key.Public, nil, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		serialized := m.blockchain.SerializeBlock(block)
+		peers := map[string]network.Peer{}
+
+		// the session recorded by a node that has synced the block from the peer, the request ids differ from the replaying node's
+		p := NewProtocol(&discardTransport{}, time.Minute)
+		if p.recorder, err = newRecorder(dir, "tcp://127.0.0.1:4004"); err != nil {
+			t.Fatal(err)
+		}
+		frames := []struct {
+			direction recordDirection
+			typeId    typeId
+			operation operationId
+			id        uint32
+			payload   []byte
+		}{
+			{recordOutgoing, request, hello, 7, helloPayload()},
+			{recordIncoming, response, hello, 7, generateHello(4004, []byte{1, 2, 3}, serialized.Header, peers, "recorded")},
+			{recordOutgoing, request, getBlocks, 8, utils.Serialize(packetGetBlocksRequest{FromIndex: 1, ToIndex: 1})},
+			{recordIncoming, response, getBlocks, 8, utils.Serialize(packetGetBlocksResponse{Blocks: []safebox.SerializedBlock{serialized}})},
+		}
+		for _, frame := range frames {
+			packet, err := p.preparePacket(frame.typeId, frame.operation, frame.id, success, frame.payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.recorder.record(frame.direction, packet, nil)
+		}
+		p.Close()
+
+		files, err := filepath.Glob(filepath.Join(dir, "*.p2p"))
+		if err != nil || len(files) != 1 {
+			t.Fatalf("unexpected recordings %v %v", files, err)
+		}
+		recording, err := os.Open(files[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer recording.Close()
+		transport, err := NewReplayTransport(recording, false, 3*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !transport.Outgoing() {
+			t.Fatal("the recorded session is outgoing")
+		}
+
+		m.OnNewConnection(context.Background(), &network.Connection{
+			Address:        "replay",
+			Outgoing:       transport.Outgoing(),
+			Transport:      transport,
+			OnStateUpdated: func() {},
+		})
+		for deadline := time.Now().Add(5 * time.Second); m.blockchain.GetHeight() != 2 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		}
+		if height := m.blockchain.GetHeight(); height != 2 {
+			t.Fatalf("the replayed block wasn't synced, height %d", height)
+		}
+	})
+}
+
+// importSafebox fast syncs the destination from the source's latest safebox snapshot, returns the imported height
+func importSafebox(t *testing.T, source, destination *blockchain.Blockchain) uint32 {
+	height, hash, err := source.GetSafeboxSnapshot(source.GetHeight() - 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers := make([]safebox.SerializedBlockHeader, 0, height+1)
+	for index := uint32(0); index <= height; index++ {
+		block, err := source.GetBlock(index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		headers = append(headers, source.SerializeBlockHeader(block, false, false))
+	}
+	imported, err := destination.NewSafeboxImport(height, hash, headers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashes, err := source.GetSafeboxHashes(height, hash, 0, height)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := imported.AddHashes(hashes); err != nil {
+		t.Fatal(err)
+	}
+	packs, err := source.GetSafeboxPacks(height, hash, 0, height)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := imported.AddPacks(packs); err != nil {
+		t.Fatal(err)
+	}
+	parent, err := source.GetBlock(height - 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := destination.ImportSafebox(imported, source.SerializeBlock(parent)); err != nil {
+		t.Fatal(err)
+	}
+	return height
+}
+
+func TestFastSyncedHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pasl-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, err := crypto.NewKeyByType(crypto.NIDsecp256k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := &common.FixedClock{Time: 2000000000}
+	policy := blockchain.SnapshotPolicy{Interval: 5, FullEvery: 1, KeepLast: 2}
+	sourceFile, destinationFile := filepath.Join(dir, "source.db"), filepath.Join(dir, "destination.db")
+
+	var height uint32
+	if err := storage.WithStorage(&sourceFile, func(sourceStorage storage.Storage) error {
+		source, err := blockchain.NewBlockchain(safebox.NewSafebox, sourceStorage, nil, clock, policy)
+		if err != nil {
+			return err
+		}
+		for each := uint32(0); each < 12; each++ {
+			timestamp := 1500000000 + source.GetHeight()*300
+			block, _, _, err := source.GetBlockTemplate(key.Public, nil, &timestamp, 0)
+			if err != nil {
+				return err
+			}
+			if err := source.ProcessNewBlock(source.SerializeBlock(block), false); err != nil {
+				return err
+			}
+		}
+		return storage.WithStorage(&destinationFile, func(destinationStorage storage.Storage) error {
+			destination, err := blockchain.NewBlockchain(safebox.NewSafebox, destinationStorage, nil, clock, policy)
+			if err != nil {
+				return err
+			}
+			height = importSafebox(t, source, destination)
+			return nil
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the node is restarted after the fast sync
+	if err := storage.WithStorage(&destinationFile, func(s storage.Storage) error {
+		destination, err := blockchain.NewBlockchain(safebox.NewSafebox, s, nil, clock, policy)
+		if err != nil {
+			return err
+		}
+		if start := destination.GetHistoryStart(); start != height-1 {
+			t.Fatalf("unexpected history start %d", start)
+		}
+
+		conn := &PascalConnection{blockchain: destination}
+		getBlocksRequest := func(operation operationId, from, to uint32) (*requestResponse, []byte) {
+			packet := &requestResponse{typeId: request, operation: operation, result: &result{}}
+			payload := utils.Serialize(packetGetBlocksRequest{FromIndex: from, ToIndex: to})
+			var out []byte
+			var err error
+			if operation == getBlocks {
+				out, err = conn.onGetBlocksRequest(packet, payload)
+			} else {
+				out, err = conn.onGetHeadersRequest(packet, payload)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			return packet, out
+		}
+
+		for _, operation := range []operationId{getBlocks, getHeaders} {
+			if packet, _ := getBlocksRequest(operation, 0, height); packet.result.getError() != historyUnavailable {
+				t.Fatalf("missing blocks are not refused for %d, got %d", operation, packet.result.getError())
+			}
+		}
+		packet, out := getBlocksRequest(getBlocks, height-1, height)
+		if packet.result.getError() != success {
+			t.Fatalf("stored blocks are refused with %d", packet.result.getError())
+		}
+		var response packetGetBlocksResponse
+		if err := utils.Deserialize(&response, bytes.NewBuffer(out)); err != nil {
+			t.Fatal(err)
+		}
+		if len(response.Blocks) != 1 || response.Blocks[0].Header.Index != height-1 {
+			t.Fatalf("unexpected blocks %d", len(response.Blocks))
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRefusedHistory(t *testing.T) {
+	withManager(t, Config{TimeoutRequest: time.Minute}, func(m *Manager) {
+		conn, closed, stop := connect(t, m, map[operationId]requestHandler{
+			getBlocks: func(request *requestResponse, payload []byte) ([]byte, error) {
+				request.result.setError(historyUnavailable)
+				return nil, nil
+			},
+		})
+
+		if blocks := conn.BlocksGet(5, 10); len(blocks) != 0 {
+			t.Fatalf("unexpected blocks %d", len(blocks))
+		}
+		if conn.servesHistory(5) || !conn.servesHistory(100) {
+			t.Fatal("refused blocks are not remembered")
+		}
+		stop()
+		<-closed
+	})
+}
@@ -0,0 +1,122 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package pasl
+
+import (
+	"sync"
+
+	"github.com/pasl-project/pasl/safebox"
+)
+
+type orphan struct {
+	safebox.SerializedBlock
+	source *PascalConnection
+	key    string
+}
+
+// orphanPool buffers the blocks announced ahead of their parents, they are keyed by the parent's safebox hash.
+// The pool is bounded, the oldest orphans are evicted first.
+type orphanPool struct {
+	lock     sync.Mutex
+	byParent map[string][]*orphan
+	known    map[string]struct{}
+	order    []*orphan
+	limit    int
+}
+
+func newOrphanPool(limit uint32) *orphanPool {
+	return &orphanPool{
+		byParent: make(map[string][]*orphan),
+		known:    make(map[string]struct{}),
+		order:    make([]*orphan, 0, limit),
+		limit:    int(limit),
+	}
+}
+
+// Add buffers the block, returns false if it's buffered already
+func (o *orphanPool) Add(block *safebox.SerializedBlock, source *PascalConnection) bool {
+	key := blockKey(block)
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if _, ok := o.known[key]; ok || o.limit == 0 {
+		return false
+	}
+	if len(o.order) >= o.limit {
+		o.removeUnsafe(o.order[0])
+	}
+
+	entry := &orphan{*block, source, key}
+	parent := string(block.Header.PrevSafeboxHash)
+	o.byParent[parent] = append(o.byParent[parent], entry)
+	o.known[key] = struct{}{}
+	o.order = append(o.order, entry)
+	return true
+}
+
+// Take removes and returns the orphans of the parent, the orphans below the height are dropped as stale
+func (o *orphanPool) Take(parent []byte, height uint32) []*orphan {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	for _, entry := range append([]*orphan{}, o.order...) {
+		if entry.Header.Index < height {
+			o.removeUnsafe(entry)
+		}
+	}
+
+	children := append([]*orphan{}, o.byParent[string(parent)]...)
+	for _, entry := range children {
+		o.removeUnsafe(entry)
+	}
+	return children
+}
+
+func (o *orphanPool) Len() int {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	return len(o.order)
+}
+
+func (o *orphanPool) removeUnsafe(entry *orphan) {
+	parent := string(entry.Header.PrevSafeboxHash)
+	siblings := o.byParent[parent]
+	for index := range siblings {
+		if siblings[index] == entry {
+			siblings = append(siblings[:index], siblings[index+1:]...)
+			break
+		}
+	}
+	if len(siblings) == 0 {
+		delete(o.byParent, parent)
+	} else {
+		o.byParent[parent] = siblings
+	}
+
+	for index := range o.order {
+		if o.order[index] == entry {
+			o.order = append(o.order[:index], o.order[index+1:]...)
+			break
+		}
+	}
+	delete(o.known, entry.key)
+}
@@ -20,6 +20,7 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package pasl
 
 import (
+	"github.com/pasl-project/pasl/crypto"
 	"github.com/pasl-project/pasl/safebox"
 	"github.com/pasl-project/pasl/safebox/tx"
 )
@@ -37,6 +38,59 @@ type packetGetHeadersResponse struct {
 	BlockHeaders []safebox.SerializedBlockHeader
 }
 
+const (
+	safeboxInfo uint8 = iota
+	safeboxHashes
+	safeboxPacks
+)
+
+// packetGetSafeboxRequest asks for the newest snapshot not above the Height when Kind is safeboxInfo,
+// otherwise for the pack hashes or packs in the range [From, From + Count) of the snapshot identified by Height and SafeboxHash
+type packetGetSafeboxRequest struct {
+	Kind        uint8
+	Height      uint32
+	SafeboxHash []byte
+	From        uint32
+	Count       uint32
+}
+
+type packetGetSafeboxResponse struct {
+	Height      uint32
+	SafeboxHash []byte
+	Chunks      [][]byte
+}
+
+type packetGetPendingOperationsRequest struct {
+	Start uint32
+	Max   uint32
+}
+
+type packetGetPendingOperationsResponse struct {
+	Total   uint32
+	Pending tx.OperationsNetwork
+}
+
+type packetGetAccountRequest struct {
+	Numbers []uint32
+}
+
+type packetAccount struct {
+	Number          uint32
+	PublicKey       crypto.PublicSerialized
+	Balance         uint64
+	UpdatedIndex    uint32
+	Operations      uint32
+	OperationsTotal uint32
+	Timestamp       uint32
+}
+
+// packetGetAccountResponse carries the states of the requested accounts as of the Height, unknown accounts are omitted
+type packetGetAccountResponse struct {
+	Height      uint32
+	SafeboxHash []byte
+	Accounts    []packetAccount
+}
+
 type packetError struct {
 	Message string
 }
@@ -45,6 +99,23 @@ type packetNewBlock struct {
 	safebox.SerializedBlock
 }
 
+// packetNewBlockCompact announces the block by its header and the short ids of its operations
+type packetNewBlockCompact struct {
+	Header   safebox.SerializedBlockHeader
+	ShortIds []uint64
+}
+
+// packetGetBlockOperationsRequest asks for the operations at the Indices of the block identified by Index and OperationsHash
+type packetGetBlockOperationsRequest struct {
+	Index          uint32
+	OperationsHash []byte
+	Indices        []uint32
+}
+
+type packetGetBlockOperationsResponse struct {
+	Fetched tx.OperationsNetwork
+}
+
 type packetNewOperations struct {
 	tx.OperationsNetwork
 }
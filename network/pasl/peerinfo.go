@@ -0,0 +1,89 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package pasl
+
+import (
+	"context"
+	"encoding/hex"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/pasl-project/pasl/network"
+)
+
+// info collects what's known about the peer, the ban score is filled in by the manager
+func (p *PascalConnection) info() network.PeerConnection {
+	bytesIn, bytesOut, packetsIn, packetsOut := p.underlying.Traffic()
+	bytesHistorical := uint64(0)
+	if p.meter != nil {
+		_, _, bytesHistorical = p.meter.Traffic()
+	}
+	version := p.GetVersion()
+	direction := "inbound"
+	if p.outgoing {
+		direction = "outbound"
+	}
+
+	p.infoLock.Lock()
+	topBlockIndex, safeboxHash, userAgent := p.topBlockIndex, p.safeboxHash, p.userAgent
+	p.infoLock.Unlock()
+
+	return network.PeerConnection{
+		Address:         p.logPrefix,
+		Direction:       direction,
+		Nonce:           hex.EncodeToString(p.GetRemoteNonce()),
+		UserAgent:       userAgent,
+		Netver:          version.Major,
+		NetverAvailable: version.Minor,
+		Capabilities:    capability(atomic.LoadUint32(&p.capabilities)).String(),
+		Block:           topBlockIndex,
+		SafeboxHash:     hex.EncodeToString(safeboxHash),
+		Connected:       uint32(p.connectedAt.Unix()),
+		LastSeen:        atomic.LoadUint32(&p.lastSeen),
+		PingMs:          float64(atomic.LoadUint32(&p.pingRtt)) * float64(time.Microsecond) / float64(time.Millisecond),
+		BytesRecv:       bytesIn,
+		BytesSent:       bytesOut,
+		PacketsRecv:     packetsIn,
+		PacketsSent:     packetsOut,
+		BytesHistorical: bytesHistorical,
+	}
+}
+
+func (m *Manager) GetHandlers() map[string]interface{} {
+	return map[string]interface{}{
+		"getconnections": m.GetConnections,
+		"getpeerinfo":    m.GetConnections,
+		"getchaintips":   m.GetChainTips,
+		"getforkstatus":  m.GetForkStatus,
+	}
+}
+
+// GetConnections lists the connections that completed the handshake
+func (m *Manager) GetConnections(context.Context, *struct{}) ([]network.PeerConnection, error) {
+	result := make([]network.PeerConnection, 0)
+	m.forEachConnection(func(conn *PascalConnection) {
+		info := conn.info()
+		info.BanScore = m.bans.Score(conn.banKeys()...)
+		result = append(result, info)
+	}, nil)
+	sort.Slice(result, func(i, j int) bool { return result[i].Connected < result[j].Connected })
+	return result, nil
+}
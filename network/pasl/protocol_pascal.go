@@ -32,10 +32,29 @@ import (
 	"github.com/modern-go/concurrent"
 	"github.com/pasl-project/pasl/common"
 	"github.com/pasl-project/pasl/defaults"
+	"github.com/pasl-project/pasl/utils"
 )
 
 const headerSize = 4 + 2 + 2 + 2 + 4 + 2 + 2 + 4
 
+const (
+	maxFrameSizeDefault    uint32 = 64 * 1024
+	maxFrameSizeHello      uint32 = 128 * 1024
+	maxFrameSizeRequest    uint32 = 1024
+	maxFrameSizeHeaders    uint32 = 8 * 1024 * 1024
+	maxFrameSizeBlocks     uint32 = 64 * 1024 * 1024
+	maxFrameSizeNewBlock   uint32 = 16 * 1024 * 1024
+	maxFrameSizeOperations uint32 = 4 * 1024 * 1024
+	maxFrameSizeSafebox    uint32 = 16 * 1024 * 1024
+)
+
+var errFrameTooLarge = errors.New("Frame size exceeds the limit")
+var errQueueFull = errors.New("Outgoing queue is full")
+var errClosed = errors.New("Connection closed")
+var errInvalidProtocolVersion = errors.New("Protocol version is not supported")
+var errUnexpectedResponse = errors.New("Unexpected response")
+var errHistoryUnavailable = errors.New("Peer doesn't store the blocks requested")
+
 type typeId int16
 
 const (
@@ -55,6 +74,13 @@ const (
 	getHeaders    = 0x5
 	newBlock      = 0x11
 	newOperations = 0x20
+
+	// PASL specific requests use the ids PascalCoin doesn't, peers lacking the capability are answered with notImplemented
+	getSafebox           = 0x4021
+	getPendingOperations = 0x4030
+	getAccount           = 0x4031
+	newBlockCompact      = 0x4040
+	getBlockOperations   = 0x4041
 )
 
 type errorId int16
@@ -66,6 +92,10 @@ const (
 	invalidDataBufferInfo = 0x0010
 	internalServerError   = 0x0011
 	invalidNewAccount     = 0x0012
+	notImplemented        = 0x00ff
+
+	// PASL specific errors use the ids PascalCoin doesn't, fast synced nodes refuse the blocks preceding the imported safebox
+	historyUnavailable = 0x4000
 )
 
 type packetHeader struct {
@@ -96,6 +126,7 @@ type requestResponse struct {
 	operation operationId
 	expecting int
 	result    *result
+	version   common.Version
 }
 
 func (r *requestResponse) GetType() string {
@@ -142,7 +173,20 @@ func (this *requestWithTimeout) Process(packet *requestResponse, payload []byte)
 	return this.responseHandler(packet, payload)
 }
 
+type incomingPacket struct {
+	*requestResponse
+	payload []byte
+}
+
+// protocol decouples reading, handling and writing, requests and notifications are queued to dispatchLoop
+// while responses are handled right away, all outgoing packets are queued to writeLoop. Bounded queues
+// make a slow peer stall its own connection only.
 type protocol struct {
+	// traffic counters are accessed atomically, they stay first to keep the 64-bit alignment
+	bytesIn         uint64
+	bytesOut        uint64
+	packetsIn       uint64
+	packetsOut      uint64
 	transport       io.WriteCloser
 	timeoutRequest  time.Duration
 	requests        sync.Map
@@ -151,6 +195,14 @@ type protocol struct {
 	header          packetHeader
 	pendingPacket   *requestResponse
 	knownOperations map[operationId]requestHandler
+	incoming        chan incomingPacket
+	outgoing        chan []byte
+	done            chan struct{}
+	closeOnce       sync.Once
+	failureLock     sync.Mutex
+	failure         error
+	recorder        *recorder
+	pendingHeader   []byte
 }
 
 func NewProtocol(transport io.WriteCloser, timeoutRequest time.Duration) *protocol {
@@ -159,43 +211,221 @@ func NewProtocol(transport io.WriteCloser, timeoutRequest time.Duration) *protoc
 		timeoutRequest:  timeoutRequest,
 		buffer:          &bytes.Buffer{},
 		knownOperations: make(map[operationId]requestHandler),
+		incoming:        make(chan incomingPacket, defaults.NetworkIncomingQueue),
+		outgoing:        make(chan []byte, defaults.NetworkOutgoingQueue),
+		done:            make(chan struct{}),
 	}
 	return conn
 }
 
 func (this *protocol) Close() error {
-	this.requests.Range(func(id, handler interface{}) bool {
-		if handler != nil {
-			handler.(*requestWithTimeout).Process(nil, nil)
-		}
-		return true
+	err := error(nil)
+	this.closeOnce.Do(func() {
+		close(this.done)
+		this.requests.Range(func(id, handler interface{}) bool {
+			if handler, ok := this.requests.LoadAndDelete(id); ok && handler != nil {
+				handler.(*requestWithTimeout).Process(nil, nil)
+			}
+			return true
+		})
+		err = this.transport.Close()
+		this.recorder.Close()
 	})
-	return this.transport.Close()
+	return err
+}
+
+// Err returns the error a queued packet handler has failed with
+func (this *protocol) Err() error {
+	this.failureLock.Lock()
+	defer this.failureLock.Unlock()
+	return this.failure
+}
+
+func (this *protocol) fail(err error) {
+	this.failureLock.Lock()
+	if this.failure == nil {
+		this.failure = err
+	}
+	this.failureLock.Unlock()
+	this.Close()
+}
+
+func (this *protocol) dispatchLoop(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-this.done:
+			return
+		case packet := <-this.incoming:
+			if err := this.onPacket(packet.requestResponse, packet.payload); err != nil {
+				this.fail(err)
+				return
+			}
+		}
+	}
+}
+
+func (this *protocol) writeLoop(ctx context.Context) {
+	for {
+		select {
+		case <-this.done:
+			return
+		case <-ctx.Done():
+			// flush what's already queued, e.g. the error report preceding disconnection
+			for {
+				select {
+				case packet := <-this.outgoing:
+					if err := this.send(packet); err != nil {
+						return
+					}
+				default:
+					return
+				}
+			}
+		case packet := <-this.outgoing:
+			if err := this.send(packet); err != nil {
+				this.Close()
+				return
+			}
+		}
+	}
+}
+
+func (this *protocol) send(packet []byte) error {
+	this.recorder.record(recordOutgoing, packet, nil)
+	written, err := this.transport.Write(packet)
+	atomic.AddUint64(&this.bytesOut, uint64(written))
+	if err == nil {
+		atomic.AddUint64(&this.packetsOut, 1)
+	}
+	return err
+}
+
+// Traffic returns the bytes and packets received and sent so far
+func (this *protocol) Traffic() (bytesIn, bytesOut, packetsIn, packetsOut uint64) {
+	return atomic.LoadUint64(&this.bytesIn), atomic.LoadUint64(&this.bytesOut), atomic.LoadUint64(&this.packetsIn), atomic.LoadUint64(&this.packetsOut)
+}
+
+// write queues the packet, droppable packets are discarded when the queue is full instead of blocking the caller
+func (this *protocol) write(packet []byte, droppable bool) error {
+	if droppable {
+		select {
+		case this.outgoing <- packet:
+			return nil
+		case <-this.done:
+			return errClosed
+		default:
+			return errQueueFull
+		}
+	}
+	select {
+	case this.outgoing <- packet:
+		return nil
+	case <-this.done:
+		return errClosed
+	}
+}
+
+// maxFrameSize returns the payload size limit, responses carrying blocks are allowed to be much larger than the rest
+func maxFrameSize(typeId typeId, operation operationId) uint32 {
+	switch operation {
+	case hello:
+		return maxFrameSizeHello
+	case getBlocks:
+		if typeId == response {
+			return maxFrameSizeBlocks
+		}
+		return maxFrameSizeRequest
+	case getHeaders:
+		if typeId == response {
+			return maxFrameSizeHeaders
+		}
+		return maxFrameSizeRequest
+	case getSafebox:
+		if typeId == response {
+			return maxFrameSizeSafebox
+		}
+		return maxFrameSizeRequest
+	case newBlock, newBlockCompact:
+		return maxFrameSizeNewBlock
+	case getBlockOperations:
+		if typeId == response {
+			return maxFrameSizeNewBlock
+		}
+		return maxFrameSizeDefault
+	case newOperations:
+		return maxFrameSizeOperations
+	case getPendingOperations:
+		if typeId == response {
+			return maxFrameSizeOperations
+		}
+		return maxFrameSizeRequest
+	default:
+		return maxFrameSizeDefault
+	}
 }
 
 func (this *protocol) OnData(data []byte) error {
+	if err := this.Err(); err != nil {
+		return err
+	}
+
 	err := binary.Write(this.buffer, binary.LittleEndian, data)
 	if err != nil {
 		return err
 	}
+	atomic.AddUint64(&this.bytesIn, uint64(len(data)))
 
 	for {
 		if this.pendingPacket == nil {
 			if this.buffer.Len() < headerSize {
 				break
 			}
-			this.pendingPacket, err = this.parseHeader(this.buffer.Next(headerSize))
+			header := this.buffer.Next(headerSize)
+			if this.recorder != nil {
+				this.pendingHeader = append(this.pendingHeader[:0], header...)
+			}
+			this.pendingPacket, err = this.parseHeader(header)
+			if err != nil {
+				this.recorder.record(recordIncoming, this.pendingHeader, nil)
+			}
+			switch err {
+			case errFrameTooLarge:
+				this.sendErrorReport(invalidDataBufferInfo, err.Error())
+			case errInvalidProtocolVersion:
+				this.sendErrorReport(invalidProtocolVersion, err.Error())
+			}
+			if err != nil {
+				return err
+			}
 		} else {
 			if this.buffer.Len() < this.pendingPacket.expecting {
 				break
 			}
 
-			payloadIn := this.buffer.Next(this.pendingPacket.expecting)
-			err = this.onPacket(this.pendingPacket, payloadIn)
+			packet := this.pendingPacket
 			this.pendingPacket = nil
+			payloadIn := this.buffer.Next(packet.expecting)
+			atomic.AddUint64(&this.packetsIn, 1)
+			this.recorder.record(recordIncoming, this.pendingHeader, payloadIn)
 
-			if err != nil {
-				return err
+			if packet.typeId == response {
+				if err = this.onPacket(packet, payloadIn); err != nil {
+					return err
+				}
+				continue
+			}
+
+			payload := make([]byte, len(payloadIn))
+			copy(payload, payloadIn)
+			select {
+			case this.incoming <- incomingPacket{packet, payload}:
+			case <-this.done:
+				if err := this.Err(); err != nil {
+					return err
+				}
+				return errClosed
 			}
 		}
 	}
@@ -220,11 +450,10 @@ func (this *protocol) onPacket(packet *requestResponse, payload []byte) (err err
 
 func (this *protocol) processPacket(packet *requestResponse, payload []byte) (out []byte, err error) {
 	if packet.typeId == response {
-		if request, ok := this.requests.LoadOrStore(packet.id, nil); ok && request != nil {
-			this.requests.Delete(packet.id)
+		if request, ok := this.requests.LoadAndDelete(packet.id); ok && request != nil {
 			return nil, request.(*requestWithTimeout).Process(packet, payload)
 		}
-		return nil, errors.New("Unexpected response")
+		return nil, errUnexpectedResponse
 	}
 
 	if handler, ok := this.knownOperations[packet.operation]; ok {
@@ -252,8 +481,7 @@ func (this *protocol) sendRequest(operationId operationId, payload []byte, handl
 
 	if handler != nil {
 		this.requests.Store(newRequestId, NewRequest(handler, func() {
-			if request, ok := this.requests.LoadOrStore(newRequestId, nil); ok && request != nil {
-				this.requests.Delete(newRequestId)
+			if request, ok := this.requests.LoadAndDelete(newRequestId); ok && request != nil {
 				if err := handler(nil, nil); err != nil {
 					this.Close()
 				}
@@ -261,7 +489,11 @@ func (this *protocol) sendRequest(operationId operationId, payload []byte, handl
 		}, this.timeoutRequest))
 	}
 
-	_, err = this.transport.Write(packet)
+	if err = this.write(packet, handler == nil); err != nil {
+		if request, ok := this.requests.LoadAndDelete(newRequestId); ok && request != nil {
+			request.(*requestWithTimeout).UnboundedExecutor.StopAndWaitForever()
+		}
+	}
 	return err
 }
 
@@ -270,8 +502,17 @@ func (this *protocol) sendResponse(request *requestResponse, payload []byte) err
 	if err != nil {
 		return err
 	}
-	_, err = this.transport.Write(packet)
-	return err
+	return this.write(packet, false)
+}
+
+func (this *protocol) sendErrorReport(errorId errorId, message string) error {
+	packet, err := this.preparePacket(typeId(notification), errorReport, atomic.AddUint32(&this.requestId, 1), errorId, utils.Serialize(packetError{
+		Message: message,
+	}))
+	if err != nil {
+		return err
+	}
+	return this.write(packet, true)
 }
 
 func (this *protocol) preparePacket(typeId typeId, operationId operationId, requestId uint32, errorId errorId, payload []byte) (data []byte, err error) {
@@ -283,8 +524,8 @@ func (this *protocol) preparePacket(typeId typeId, operationId operationId, requ
 		Error:     errorId,
 		RequestId: requestId,
 		Version: common.Version{
-			Major: 3,
-			Minor: 4,
+			Major: defaults.NetProtocolVersion,
+			Minor: defaults.NetProtocolAvailable,
 		},
 		PayloadSize: uint32(len(payload)),
 	})
@@ -315,11 +556,23 @@ func (this *protocol) parseHeader(data []byte) (handleWith *requestResponse, err
 		return
 	}
 
+	// the major is the protocol version the peer speaks, the minor is the newest one it's aware of
+	if this.header.Version.Major < defaults.NetProtocolMinVersion {
+		err = errInvalidProtocolVersion
+		return
+	}
+
+	if this.header.PayloadSize > maxFrameSize(this.header.TypeId, this.header.Operation) {
+		err = errFrameTooLarge
+		return
+	}
+
 	return &requestResponse{
 		id:        this.header.RequestId,
 		typeId:    this.header.TypeId,
 		operation: this.header.Operation,
 		expecting: int(this.header.PayloadSize),
-		result:    &result{},
+		result:    &result{errorId: this.header.Error},
+		version:   this.header.Version,
 	}, nil
 }
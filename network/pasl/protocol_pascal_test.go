@@ -0,0 +1,644 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package pasl
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pasl-project/pasl/crypto"
+	"github.com/pasl-project/pasl/defaults"
+	"github.com/pasl-project/pasl/network"
+	"github.com/pasl-project/pasl/safebox"
+	"github.com/pasl-project/pasl/safebox/tx"
+	"github.com/pasl-project/pasl/utils"
+)
+
+type discardTransport struct {
+	bytes.Buffer
+}
+
+func (*discardTransport) Close() error {
+	return nil
+}
+
+func startProtocol(p *protocol) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	loops := sync.WaitGroup{}
+	for _, loop := range []func(context.Context){p.dispatchLoop, p.writeLoop} {
+		loops.Add(1)
+		go func(loop func(context.Context)) {
+			defer loops.Done()
+			loop(ctx)
+		}(loop)
+	}
+	return func() {
+		cancel()
+		loops.Wait()
+	}
+}
+
+func newFuzzProtocol() *protocol {
+	p := NewProtocol(&discardTransport{}, time.Second)
+	decoders := map[operationId]func() interface{}{
+		hello:                func() interface{} { return &packetHello{} },
+		errorReport:          func() interface{} { return &packetError{} },
+		getBlocks:            func() interface{} { return &packetGetBlocksRequest{} },
+		getHeaders:           func() interface{} { return &packetGetBlocksRequest{} },
+		newBlock:             func() interface{} { return &packetNewBlock{} },
+		newOperations:        func() interface{} { return &packetNewOperations{} },
+		getSafebox:           func() interface{} { return &packetGetSafeboxRequest{} },
+		getPendingOperations: func() interface{} { return &packetGetPendingOperationsRequest{} },
+		getAccount:           func() interface{} { return &packetGetAccountRequest{} },
+		newBlockCompact:      func() interface{} { return &packetNewBlockCompact{} },
+		getBlockOperations:   func() interface{} { return &packetGetBlockOperationsRequest{} },
+	}
+	for operation, decoder := range decoders {
+		decoder := decoder
+		p.knownOperations[operation] = func(request *requestResponse, payload []byte) ([]byte, error) {
+			return nil, utils.Deserialize(decoder(), bytes.NewBuffer(payload))
+		}
+	}
+	return p
+}
+
+func helloPayload() []byte {
+	header := safebox.SerializedBlockHeader{
+		PrevSafeboxHash: make([]byte, sha256.Size),
+	}
+	peers := map[string]network.Peer{
+		"tcp://127.0.0.1:4004": network.Peer{Address: "tcp://127.0.0.1:4004"},
+	}
+	return generateHello(4004, []byte{1, 2, 3}, header, peers, "fuzz")
+}
+
+func TestFrameSizeLimit(t *testing.T) {
+	p := newFuzzProtocol()
+	frame, err := p.preparePacket(request, hello, 1, success, make([]byte, maxFrameSizeHello+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.OnData(frame[:headerSize]); err != errFrameTooLarge {
+		t.Fatalf("oversized frame should be rejected, got %v", err)
+	}
+
+	var report packetError
+	var written []byte
+	select {
+	case written = <-p.outgoing:
+	default:
+		t.Fatalf("error report wasn't sent")
+	}
+	if err := utils.Deserialize(&report, bytes.NewBuffer(written[headerSize:])); err != nil || report.Message != errFrameTooLarge.Error() {
+		t.Fatalf("invalid error report '%s' %v", report.Message, err)
+	}
+}
+
+func TestQueuedDispatch(t *testing.T) {
+	p := newFuzzProtocol()
+	handled := make(chan uint32)
+	release := make(chan struct{})
+	p.knownOperations[message] = func(request *requestResponse, payload []byte) ([]byte, error) {
+		handled <- request.id
+		<-release
+		return nil, nil
+	}
+	defer startProtocol(p)()
+
+	received := make(chan uint32, 1)
+	if err := p.sendRequest(message, nil, func(response *requestResponse, payload []byte) error {
+		received <- response.id
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	requestId := p.requestId
+
+	frame, err := p.preparePacket(request, message, 1, success, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.OnData(frame); err != nil {
+		t.Fatal(err)
+	}
+	<-handled
+
+	// responses are handled while the request handler is still busy
+	frame, err = p.preparePacket(response, message, requestId, success, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.OnData(frame); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case id := <-received:
+		if id != requestId {
+			t.Fatalf("unexpected response id %d", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("response was blocked by the request handler")
+	}
+
+	// notifications are dropped once the outgoing queue is full rather than blocking the caller
+	for each := uint32(0); each < defaults.NetworkOutgoingQueue*2; each++ {
+		p.sendRequest(newOperations, nil, nil)
+	}
+	close(release)
+}
+
+func TestDispatchFailure(t *testing.T) {
+	p := newFuzzProtocol()
+	p.knownOperations[message] = func(request *requestResponse, payload []byte) ([]byte, error) {
+		return nil, errors.New("handler failed")
+	}
+	defer startProtocol(p)()
+
+	frame, err := p.preparePacket(notification, message, 1, success, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.OnData(frame); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-p.done:
+	case <-time.After(time.Second):
+		t.Fatalf("connection wasn't closed")
+	}
+	if p.Err() == nil || p.OnData(frame) != p.Err() {
+		t.Fatalf("handler failure wasn't reported")
+	}
+}
+
+func TestSafeboxPacket(t *testing.T) {
+	packet := packetGetSafeboxResponse{
+		Height:      10,
+		SafeboxHash: make([]byte, sha256.Size),
+		Chunks:      [][]byte{{1, 2, 3}, {}, {4}},
+	}
+	var decoded packetGetSafeboxResponse
+	if err := utils.Deserialize(&decoded, bytes.NewBuffer(utils.Serialize(packet))); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Height != packet.Height || len(decoded.Chunks) != len(packet.Chunks) || !bytes.Equal(decoded.Chunks[2], packet.Chunks[2]) {
+		t.Fatalf("invalid safebox packet %v", decoded)
+	}
+}
+
+func TestPendingOperationsPacket(t *testing.T) {
+	key, err := crypto.NewKeyByType(crypto.NIDsecp256k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet := packetGetPendingOperationsResponse{
+		Total: 3,
+		Pending: tx.OperationsNetwork{
+			Operations: []tx.CommonOperation{&tx.Transfer{
+				Source:      1,
+				OperationId: 2,
+				Destination: 3,
+				Amount:      4,
+				Fee:         5,
+				PublicKey:   *key.Public,
+			}},
+		},
+	}
+	var decoded packetGetPendingOperationsResponse
+	if err := utils.Deserialize(&decoded, bytes.NewBuffer(utils.Serialize(&packet))); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Total != packet.Total || len(decoded.Pending.Operations) != 1 || decoded.Pending.Operations[0].GetFee() != 5 {
+		t.Fatalf("invalid pending operations packet %v", decoded)
+	}
+}
+
+func TestAccountPacket(t *testing.T) {
+	key, err := crypto.NewKeyByType(crypto.NIDsecp256k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet := packetGetAccountResponse{
+		Height:      10,
+		SafeboxHash: []byte{1, 2, 3},
+		Accounts: []packetAccount{{
+			Number:          7,
+			PublicKey:       key.Public.Serialized(),
+			Balance:         1000,
+			UpdatedIndex:    9,
+			Operations:      2,
+			OperationsTotal: 3,
+			Timestamp:       4,
+		}},
+	}
+	var decoded packetGetAccountResponse
+	if err := utils.Deserialize(&decoded, bytes.NewBuffer(utils.Serialize(packet))); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Height != 10 || len(decoded.Accounts) != 1 || decoded.Accounts[0].Balance != 1000 || !bytes.Equal(decoded.Accounts[0].PublicKey.X, packet.Accounts[0].PublicKey.X) {
+		t.Fatalf("invalid account packet %v", decoded)
+	}
+}
+
+func TestInventory(t *testing.T) {
+	known := newInventory(2)
+	if !known.Add("a") || !known.Add("b") {
+		t.Fatal("new items are reported as known")
+	}
+	if known.Add("a") {
+		t.Fatal("known item is reported as new")
+	}
+	if !known.Add("c") || !known.Add("a") {
+		t.Fatal("the oldest item wasn't evicted")
+	}
+	if known.Add("c") {
+		t.Fatal("recent item was evicted")
+	}
+}
+
+func TestRelayBatching(t *testing.T) {
+	key, err := crypto.NewKeyByType(crypto.NIDsecp256k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewProtocol(&discardTransport{}, time.Second)
+	conn := &PascalConnection{
+		underlying: p,
+		knownOps:   newInventory(defaults.NetworkInventorySize),
+		relay:      make(chan tx.CommonOperation, defaults.NetworkEventsQueue),
+	}
+
+	announced := &tx.Transfer{Source: 1, OperationId: 1, PublicKey: *key.Public}
+	conn.knownOps.Add(operationKey(announced))
+	conn.BroadcastTx(announced, operationKey(announced))
+	for index := uint32(0); index < 3; index++ {
+		operation := &tx.Transfer{Source: 2, OperationId: index, PublicKey: *key.Public}
+		conn.BroadcastTx(operation, operationKey(operation))
+		conn.BroadcastTx(operation, operationKey(operation))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go conn.relayLoop(ctx)
+
+	var written []byte
+	select {
+	case written = <-p.outgoing:
+	case <-time.After(10 * defaults.NetworkRelayInterval):
+		t.Fatal("operations weren't relayed")
+	}
+	var packet packetNewOperations
+	if err := utils.Deserialize(&packet, bytes.NewBuffer(written[headerSize:])); err != nil {
+		t.Fatal(err)
+	}
+	if len(packet.Operations) != 3 {
+		t.Fatalf("expected a single batch of 3 operations, got %d", len(packet.Operations))
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	all := capabilityCompactBlocks | capabilitySafebox | capabilityPendingOperations | capabilityAccounts
+	for userAgent, expected := range map[string]capability{
+		"PASL v0.1":  0,
+		"PASL v0.2":  all,
+		"PASL v1.0":  all,
+		"4.0.2":      0,
+		"":           0,
+		"PASL vnext": 0,
+	} {
+		if capabilitiesOf(userAgent) != expected {
+			t.Errorf("unexpected capabilities %s of '%s'", capabilitiesOf(userAgent), userAgent)
+		}
+	}
+	if capabilitiesOf(defaults.UserAgent) != all {
+		t.Error("own user agent doesn't advertise all the capabilities")
+	}
+	if all.String() != "compact-blocks,safebox,pending-operations,accounts" || capability(0).String() != "none" {
+		t.Errorf("unexpected capabilities string %s", all)
+	}
+}
+
+func TestCapabilityRequired(t *testing.T) {
+	conn := &PascalConnection{}
+	served := false
+	handler := conn.requires(capabilitySafebox, func(request *requestResponse, payload []byte) ([]byte, error) {
+		served = true
+		return nil, nil
+	})
+
+	packet := &requestResponse{typeId: request, operation: getSafebox, result: &result{}}
+	if _, err := handler(packet, nil); err != nil || served || packet.result.getError() != notImplemented {
+		t.Fatalf("peer lacking the capability should get notImplemented, got %d %v", packet.result.getError(), err)
+	}
+
+	atomic.StoreUint32(&conn.capabilities, uint32(capabilitySafebox))
+	packet.result.setError(success)
+	if _, err := handler(packet, nil); err != nil || !served || packet.result.getError() != success {
+		t.Fatalf("request wasn't served, got %d %v", packet.result.getError(), err)
+	}
+}
+
+func TestCompactBlocksRequired(t *testing.T) {
+	conn := &PascalConnection{underlying: NewProtocol(&discardTransport{}, time.Second)}
+	if err := conn.OnOpen(); err != nil {
+		t.Fatal(err)
+	}
+	defer conn.periodic.StopAndWaitForever()
+
+	compact := utils.Serialize(packetNewBlockCompact{Header: safebox.SerializedBlockHeader{Index: 1}})
+	for _, operation := range []operationId{newBlockCompact, getBlockOperations} {
+		packet := &requestResponse{typeId: request, operation: operation, result: &result{}}
+		if _, err := conn.underlying.knownOperations[operation](packet, compact); err != nil || packet.result.getError() != notImplemented {
+			t.Fatalf("peer lacking the capability should get notImplemented for %d, got %d %v", operation, packet.result.getError(), err)
+		}
+	}
+	if len(conn.compactBlocks) != 0 {
+		t.Fatal("compact block from the peer lacking the capability is queued")
+	}
+}
+
+func TestCompactBlocksQueue(t *testing.T) {
+	conn := &PascalConnection{
+		knownBlocks:   newInventory(defaults.NetworkInventorySize),
+		compactBlocks: make(chan *packetNewBlockCompact, 2),
+	}
+	for index := uint32(0); index < 5; index++ {
+		compact := utils.Serialize(packetNewBlockCompact{Header: safebox.SerializedBlockHeader{Index: index}})
+		if _, err := conn.onNewBlockCompactNotification(&requestResponse{typeId: notification, operation: newBlockCompact, result: &result{}}, compact); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(conn.compactBlocks) != 2 {
+		t.Fatalf("compact blocks queue isn't bounded, %d queued", len(conn.compactBlocks))
+	}
+}
+
+func TestHistoricalReleasesWorker(t *testing.T) {
+	workers := newWorkerPool(1)
+	defer workers.Stop()
+	bandwidth := network.NewBandwidth(0, 0, 100)
+	conn := &PascalConnection{
+		workers: workers,
+		meter:   bandwidth.Meter(&discardTransport{}).(*network.MeteredTransport),
+	}
+
+	prepared := make(chan struct{})
+	throttled := make(chan error, 1)
+	go func() {
+		_, err := conn.historical(conn.heavy(func(request *requestResponse, payload []byte) ([]byte, error) {
+			close(prepared)
+			return make([]byte, 1000), nil
+		}))(&requestResponse{result: &result{}}, nil)
+		throttled <- err
+	}()
+	<-prepared
+
+	// the throttled response must not keep the only worker busy
+	served := make(chan struct{})
+	go conn.heavy(func(request *requestResponse, payload []byte) ([]byte, error) {
+		close(served)
+		return nil, nil
+	})(&requestResponse{result: &result{}}, nil)
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("worker is held while throttling")
+	}
+
+	conn.meter.Close()
+	if err := <-throttled; err != errClosed {
+		t.Fatalf("closing the connection should interrupt throttling, got %v", err)
+	}
+}
+
+func TestProtocolVersion(t *testing.T) {
+	p := newFuzzProtocol()
+	frame, err := p.preparePacket(request, hello, 1, success, helloPayload())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the version is stored right after the network id, type, operation, error and request id
+	binary.LittleEndian.PutUint16(frame[14:], defaults.NetProtocolMinVersion-1)
+	if err := p.OnData(frame); err != errInvalidProtocolVersion {
+		t.Fatalf("outdated peer should be rejected, got %v", err)
+	}
+
+	var report packetError
+	var written []byte
+	select {
+	case written = <-p.outgoing:
+	default:
+		t.Fatalf("error report wasn't sent")
+	}
+	if binary.LittleEndian.Uint16(written[8:]) != uint16(invalidProtocolVersion) {
+		t.Fatalf("unexpected error id %d", binary.LittleEndian.Uint16(written[8:]))
+	}
+	if err := utils.Deserialize(&report, bytes.NewBuffer(written[headerSize:])); err != nil || report.Message != errInvalidProtocolVersion.Error() {
+		t.Fatalf("invalid error report '%s' %v", report.Message, err)
+	}
+}
+
+func TestCompactBlockPacket(t *testing.T) {
+	key, err := crypto.NewKeyByType(crypto.NIDsecp256k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	operations := []tx.CommonOperation{
+		&tx.Transfer{Source: 1, OperationId: 1, PublicKey: *key.Public},
+		&tx.Transfer{Source: 1, OperationId: 2, PublicKey: *key.Public},
+	}
+	hash := safebox.GetOperationsHash(operations)
+	block := safebox.SerializedBlock{
+		Header: safebox.SerializedBlockHeader{
+			Index:          5,
+			OperationsHash: hash[:],
+		},
+		Operations: tx.ToTxSerialized(operations),
+	}
+
+	var decoded packetNewBlockCompact
+	if err := utils.Deserialize(&decoded, bytes.NewBuffer(utils.Serialize(newCompactBlock(&block)))); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Header.Index != 5 || !bytes.Equal(decoded.Header.OperationsHash, hash[:]) || len(decoded.ShortIds) != 2 {
+		t.Fatalf("invalid compact block %v", decoded)
+	}
+	for index := range operations {
+		if decoded.ShortIds[index] != shortId(operationKey(operations[index])) {
+			t.Fatalf("invalid short id of operation %d", index)
+		}
+	}
+	if decoded.ShortIds[0] == decoded.ShortIds[1] {
+		t.Fatal("distinct operations share the short id")
+	}
+}
+
+func FuzzOnData(f *testing.F) {
+	p := newFuzzProtocol()
+	for _, seed := range []struct {
+		typeId    typeId
+		operation operationId
+		payload   []byte
+	}{
+		{request, hello, helloPayload()},
+		{request, getBlocks, utils.Serialize(packetGetBlocksRequest{FromIndex: 0, ToIndex: 10})},
+		{notification, newOperations, utils.Serialize(&packetNewOperations{})},
+		{notification, errorReport, utils.Serialize(packetError{Message: "error"})},
+	} {
+		frame, err := p.preparePacket(seed.typeId, seed.operation, 1, success, seed.payload)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(frame)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		p := newFuzzProtocol()
+		defer startProtocol(p)()
+		for len(data) > 0 {
+			chunk := len(data)%7 + 1
+			if chunk > len(data) {
+				chunk = len(data)
+			}
+			if err := p.OnData(data[:chunk]); err != nil {
+				return
+			}
+			data = data[chunk:]
+		}
+	})
+}
+
+func FuzzDecoders(f *testing.F) {
+	f.Add(helloPayload())
+	f.Add(utils.Serialize(packetGetBlocksRequest{FromIndex: 1, ToIndex: 2}))
+	f.Add(utils.Serialize(&packetNewOperations{}))
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, packet := range []interface{}{
+			&packetHello{},
+			&packetError{},
+			&packetGetBlocksRequest{},
+			&packetGetBlocksResponse{},
+			&packetGetHeadersResponse{},
+			&packetNewBlock{},
+			&packetNewOperations{},
+			&packetGetSafeboxRequest{},
+			&packetGetSafeboxResponse{},
+			&packetGetPendingOperationsRequest{},
+			&packetGetPendingOperationsResponse{},
+			&packetGetAccountRequest{},
+			&packetGetAccountResponse{},
+			&packetNewBlockCompact{},
+			&packetGetBlockOperationsRequest{},
+			&packetGetBlockOperationsResponse{},
+		} {
+			utils.Deserialize(packet, bytes.NewBuffer(data))
+		}
+		utils.DeserializeBytes(bytes.NewBuffer(data))
+	})
+}
+
+func TestHelloPeers(t *testing.T) {
+	header := safebox.SerializedBlockHeader{
+		PrevSafeboxHash: make([]byte, sha256.Size),
+	}
+	peers := map[string]network.Peer{
+		"tcp://[2001:db8::1]:4005": network.Peer{Address: "tcp://[2001:db8::1]:4005"},
+	}
+
+	var packet packetHello
+	if err := utils.Deserialize(&packet, bytes.NewBuffer(generateHello(4004, []byte{1}, header, peers, "test"))); err != nil {
+		t.Fatal(err)
+	}
+	if len(packet.Peers) != 1 || packet.Peers[0].Host != "2001:db8::1" || packet.Peers[0].Port != 4005 {
+		t.Fatalf("unexpected peers %+v", packet.Peers)
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pasl-record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := newFuzzProtocol()
+	if p.recorder, err = newRecorder(dir, "tcp://[::1]:4004"); err != nil {
+		t.Fatal(err)
+	}
+	incoming, err := p.preparePacket(request, hello, 1, success, helloPayload())
+	if err != nil {
+		t.Fatal(err)
+	}
+	outgoing, err := p.preparePacket(request, getBlocks, 2, success, utils.Serialize(packetGetBlocksRequest{FromIndex: 1, ToIndex: 2}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, chunk := range [][]byte{incoming[:headerSize+1], incoming[headerSize+1:]} {
+		if err := p.OnData(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.send(outgoing); err != nil {
+		t.Fatal(err)
+	}
+	p.Close()
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.p2p"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("unexpected recordings %v %v", files, err)
+	}
+	recording, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frames := make([]*recordedFrame, 0)
+	if err := readRecording(bytes.NewBuffer(recording), func(frame *recordedFrame) error {
+		frames = append(frames, frame)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 2 || frames[0].Direction != recordIncoming || !bytes.Equal(frames[0].Frame, incoming) ||
+		frames[1].Direction != recordOutgoing || !bytes.Equal(frames[1].Frame, outgoing) {
+		t.Fatalf("unexpected frames recorded %+v", frames)
+	}
+
+	transport, err := NewReplayTransport(bytes.NewBuffer(recording), false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayed, err := ioutil.ReadAll(transport)
+	if err != nil || !bytes.Equal(replayed, incoming) {
+		t.Fatalf("unexpected replay %v", err)
+	}
+}
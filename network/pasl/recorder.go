@@ -0,0 +1,315 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package pasl
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pasl-project/pasl/utils"
+)
+
+// requestIdOffset is the offset of the request id in the frame header, following the network id, type, operation and error
+const requestIdOffset = 4 + 2 + 2 + 2
+
+type recordDirection uint8
+
+const (
+	recordIncoming recordDirection = iota
+	recordOutgoing
+)
+
+// recordedFrame is the framed packet, header followed by the payload, sent or received at the time
+type recordedFrame struct {
+	Direction recordDirection
+	Time      time.Time
+	Frame     []byte
+}
+
+// recorder writes the framed packets of a single connection, each record is the direction byte,
+// unix nanoseconds timestamp, frame length and the frame itself, little endian
+type recorder struct {
+	lock   sync.Mutex
+	writer *bufio.Writer
+	file   io.Closer
+	failed bool
+}
+
+// newRecorder creates the recording file in the directory named after the address and the current time
+func newRecorder(dir string, address string) (*recorder, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	name := strings.NewReplacer(":", "_", "/", "_", "[", "", "]", "").Replace(strings.TrimPrefix(address, "tcp://"))
+	file, err := os.Create(filepath.Join(dir, fmt.Sprintf("%s-%d.p2p", name, time.Now().UnixNano())))
+	if err != nil {
+		return nil, err
+	}
+	return &recorder{
+		writer: bufio.NewWriter(file),
+		file:   file,
+	}, nil
+}
+
+func (this *recorder) record(direction recordDirection, header []byte, payload []byte) {
+	if this == nil {
+		return
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.failed {
+		return
+	}
+	var prefix [13]byte
+	prefix[0] = byte(direction)
+	binary.LittleEndian.PutUint64(prefix[1:], uint64(time.Now().UnixNano()))
+	binary.LittleEndian.PutUint32(prefix[9:], uint32(len(header)+len(payload)))
+	this.writer.Write(prefix[:])
+	this.writer.Write(header)
+	if _, err := this.writer.Write(payload); err != nil {
+		this.failed = true
+	}
+}
+
+func (this *recorder) Close() error {
+	if this == nil {
+		return nil
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	// packets still in flight aren't recorded once the file is closed
+	this.failed = true
+	err := this.writer.Flush()
+	if closeErr := this.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// readRecording calls fn for every frame recorded until the end of the recording
+func readRecording(reader io.Reader, fn func(frame *recordedFrame) error) error {
+	buffered := bufio.NewReader(reader)
+	for {
+		var prefix [13]byte
+		if _, err := io.ReadFull(buffered, prefix[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		length := binary.LittleEndian.Uint32(prefix[9:])
+		if length > maxFrameSizeBlocks+headerSize {
+			return errFrameTooLarge
+		}
+		frame := &recordedFrame{
+			Direction: recordDirection(prefix[0]),
+			Time:      time.Unix(0, int64(binary.LittleEndian.Uint64(prefix[1:]))),
+			Frame:     make([]byte, length),
+		}
+		if _, err := io.ReadFull(buffered, frame.Frame); err != nil {
+			return err
+		}
+		if err := fn(frame); err != nil {
+			return err
+		}
+	}
+}
+
+// ReplayTransport plays the incoming frames of a recording back as if they were received from the peer,
+// everything written to it is discarded. Recorded responses are held back until the node sends the request
+// of the same operation and are delivered with its request id, the ones the node doesn't ask for within
+// linger are dropped. The connection stays open for linger once the recording ends so that the last packets
+// get processed.
+type ReplayTransport struct {
+	frames    [][]byte
+	delays    []time.Duration
+	offset    int
+	outgoing  bool
+	realtime  bool
+	linger    time.Duration
+	lock      sync.Mutex
+	requested map[operationId][]uint32
+	written   chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewReplayTransport reads the recording, realtime keeps the recorded intervals between the frames
+func NewReplayTransport(recording io.Reader, realtime bool, linger time.Duration) (*ReplayTransport, error) {
+	result := &ReplayTransport{
+		realtime:  realtime,
+		linger:    linger,
+		requested: make(map[operationId][]uint32),
+		written:   make(chan struct{}, 1),
+		closed:    make(chan struct{}),
+	}
+	var previous time.Time
+	first := true
+	err := readRecording(recording, func(frame *recordedFrame) error {
+		// the node connecting to the peer sends the first packet
+		if first {
+			result.outgoing = frame.Direction == recordOutgoing
+			first = false
+		}
+		if frame.Direction != recordIncoming {
+			return nil
+		}
+		delay := time.Duration(0)
+		if !previous.IsZero() {
+			delay = frame.Time.Sub(previous)
+		}
+		previous = frame.Time
+		result.frames = append(result.frames, frame.Frame)
+		result.delays = append(result.delays, delay)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(result.frames) == 0 {
+		return nil, errors.New("No incoming packets recorded")
+	}
+	return result, nil
+}
+
+// Outgoing tells whether the recorded connection was initiated by the node
+func (this *ReplayTransport) Outgoing() bool {
+	return this.outgoing
+}
+
+func (this *ReplayTransport) wait(delay time.Duration) bool {
+	if delay <= 0 {
+		return true
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-this.closed:
+		return false
+	}
+}
+
+// match waits for the node to request the operation the response frame answers and rewrites its request id,
+// the rest of the frames are passed as is
+func (this *ReplayTransport) match(frame []byte) bool {
+	var header packetHeader
+	if err := binary.Read(bytes.NewReader(frame), binary.LittleEndian, &header); err != nil || header.TypeId != response {
+		return true
+	}
+
+	timer := time.NewTimer(this.linger)
+	defer timer.Stop()
+	for {
+		this.lock.Lock()
+		if ids := this.requested[header.Operation]; len(ids) > 0 {
+			this.requested[header.Operation] = ids[1:]
+			this.lock.Unlock()
+			binary.LittleEndian.PutUint32(frame[requestIdOffset:], ids[0])
+			return true
+		}
+		this.lock.Unlock()
+
+		select {
+		case <-this.written:
+		case <-timer.C:
+			utils.Tracef("Replay: the node hasn't requested %d, dropping the response", header.Operation)
+			return false
+		case <-this.closed:
+			return false
+		}
+	}
+}
+
+func (this *ReplayTransport) next() {
+	this.frames = this.frames[1:]
+	this.delays = this.delays[1:]
+	this.offset = 0
+}
+
+func (this *ReplayTransport) Read(p []byte) (int, error) {
+	for this.offset == 0 {
+		if len(this.frames) == 0 {
+			this.wait(this.linger)
+			return 0, io.EOF
+		}
+		if this.realtime && !this.wait(this.delays[0]) {
+			return 0, io.EOF
+		}
+		if this.match(this.frames[0]) {
+			break
+		}
+		select {
+		case <-this.closed:
+			return 0, io.EOF
+		default:
+			this.next()
+		}
+	}
+
+	read := copy(p, this.frames[0][this.offset:])
+	this.offset += read
+	if this.offset == len(this.frames[0]) {
+		this.next()
+	}
+	return read, nil
+}
+
+// Write discards the packet, the ids of the requests are kept for the recorded responses
+func (this *ReplayTransport) Write(p []byte) (int, error) {
+	select {
+	case <-this.closed:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+
+	var header packetHeader
+	if err := binary.Read(bytes.NewReader(p), binary.LittleEndian, &header); err == nil && header.TypeId == request {
+		this.lock.Lock()
+		this.requested[header.Operation] = append(this.requested[header.Operation], header.RequestId)
+		this.lock.Unlock()
+		select {
+		case this.written <- struct{}{}:
+		default:
+		}
+	}
+	return len(p), nil
+}
+
+func (this *ReplayTransport) Close() error {
+	this.closeOnce.Do(func() {
+		close(this.closed)
+	})
+	return nil
+}
@@ -0,0 +1,61 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package pasl
+
+import (
+	"sync"
+)
+
+// workerPool bounds the number of heavy requests served concurrently across all the connections
+type workerPool struct {
+	jobs      chan func()
+	waitGroup sync.WaitGroup
+}
+
+func newWorkerPool(workers uint32) *workerPool {
+	pool := &workerPool{
+		jobs: make(chan func()),
+	}
+	for each := uint32(0); each < workers; each++ {
+		pool.waitGroup.Add(1)
+		go func() {
+			defer pool.waitGroup.Done()
+			for job := range pool.jobs {
+				job()
+			}
+		}()
+	}
+	return pool
+}
+
+// Do blocks the caller until a worker is available and the job is done
+func (w *workerPool) Do(job func()) {
+	done := make(chan struct{})
+	w.jobs <- func() {
+		defer close(done)
+		job()
+	}
+	<-done
+}
+
+func (w *workerPool) Stop() {
+	close(w.jobs)
+	w.waitGroup.Wait()
+}
@@ -22,6 +22,7 @@ package network
 import (
 	"bytes"
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 
@@ -71,6 +72,48 @@ func (this *PeersList) Add(address string, peer *Peer) bool {
 	return true
 }
 
+// AddLearned queues the address announced by the source peer, limiting the addresses from the same source group and landing in the same network group
+func (this *PeersList) AddLearned(address string, source string) bool {
+	sourceGroup := addressGroup(source)
+	group := addressGroup(address)
+
+	this.Lock.Lock()
+	defer this.Lock.Unlock()
+
+	if _, exists := this.Forbidden[address]; exists {
+		return false
+	}
+	if _, exists := this.Queued.Get(address); exists {
+		return false
+	}
+	if _, exists := this.Connected[address]; exists {
+		return false
+	}
+
+	fromSource := uint32(0)
+	inBucket := uint32(0)
+	iter := this.Queued.IterFunc()
+	for kv, ok := iter(); ok; kv, ok = iter() {
+		peer := kv.Value.(*Peer)
+		if peer.Source != sourceGroup {
+			continue
+		}
+		fromSource++
+		if addressGroup(peer.Address) == group {
+			inBucket++
+		}
+	}
+	if fromSource >= defaults.PeersPerSource || inBucket >= defaults.PeersPerBucket {
+		return false
+	}
+
+	this.Queued.Set(address, &Peer{
+		Address: address,
+		Source:  sourceGroup,
+	})
+	return true
+}
+
 func (p *PeersList) Forbid(address string) {
 	p.Lock.Lock()
 	defer p.Lock.Unlock()
@@ -90,6 +133,13 @@ func (this *PeersList) AddSerialized(serialized []byte) error {
 	return nil
 }
 
+// reliability is the smoothed share of successful connections, unknown peers score in the middle
+func (peer *Peer) reliability() float64 {
+	return float64(peer.Successes+1) / float64(peer.Successes+peer.Failures+2)
+}
+
+// ScheduleReconnect picks the peers to connect to, anchors go first followed by historically reliable and faster peers,
+// no more than MaxOutgoingPerGroup connections are made to a single network group
 func (this *PeersList) ScheduleReconnect(maxActive int) []*Peer {
 	result := make([]*Peer, 0)
 
@@ -103,18 +153,44 @@ func (this *PeersList) ScheduleReconnect(maxActive int) []*Peer {
 
 	toAdd := maxActive - active
 	current := uint32(time.Now().Unix())
+	candidates := make([]*Peer, 0)
 	iter := this.Queued.IterFunc()
-	for kv, ok := iter(); ok && toAdd > 0; kv, ok = iter() {
-		address := kv.Key.(string)
+	for kv, ok := iter(); ok; kv, ok = iter() {
 		peer := kv.Value.(*Peer)
 		if current < peer.LastConnectTimestamp+peer.ReconnectPenalty {
 			continue
 		}
+		candidates = append(candidates, peer)
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].Anchor != candidates[j].Anchor {
+			return candidates[i].Anchor
+		}
+		if left, right := candidates[i].reliability(), candidates[j].reliability(); left != right {
+			return left > right
+		}
+		return candidates[i].Latency < candidates[j].Latency
+	})
+
+	groups := make(map[string]uint32)
+	for _, peer := range this.Connected {
+		groups[addressGroup(peer.Address)]++
+	}
+
+	for _, peer := range candidates {
+		if toAdd == 0 {
+			break
+		}
+		group := addressGroup(peer.Address)
+		if groups[group] >= defaults.MaxOutgoingPerGroup {
+			continue
+		}
+		groups[group]++
 		peer.LastConnectTimestamp = uint32(time.Now().Unix())
 		peer.ReconnectPenalty = utils.MinUint32(defaults.ReconnectionDelayMax, peer.ReconnectPenalty+1)
 
-		this.Queued.Delete(address)
-		this.Connected[address] = peer
+		this.Queued.Delete(peer.Address)
+		this.Connected[peer.Address] = peer
 
 		result = append(result, peer)
 
@@ -124,10 +200,95 @@ func (this *PeersList) ScheduleReconnect(maxActive int) []*Peer {
 	return result
 }
 
+func (this *PeersList) SetSeen(peer *Peer) {
+	this.Lock.Lock()
+	defer this.Lock.Unlock()
+
+	peer.LastSeen = uint64(time.Now().Unix())
+}
+
+func (this *PeersList) SetSucceeded(peer *Peer, latency time.Duration) {
+	this.Lock.Lock()
+	defer this.Lock.Unlock()
+
+	peer.Successes++
+	peer.FailuresInRow = 0
+	peer.ConnectedSince = uint32(time.Now().Unix())
+	milliseconds := uint32(latency / time.Millisecond)
+	if peer.Latency == 0 {
+		peer.Latency = milliseconds
+	} else {
+		peer.Latency = (3*peer.Latency + milliseconds) / 4
+	}
+}
+
+func (this *PeersList) SetFailed(peer *Peer) {
+	this.Lock.Lock()
+	defer this.Lock.Unlock()
+
+	peer.Failures++
+	peer.FailuresInRow++
+}
+
+// Evict drops the queued peers unseen for staleAfter or failed maxFailures times in a row, returns the number of evicted peers
+func (this *PeersList) Evict(staleAfter time.Duration, maxFailures uint32) int {
+	this.Lock.Lock()
+	defer this.Lock.Unlock()
+
+	current := uint64(time.Now().Unix())
+	evicted := make([]string, 0)
+	iter := this.Queued.IterFunc()
+	for kv, ok := iter(); ok; kv, ok = iter() {
+		peer := kv.Value.(*Peer)
+		stale := peer.LastSeen > 0 && current > peer.LastSeen+uint64(staleAfter/time.Second)
+		if stale || peer.FailuresInRow >= maxFailures {
+			evicted = append(evicted, kv.Key.(string))
+		}
+	}
+	for _, address := range evicted {
+		this.Queued.Delete(address)
+	}
+	return len(evicted)
+}
+
+// UpdateAnchors marks up to count longest connected peers as anchors, to be reconnected first after restart
+func (this *PeersList) UpdateAnchors(count uint32) {
+	this.Lock.Lock()
+	defer this.Lock.Unlock()
+
+	connected := make([]*Peer, 0, len(this.Connected))
+	for _, peer := range this.Connected {
+		if peer.ConnectedSince > 0 {
+			connected = append(connected, peer)
+		}
+	}
+	if len(connected) == 0 {
+		return
+	}
+	sort.Slice(connected, func(i, j int) bool {
+		if connected[i].ConnectedSince != connected[j].ConnectedSince {
+			return connected[i].ConnectedSince < connected[j].ConnectedSince
+		}
+		return connected[i].Address < connected[j].Address
+	})
+
+	for _, peer := range this.Connected {
+		peer.Anchor = false
+	}
+	iter := this.Queued.IterFunc()
+	for kv, ok := iter(); ok; kv, ok = iter() {
+		kv.Value.(*Peer).Anchor = false
+	}
+	for index := 0; index < len(connected) && uint32(index) < count; index++ {
+		connected[index].Anchor = true
+	}
+}
+
 func (this *PeersList) SetDisconnected(peer *Peer) {
 	this.Lock.Lock()
 	defer this.Lock.Unlock()
 
+	peer.ConnectedSince = 0
 	if peer, ok := this.Connected[peer.Address]; ok {
 		this.Queued.Set(peer.Address, peer)
 	}
@@ -0,0 +1,384 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package simnet runs several full nodes in one process wired together with in-memory pipes,
+// it is meant for testing synchronization, fork switching and relaying end to end.
+package simnet
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pasl-project/pasl/blockchain"
+	"github.com/pasl-project/pasl/common"
+	"github.com/pasl-project/pasl/crypto"
+	"github.com/pasl-project/pasl/defaults"
+	"github.com/pasl-project/pasl/network"
+	"github.com/pasl-project/pasl/network/pasl"
+	"github.com/pasl-project/pasl/safebox"
+	"github.com/pasl-project/pasl/storage"
+	"github.com/pasl-project/pasl/utils"
+)
+
+const (
+	// blocks are timestamped in the past of the clock so that they never look like coming from the future
+	clockNow       uint32 = 2000000000
+	blocksTimeBase uint32 = 1500000000
+	blocksInterval uint32 = 300
+)
+
+// Node is a full node with its own storage, blockchain and P2P manager
+type Node struct {
+	Index      int
+	Blockchain *blockchain.Blockchain
+	Manager    *pasl.Manager
+	miner      *crypto.Key
+	stop       chan struct{}
+	done       chan error
+}
+
+type link struct {
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// Network keeps the nodes and the links between them, links are identified by the pair of node indexes
+type Network struct {
+	dir   string
+	nodes []*Node
+	lock  sync.Mutex
+	links map[[2]int]*link
+	known map[[2]int]struct{}
+}
+
+// New starts count nodes each with a fresh blockchain stored in a temporary directory, the nodes are not linked
+func New(count int) (*Network, error) {
+	dir, err := ioutil.TempDir("", "simnet")
+	if err != nil {
+		return nil, err
+	}
+	result := &Network{
+		dir:   dir,
+		links: make(map[[2]int]*link),
+		known: make(map[[2]int]struct{}),
+	}
+	for index := 0; index < count; index++ {
+		node, err := startNode(index, filepath.Join(dir, fmt.Sprintf("node%d.db", index)))
+		if err != nil {
+			result.Close()
+			return nil, err
+		}
+		result.nodes = append(result.nodes, node)
+	}
+	return result, nil
+}
+
+func startNode(index int, filename string) (*Node, error) {
+	miner, err := crypto.NewKeyByType(crypto.NIDsecp256k1)
+	if err != nil {
+		return nil, err
+	}
+	node := &Node{
+		Index: index,
+		miner: miner,
+		stop:  make(chan struct{}),
+		done:  make(chan error, 1),
+	}
+
+	ready := make(chan struct{})
+	go func() {
+		node.done <- storage.WithStorage(&filename, func(s storage.Storage) error {
+			clock := &common.FixedClock{Time: clockNow}
+			blockchainInstance, err := blockchain.NewBlockchain(safebox.NewSafebox, s, nil, clock, blockchain.DefaultSnapshotPolicy())
+			if err != nil {
+				return err
+			}
+			node.Blockchain = blockchainInstance
+
+			nonce := utils.Serialize(miner.Public)
+			peers := network.NewPeersList()
+			peerUpdates := make(chan network.PeerUpdate, defaults.NetworkPeersPerHello)
+			bans := network.NewBansList(defaults.BanScoreThreshold, defaults.BanDuration, func([]network.Ban) {})
+			return pasl.WithManager(nonce, blockchainInstance, 0, peers, bans, peerUpdates, blockchainInstance.BlocksUpdates, blockchainInstance.TxPoolUpdates, pasl.Config{
+				TimeoutRequest: defaults.TimeoutRequest,
+			}, common.NewAdjustedClock(clock), func(manager *pasl.Manager) error {
+				node.Manager = manager
+				close(ready)
+				<-node.stop
+				return nil
+			})
+		})
+	}()
+
+	select {
+	case <-ready:
+		return node, nil
+	case err := <-node.done:
+		return nil, err
+	}
+}
+
+// Address is the P2P address the node is seen by its peers with
+func (this *Node) Address() string {
+	return fmt.Sprintf("tcp://127.0.0.%d:%d", this.Index+1, defaults.P2PPort)
+}
+
+// Mine appends count blocks on top of the node's chain and announces them to the peers
+func (this *Node) Mine(count int) error {
+	for each := 0; each < count; each++ {
+		timestamp := blocksTimeBase + this.Blockchain.GetHeight()*blocksInterval
+		block, _, _, err := this.Blockchain.GetBlockTemplate(this.miner.Public, []byte(fmt.Sprintf("simnet %d", this.Index)), &timestamp, 0)
+		if err != nil {
+			return err
+		}
+		if err := this.Blockchain.ProcessNewBlock(this.Blockchain.SerializeBlock(block), true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// State returns the height and the safebox hash of the node
+func (this *Node) State() (uint32, []byte) {
+	height, safeboxHash, _ := this.Blockchain.GetState()
+	return height, safeboxHash
+}
+
+func (this *Node) stopAndWait() error {
+	close(this.stop)
+	return <-this.done
+}
+
+// Node returns the node by its index
+func (this *Network) Node(index int) *Node {
+	return this.nodes[index]
+}
+
+func linkKey(a, b int) [2]int {
+	if a > b {
+		a, b = b, a
+	}
+	return [2]int{a, b}
+}
+
+// Connect links the nodes a and b, a being the outgoing side, and waits for both sides to complete the handshake
+func (this *Network) Connect(a, b int) error {
+	if a == b || a < 0 || b < 0 || a >= len(this.nodes) || b >= len(this.nodes) {
+		return fmt.Errorf("Invalid link %d-%d", a, b)
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	key := linkKey(a, b)
+	if _, ok := this.links[key]; ok {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	current := &link{cancel: cancel}
+	handshakes := sync.WaitGroup{}
+	handshakes.Add(2)
+	outgoing, incoming := net.Pipe()
+	for _, side := range []struct {
+		node, peer *Node
+		transport  net.Conn
+		outgoing   bool
+	}{
+		{this.nodes[a], this.nodes[b], outgoing, true},
+		{this.nodes[b], this.nodes[a], incoming, false},
+	} {
+		side := side
+		handshake := sync.Once{}
+		current.wg.Add(1)
+		go func() {
+			defer current.wg.Done()
+			defer side.transport.Close()
+			defer handshake.Do(handshakes.Done)
+			side.node.Manager.OnNewConnection(ctx, &network.Connection{
+				Address:   side.peer.Address(),
+				Outgoing:  side.outgoing,
+				Transport: side.transport,
+				OnStateUpdated: func() {
+					handshake.Do(handshakes.Done)
+				},
+			})
+			// the other side is notified once either of the managers drops the connection
+			cancel()
+		}()
+	}
+	this.links[key] = current
+	this.known[key] = struct{}{}
+
+	handshakes.Wait()
+	select {
+	case <-ctx.Done():
+		return fmt.Errorf("Nodes %d and %d failed to connect", a, b)
+	default:
+		return nil
+	}
+}
+
+// ConnectAll links every node to every other one
+func (this *Network) ConnectAll() error {
+	for a := range this.nodes {
+		for b := a + 1; b < len(this.nodes); b++ {
+			if err := this.Connect(a, b); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Disconnect drops the link between the nodes a and b and waits for both sides to close it
+func (this *Network) Disconnect(a, b int) {
+	this.lock.Lock()
+	key := linkKey(a, b)
+	current, ok := this.links[key]
+	delete(this.links, key)
+	this.lock.Unlock()
+
+	if ok {
+		current.cancel()
+		current.wg.Wait()
+	}
+}
+
+// Partition drops every link between the nodes of different groups, the nodes not listed form a group of their own
+func (this *Network) Partition(groups ...[]int) {
+	groupOf := make(map[int]int)
+	for group, nodes := range groups {
+		for _, node := range nodes {
+			groupOf[node] = group + 1
+		}
+	}
+
+	this.lock.Lock()
+	crossing := make([][2]int, 0)
+	for key := range this.links {
+		if groupOf[key[0]] != groupOf[key[1]] {
+			crossing = append(crossing, key)
+		}
+	}
+	this.lock.Unlock()
+
+	for _, key := range crossing {
+		this.Disconnect(key[0], key[1])
+	}
+}
+
+// Heal restores every link that has ever been connected
+func (this *Network) Heal() error {
+	this.lock.Lock()
+	known := make([][2]int, 0, len(this.known))
+	for key := range this.known {
+		known = append(known, key)
+	}
+	this.lock.Unlock()
+
+	for _, key := range known {
+		if err := this.Connect(key[0], key[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Converged checks that the nodes share the same height and safebox hash, all the nodes are checked when none are given
+func (this *Network) Converged(nodes ...int) bool {
+	if len(nodes) == 0 {
+		for index := range this.nodes {
+			nodes = append(nodes, index)
+		}
+	}
+
+	height, safeboxHash := this.nodes[nodes[0]].State()
+	for _, index := range nodes[1:] {
+		otherHeight, otherHash := this.nodes[index].State()
+		if otherHeight != height || !bytes.Equal(otherHash, safeboxHash) {
+			return false
+		}
+	}
+	return true
+}
+
+// WaitConverged polls the nodes until they converge or the timeout expires
+func (this *Network) WaitConverged(timeout time.Duration, nodes ...int) error {
+	deadline := time.Now().Add(timeout)
+	for !this.Converged(nodes...) {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Nodes haven't converged in %v: %s", timeout, this.describe())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return nil
+}
+
+// WaitHeight polls the node until it reaches the height or the timeout expires
+func (this *Network) WaitHeight(index int, height uint32, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for this.nodes[index].Blockchain.GetHeight() < height {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Node %d hasn't reached height %d in %v: %s", index, height, timeout, this.describe())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return nil
+}
+
+func (this *Network) describe() string {
+	result := ""
+	for _, node := range this.nodes {
+		height, safeboxHash := node.State()
+		result += fmt.Sprintf("[node %d height %d safebox %x] ", node.Index, height, safeboxHash)
+	}
+	return result
+}
+
+// Close drops all the links, stops the nodes and removes their storage
+func (this *Network) Close() error {
+	this.lock.Lock()
+	keys := make([][2]int, 0, len(this.links))
+	for key := range this.links {
+		keys = append(keys, key)
+	}
+	this.lock.Unlock()
+	for _, key := range keys {
+		this.Disconnect(key[0], key[1])
+	}
+
+	var err error
+	for _, node := range this.nodes {
+		if stopErr := node.stopAndWait(); stopErr != nil && err == nil {
+			err = stopErr
+		}
+	}
+	if removeErr := os.RemoveAll(this.dir); removeErr != nil && err == nil {
+		err = removeErr
+	}
+	return err
+}
@@ -0,0 +1,120 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package simnet
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+const timeout = 30 * time.Second
+
+func newNetwork(t *testing.T, count int) *Network {
+	network, err := New(count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return network
+}
+
+func TestSync(t *testing.T) {
+	network := newNetwork(t, 3)
+	defer network.Close()
+
+	if err := network.Node(0).Mine(20); err != nil {
+		t.Fatal(err)
+	}
+	if err := network.ConnectAll(); err != nil {
+		t.Fatal(err)
+	}
+	if err := network.WaitConverged(timeout); err != nil {
+		t.Fatal(err)
+	}
+	if height, _ := network.Node(2).State(); height != 20 {
+		t.Fatalf("unexpected height %d", height)
+	}
+}
+
+func TestRelay(t *testing.T) {
+	network := newNetwork(t, 3)
+	defer network.Close()
+
+	network.Connect(0, 1)
+	network.Connect(1, 2)
+	if err := network.Node(0).Mine(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := network.WaitConverged(timeout); err != nil {
+		t.Fatal(err)
+	}
+
+	for each := uint32(2); each <= 4; each++ {
+		if err := network.Node(2).Mine(1); err != nil {
+			t.Fatal(err)
+		}
+		if err := network.WaitHeight(0, each, timeout); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := network.WaitConverged(timeout); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestForkSwitch(t *testing.T) {
+	network := newNetwork(t, 3)
+	defer network.Close()
+
+	if err := network.ConnectAll(); err != nil {
+		t.Fatal(err)
+	}
+	if err := network.Node(0).Mine(5); err != nil {
+		t.Fatal(err)
+	}
+	if err := network.WaitConverged(timeout); err != nil {
+		t.Fatal(err)
+	}
+
+	network.Partition([]int{0, 1}, []int{2})
+	if err := network.Node(0).Mine(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := network.Node(2).Mine(4); err != nil {
+		t.Fatal(err)
+	}
+	if err := network.WaitConverged(timeout, 0, 1); err != nil {
+		t.Fatal(err)
+	}
+	if network.Converged() {
+		t.Fatal("partitioned nodes have converged")
+	}
+	height, safeboxHash := network.Node(2).State()
+
+	if err := network.Heal(); err != nil {
+		t.Fatal(err)
+	}
+	if err := network.WaitConverged(timeout); err != nil {
+		t.Fatal(err)
+	}
+	if convergedHeight, convergedHash := network.Node(0).State(); convergedHeight != height || !bytes.Equal(convergedHash, safeboxHash) {
+		t.Fatalf("the heavier chain hasn't won, height %d", convergedHeight)
+	}
+}
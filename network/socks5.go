@@ -0,0 +1,238 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package network
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+var (
+	ErrProxyUnsupported    = errors.New("Unsupported proxy scheme, only socks5 is supported")
+	ErrProxyAuthentication = errors.New("Proxy authentication failed")
+)
+
+const (
+	socks5Version        = 0x05
+	socks5NoAuth         = 0x00
+	socks5UserPass       = 0x02
+	socks5NoAcceptable   = 0xFF
+	socks5UserPassV1     = 0x01
+	socks5Connect        = 0x01
+	socks5AddressIPv4    = 0x01
+	socks5AddressDomain  = 0x03
+	socks5AddressIPv6    = 0x04
+	socks5ReplySucceeded = 0x00
+)
+
+type dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// socks5Dialer connects through the SOCKS5 proxy, host names are resolved by the proxy
+type socks5Dialer struct {
+	proxy    string
+	username string
+	password string
+	timeout  time.Duration
+}
+
+// proxiedConn reports the proxied destination instead of the proxy as the remote address
+type proxiedConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (this *proxiedConn) RemoteAddr() net.Addr {
+	return this.remote
+}
+
+type hostAddr string
+
+func (hostAddr) Network() string {
+	return "tcp"
+}
+
+func (this hostAddr) String() string {
+	return string(this)
+}
+
+// newDialer returns the direct dialer for an empty proxy, socks5://[user:password@]host:port otherwise
+func newDialer(proxy string, timeout time.Duration) (dialer, error) {
+	if proxy == "" {
+		return &net.Dialer{Timeout: timeout}, nil
+	}
+
+	parsed, err := url.Parse(proxy)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid proxy address %s: %v", proxy, err)
+	}
+	if parsed.Scheme != "socks5" {
+		return nil, ErrProxyUnsupported
+	}
+	if parsed.Port() == "" {
+		return nil, fmt.Errorf("Proxy port is not specified %s", proxy)
+	}
+
+	result := &socks5Dialer{
+		proxy:   parsed.Host,
+		timeout: timeout,
+	}
+	if parsed.User != nil {
+		result.username = parsed.User.Username()
+		result.password, _ = parsed.User.Password()
+	}
+	return result, nil
+}
+
+func (this *socks5Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid port %s", portString)
+	}
+
+	d := net.Dialer{Timeout: this.timeout}
+	conn, err := d.DialContext(ctx, network, this.proxy)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to proxy %s: %v", this.proxy, err)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else if this.timeout != 0 {
+		conn.SetDeadline(time.Now().Add(this.timeout))
+	}
+	if err := this.handshake(conn, host, uint16(port)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	var remote net.Addr = hostAddr(address)
+	if ip := net.ParseIP(host); ip != nil {
+		remote = &net.TCPAddr{IP: ip, Port: int(port)}
+	}
+	return &proxiedConn{Conn: conn, remote: remote}, nil
+}
+
+func (this *socks5Dialer) handshake(conn net.Conn, host string, port uint16) error {
+	methods := []byte{socks5NoAuth}
+	if this.username != "" {
+		methods = []byte{socks5UserPass}
+	}
+	if _, err := conn.Write(append([]byte{socks5Version, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != socks5Version {
+		return fmt.Errorf("Unexpected proxy version %d", reply[0])
+	}
+	switch reply[1] {
+	case socks5NoAuth:
+	case socks5UserPass:
+		if err := this.authenticate(conn); err != nil {
+			return err
+		}
+	case socks5NoAcceptable:
+		return ErrProxyAuthentication
+	default:
+		return fmt.Errorf("Unsupported proxy authentication method %d", reply[1])
+	}
+
+	request := []byte{socks5Version, socks5Connect, 0}
+	if ip := net.ParseIP(host); ip != nil {
+		if ipv4 := ip.To4(); ipv4 != nil {
+			request = append(append(request, socks5AddressIPv4), ipv4...)
+		} else {
+			request = append(append(request, socks5AddressIPv6), ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return fmt.Errorf("Host name is too long %s", host)
+		}
+		request = append(append(request, socks5AddressDomain, byte(len(host))), host...)
+	}
+	request = append(request, 0, 0)
+	binary.BigEndian.PutUint16(request[len(request)-2:], port)
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[1] != socks5ReplySucceeded {
+		return fmt.Errorf("Proxy failed to connect to %s, reply code %d", net.JoinHostPort(host, strconv.Itoa(int(port))), header[1])
+	}
+
+	var length int
+	switch header[3] {
+	case socks5AddressIPv4:
+		length = net.IPv4len
+	case socks5AddressIPv6:
+		length = net.IPv6len
+	case socks5AddressDomain:
+		size := make([]byte, 1)
+		if _, err := io.ReadFull(conn, size); err != nil {
+			return err
+		}
+		length = int(size[0])
+	default:
+		return fmt.Errorf("Unsupported proxy address type %d", header[3])
+	}
+	_, err := io.ReadFull(conn, make([]byte, length+2))
+	return err
+}
+
+func (this *socks5Dialer) authenticate(conn net.Conn) error {
+	if len(this.username) > 255 || len(this.password) > 255 {
+		return errors.New("Proxy credentials are too long")
+	}
+	request := append([]byte{socks5UserPassV1, byte(len(this.username))}, this.username...)
+	request = append(append(request, byte(len(this.password))), this.password...)
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] != 0 {
+		return ErrProxyAuthentication
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+/*
+PASL - Personalized Accounts & Secure Ledger
+
+Copyright (C) 2018 PASL Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package network
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// serveSocks5 accepts a single user/password authenticated CONNECT request and echoes the tunnelled data
+func serveSocks5(t *testing.T, l net.Listener, requested chan<- []byte) {
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	greeting := make([]byte, 3)
+	if _, err := io.ReadFull(conn, greeting); err != nil || !bytes.Equal(greeting, []byte{5, 1, socks5UserPass}) {
+		t.Errorf("unexpected greeting %v %v", greeting, err)
+		return
+	}
+	conn.Write([]byte{5, socks5UserPass})
+
+	auth := make([]byte, 13)
+	if _, err := io.ReadFull(conn, auth); err != nil || !bytes.Equal(auth, append([]byte{1, 4}, append([]byte("user"), append([]byte{6}, "secret"...)...)...)) {
+		t.Errorf("unexpected credentials %v %v", auth, err)
+		return
+	}
+	conn.Write([]byte{1, 0})
+
+	request := make([]byte, 5)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return
+	}
+	host := make([]byte, int(request[4])+2)
+	if _, err := io.ReadFull(conn, host); err != nil {
+		return
+	}
+	requested <- append(request, host...)
+	conn.Write([]byte{5, socks5ReplySucceeded, 0, socks5AddressIPv4, 127, 0, 0, 1, 0, 0})
+
+	io.Copy(conn, conn)
+}
+
+func TestSocks5Dialer(t *testing.T) {
+	if _, err := newDialer("http://127.0.0.1:8080", time.Second); err != ErrProxyUnsupported {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	requested := make(chan []byte, 1)
+	go serveSocks5(t, l, requested)
+
+	d, err := newDialer("socks5://user:secret@"+l.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := d.DialContext(context.Background(), "tcp", "example.com:4004")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	expected := append(append([]byte{5, socks5Connect, 0, socks5AddressDomain, 11}, "example.com"...), 0x0f, 0xa4)
+	if request := <-requested; !bytes.Equal(request, expected) {
+		t.Fatalf("unexpected request %v", request)
+	}
+	if conn.RemoteAddr().String() != "example.com:4004" {
+		t.Fatalf("unexpected remote address %s", conn.RemoteAddr().String())
+	}
+
+	conn.Write([]byte("ping"))
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != "ping" {
+		t.Fatalf("unexpected reply %s %v", reply, err)
+	}
+}
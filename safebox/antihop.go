@@ -50,7 +50,9 @@ func (this *antiHopDiff) GetNextTarget(currentTarget common.TargetBase, getLastT
 		return currentTarget.GetCompact()
 	}
 
-	median := int64((timestamps[0] - timestamps[len(timestamps)-1]) / utils.MinUint32(defaults.DifficultyBlocks, uint32(len(timestamps)-1)))
+	// block times aren't monotonic under the median time rule, a span going backwards counts as zero
+	oldest := timestamps[len(timestamps)-1]
+	median := int64((utils.MaxUint32(timestamps[0], oldest) - oldest) / utils.MinUint32(defaults.DifficultyBlocks, uint32(len(timestamps)-1)))
 
 	multiplier1 := utils.MaxInt64(0, 4-(median/50))
 	multiplier1 = multiplier1 * multiplier1 * multiplier1
@@ -150,6 +150,30 @@ func NewBlock(meta *BlockMetadata) (BlockBase, error) {
 	return block, nil
 }
 
+// NewBlockFromHeader builds a block without operations, keeping the header operations hash and fee so the POW could be checked
+func NewBlockFromHeader(header *SerializedBlockHeader) (BlockBase, error) {
+	if len(header.OperationsHash) != sha256.Size {
+		return nil, fmt.Errorf("invalid operations hash length %d", len(header.OperationsHash))
+	}
+
+	block, err := NewBlock(&BlockMetadata{
+		Index:           header.Index,
+		Miner:           header.Miner,
+		Version:         header.Version,
+		Timestamp:       header.Time,
+		Target:          header.Target,
+		Nonce:           header.Nonce,
+		Payload:         header.Payload,
+		PrevSafeBoxHash: header.PrevSafeboxHash,
+	})
+	if err != nil {
+		return nil, err
+	}
+	copy(block.(*Block).OperationsHash[:], header.OperationsHash)
+	block.(*Block).Fee = header.Fee
+	return block, nil
+}
+
 func (block *Block) GetAccountsSerialized() []accounter.AccountHashBuffer {
 	result := make([]accounter.AccountHashBuffer, len(block.Accounts))
 	for i := 0; i < len(result); i++ {
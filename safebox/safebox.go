@@ -20,6 +20,7 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package safebox
 
 import (
+	"context"
 	"errors"
 	"math/big"
 	"sync"
@@ -49,12 +50,16 @@ type SafeboxBase interface {
 	Merge()
 	Rollback()
 	GetUpdatedPacks() []uint32
+	TakeUndo() ([]byte, error)
+	Undo(index uint32, undo []byte) error
 	ProcessOperations(miner *crypto.Public, timestamp uint32, operations []tx.CommonOperation, difficulty *big.Int) (map[*accounter.Account]map[uint32]uint32, error)
 	GetLastTimestamps(count uint32) (timestamps []uint32)
 	GetHashrate(blockIndex, blocksCount uint32) uint64
 	GetAccount(number uint32) *accounter.Account
+	GetAccountsByPublicKey(ctx context.Context, public *crypto.Public) ([]uint32, error)
 	GetAccountPackSerialized(index uint32) ([]byte, error)
 	SerializeAccounter() ([]byte, error)
+	SerializeAccounterPacks(indexes []uint32) ([]byte, error)
 }
 
 func NewSafebox(accounter *accounter.Accounter) SafeboxBase {
@@ -164,6 +169,25 @@ func (s *Safebox) GetUpdatedPacks() []uint32 {
 	return s.accounter.GetUpdatedPacks()
 }
 
+func (s *Safebox) TakeUndo() ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.accounter.TakeJournal()
+}
+
+func (s *Safebox) Undo(index uint32, undo []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.accounter.Undo(index, undo); err != nil {
+		return err
+	}
+	height, safeboxHash, _ := s.accounter.GetState()
+	s.fork = GetActiveFork(height, safeboxHash)
+	return nil
+}
+
 func (this *Safebox) processOperationsUnsafe(miner *crypto.Public, timestamp uint32, operations []tx.CommonOperation, difficulty *big.Int) (map[*accounter.Account]map[uint32]uint32, error) {
 	if err := this.validateSignatures(operations); err != nil {
 		return nil, err
@@ -179,6 +203,7 @@ func (this *Safebox) processOperationsUnsafe(miner *crypto.Public, timestamp uin
 	}
 
 	if miner != nil {
+		this.accounter.StartJournal()
 		reward := getReward(blockIndex + 1)
 		for index := range operations {
 			reward += operations[index].GetFee()
@@ -261,6 +286,13 @@ func (this *Safebox) GetAccount(number uint32) *accounter.Account {
 	return this.accounter.GetAccount(number)
 }
 
+func (this *Safebox) GetAccountsByPublicKey(ctx context.Context, public *crypto.Public) ([]uint32, error) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	return this.accounter.GetAccountsByPublicKey(ctx, public)
+}
+
 func getReward(index uint32) uint64 {
 	magnitude := uint64(index / defaults.RewardDecreaseBlocks)
 	reward := defaults.GenesisReward
@@ -283,3 +315,10 @@ func (this *Safebox) SerializeAccounter() ([]byte, error) {
 
 	return this.accounter.Marshal()
 }
+
+func (s *Safebox) SerializeAccounterPacks(indexes []uint32) ([]byte, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.accounter.MarshalPacks(indexes)
+}
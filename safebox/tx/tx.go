@@ -276,6 +276,9 @@ func (this *OperationsNetwork) Deserialize(r io.Reader) error {
 	if err := utils.Deserialize(&count, r); err != nil {
 		return err
 	}
+	if err := utils.CheckLength(r, count, utils.MaxSliceLength); err != nil {
+		return err
+	}
 
 	this.Operations = make([]CommonOperation, count)
 
@@ -24,7 +24,6 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"os"
 
 	"github.com/boltdb/bolt"
 	"github.com/pasl-project/pasl/utils"
@@ -39,9 +38,12 @@ const (
 	tableBlock      = "block"
 	tablePack       = "pack"
 	tablePeers      = "peers"
+	tableBans       = "bans"
 	tableSnapshots  = "snapshots"
+	tableDeltas     = "snapshotDeltas"
 	tableTx         = "tx"
 	tableTxMetadata = "txMetadata"
+	tableUndo       = "undo"
 )
 
 var (
@@ -55,20 +57,30 @@ type StorageWritable interface {
 	StoreAccountOperation(context interface{}, number uint32, internalOperationId uint32, txId uint64) error
 	StoreAccountPack(context interface{}, index uint32, data []byte) error
 	StorePeers(context interface{}, peers func(func(address []byte, data []byte))) error
+	StoreBans(context interface{}, bans func(func(address []byte, data []byte))) error
 
 	StoreSnapshot(context interface{}, number uint32, serialized []byte) error
+	StoreSnapshotDelta(context interface{}, height uint32, base uint32, serialized []byte) error
 	DropSnapshot(context interface{}, height uint32) error
+
+	StoreUndo(context interface{}, index uint32, serialized []byte) error
+	DropUndo(context interface{}, index uint32) error
+	Truncate(context interface{}, height uint32) error
 }
 
 type Storage interface {
 	Load(callback func(number uint32, serialized []byte) error) (height uint32, err error)
-	LoadBlocks(toHeight *uint32, callback func(index uint32, serialized []byte) error) error
+	LoadBlocks(fromHeight uint32, toHeight *uint32, callback func(index uint32, serialized []byte) error) error
 
 	ListSnapshots() []uint32
+	ListSnapshotDeltas() map[uint32]uint32
 	LoadSnapshot(height uint32) (serialized []byte)
+	LoadSnapshotDelta(height uint32) (base uint32, serialized []byte)
+	LoadUndo(index uint32) (serialized []byte)
 
 	WithWritable(fn func(storageWritable StorageWritable, context interface{}) error) error
 	LoadPeers(peers func(address []byte, data []byte)) error
+	LoadBans(bans func(address []byte, data []byte)) error
 	GetBlock(index uint32) (data []byte, err error)
 	GetTxMetadata(txRipemd160Hash [20]byte) (data []byte, err error)
 	GetAccountTxesData(number uint32, offset uint32, limit uint32) (txData map[uint32][]byte, err error)
@@ -82,8 +94,6 @@ type StorageBoltDb struct {
 }
 
 func WithStorage(filename *string, fn func(storage Storage) error) error {
-	_, err := os.Stat(*filename)
-	firstRun := os.IsNotExist(err)
 	db, err := bolt.Open(*filename, 0600, nil)
 	if err != nil {
 		return err
@@ -94,10 +104,8 @@ func WithStorage(filename *string, fn func(storage Storage) error) error {
 		db: db,
 	}
 
-	if firstRun {
-		if err = storage.createTables(); err != nil {
-			return fmt.Errorf("Failed to initializ db %v", err)
-		}
+	if err = storage.createTables(); err != nil {
+		return fmt.Errorf("Failed to initializ db %v", err)
 	}
 
 	return fn(storage)
@@ -117,15 +125,24 @@ func (this *StorageBoltDb) createTables() error {
 		if _, err := tx.CreateBucketIfNotExists([]byte(tablePeers)); err != nil {
 			return err
 		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(tableBans)); err != nil {
+			return err
+		}
 		if _, err := tx.CreateBucketIfNotExists([]byte(tableSnapshots)); err != nil {
 			return err
 		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(tableDeltas)); err != nil {
+			return err
+		}
 		if _, err := tx.CreateBucketIfNotExists([]byte(tableTx)); err != nil {
 			return err
 		}
 		if _, err := tx.CreateBucketIfNotExists([]byte(tableTxMetadata)); err != nil {
 			return err
 		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(tableUndo)); err != nil {
+			return err
+		}
 		return nil
 	})
 }
@@ -145,7 +162,11 @@ func (this *StorageBoltDb) Load(callback func(index uint32, serialized []byte) e
 		if bucket = tx.Bucket([]byte(tableBlock)); bucket == nil {
 			return fmt.Errorf("Table doesn't exist %s", tableBlock)
 		}
-		height = uint32(bucket.Stats().KeyN)
+		// blocks preceding the imported safebox are missing, the height is derived from the top block
+		height = 0
+		if key, _ := bucket.Cursor().Last(); key != nil {
+			height = binary.BigEndian.Uint32(key) + 1
+		}
 
 		if bucket = tx.Bucket([]byte(tablePack)); bucket == nil {
 			return fmt.Errorf("Table doesn't exist %s", tablePack)
@@ -176,7 +197,7 @@ func (this *StorageBoltDb) Load(callback func(index uint32, serialized []byte) e
 	return
 }
 
-func (this *StorageBoltDb) LoadBlocks(toHeight *uint32, callback func(index uint32, serialized []byte) error) error {
+func (this *StorageBoltDb) LoadBlocks(fromHeight uint32, toHeight *uint32, callback func(index uint32, serialized []byte) error) error {
 	return this.db.View(func(tx *bolt.Tx) error {
 		var bucket *bolt.Bucket
 
@@ -184,16 +205,22 @@ func (this *StorageBoltDb) LoadBlocks(toHeight *uint32, callback func(index uint
 			return fmt.Errorf("Table doesn't exist %s", tableBlock)
 		}
 
+		// blocks preceding the imported safebox are missing, the height is derived from the top block
 		var height uint32
 		if toHeight == nil {
-			height = uint32(bucket.Stats().KeyN)
+			if key, _ := bucket.Cursor().Last(); key != nil {
+				height = binary.BigEndian.Uint32(key) + 1
+			}
 		} else {
 			height = *toHeight
 		}
 
+		var from [4]byte
+		binary.BigEndian.PutUint32(from[:], fromHeight)
+
 		cursor := bucket.Cursor()
-		var total uint32 = 0
-		for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+		var total uint32 = fromHeight
+		for key, value := cursor.Seek(from[:]); key != nil; key, value = cursor.Next() {
 			index := binary.BigEndian.Uint32(key)
 			if index >= height {
 				break
@@ -301,10 +328,16 @@ func (this *StorageBoltDb) StoreAccountPack(context interface{}, index uint32, d
 	return bucket.Put(buffer[:], data)
 }
 
+// StorePeers replaces all the stored peers, the evicted ones are dropped
 func (this *StorageBoltDb) StorePeers(context interface{}, peers func(func(address []byte, data []byte))) (err error) {
 	tx := context.(*bolt.Tx)
 
-	bucket, err := this.getTable(tx, tablePeers)
+	if tx.Bucket([]byte(tablePeers)) != nil {
+		if err = tx.DeleteBucket([]byte(tablePeers)); err != nil {
+			return err
+		}
+	}
+	bucket, err := tx.CreateBucket([]byte(tablePeers))
 	if err != nil {
 		return err
 	}
@@ -335,17 +368,62 @@ func (this *StorageBoltDb) LoadPeers(peers func(address []byte, data []byte)) er
 	})
 }
 
-func (this *StorageBoltDb) DropSnapshot(context interface{}, height uint32) error {
+// StoreBans replaces all the stored bans
+func (this *StorageBoltDb) StoreBans(context interface{}, bans func(func(address []byte, data []byte))) (err error) {
 	tx := context.(*bolt.Tx)
 
-	bucket, err := this.getTable(tx, tableSnapshots)
+	if tx.Bucket([]byte(tableBans)) != nil {
+		if err = tx.DeleteBucket([]byte(tableBans)); err != nil {
+			return err
+		}
+	}
+	bucket, err := tx.CreateBucket([]byte(tableBans))
 	if err != nil {
 		return err
 	}
 
+	bans(func(address []byte, data []byte) {
+		if err != nil {
+			return
+		}
+		err = bucket.Put(address, data)
+	})
+
+	return err
+}
+
+func (this *StorageBoltDb) LoadBans(bans func(address []byte, data []byte)) error {
+	return this.db.View(func(tx *bolt.Tx) error {
+		var bucket *bolt.Bucket
+
+		if bucket = tx.Bucket([]byte(tableBans)); bucket == nil {
+			return nil
+		}
+
+		c := bucket.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			bans(k, v)
+		}
+		return nil
+	})
+}
+
+func (this *StorageBoltDb) DropSnapshot(context interface{}, height uint32) error {
+	tx := context.(*bolt.Tx)
+
 	var buffer [4]byte
 	binary.BigEndian.PutUint32(buffer[:], height)
-	return bucket.Delete(buffer[:])
+
+	for _, table := range []string{tableSnapshots, tableDeltas} {
+		bucket, err := this.getTable(tx, table)
+		if err != nil {
+			return err
+		}
+		if err := bucket.Delete(buffer[:]); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (this *StorageBoltDb) ListSnapshots() []uint32 {
@@ -406,6 +484,149 @@ func (this *StorageBoltDb) StoreSnapshot(context interface{}, height uint32, ser
 	return bucket.Put(buffer[:], serialized)
 }
 
+func (this *StorageBoltDb) StoreSnapshotDelta(context interface{}, height uint32, base uint32, serialized []byte) error {
+	tx := context.(*bolt.Tx)
+
+	bucket, err := this.getTable(tx, tableDeltas)
+	if err != nil {
+		return err
+	}
+
+	var buffer [4]byte
+	binary.BigEndian.PutUint32(buffer[:], height)
+
+	data := make([]byte, 4+len(serialized))
+	binary.BigEndian.PutUint32(data[:4], base)
+	copy(data[4:], serialized)
+	return bucket.Put(buffer[:], data)
+}
+
+func (this *StorageBoltDb) ListSnapshotDeltas() map[uint32]uint32 {
+	result := make(map[uint32]uint32)
+
+	if this.db.View(func(tx *bolt.Tx) error {
+		var bucket *bolt.Bucket
+
+		if bucket = tx.Bucket([]byte(tableDeltas)); bucket == nil {
+			return nil
+		}
+
+		cursor := bucket.Cursor()
+		for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+			if len(value) < 4 {
+				continue
+			}
+			result[binary.BigEndian.Uint32(key)] = binary.BigEndian.Uint32(value[:4])
+		}
+
+		return nil
+	}) != nil {
+		return nil
+	}
+
+	return result
+}
+
+func (this *StorageBoltDb) LoadSnapshotDelta(height uint32) (base uint32, serialized []byte) {
+	if this.db.View(func(tx *bolt.Tx) error {
+		var bucket *bolt.Bucket
+
+		if bucket = tx.Bucket([]byte(tableDeltas)); bucket == nil {
+			return nil
+		}
+
+		var buffer [4]byte
+		binary.BigEndian.PutUint32(buffer[:], height)
+
+		if data := bucket.Get(buffer[:]); len(data) >= 4 {
+			base = binary.BigEndian.Uint32(data[:4])
+			serialized = make([]byte, len(data)-4)
+			copy(serialized, data[4:])
+		}
+
+		return nil
+	}) != nil {
+		return 0, nil
+	}
+	return base, serialized
+}
+
+func (this *StorageBoltDb) StoreUndo(context interface{}, index uint32, serialized []byte) error {
+	tx := context.(*bolt.Tx)
+
+	bucket, err := this.getTable(tx, tableUndo)
+	if err != nil {
+		return err
+	}
+
+	var buffer [4]byte
+	binary.BigEndian.PutUint32(buffer[:], index)
+
+	dataCopy := make([]byte, len(serialized))
+	copy(dataCopy, serialized)
+	return bucket.Put(buffer[:], dataCopy)
+}
+
+func (this *StorageBoltDb) DropUndo(context interface{}, index uint32) error {
+	tx := context.(*bolt.Tx)
+
+	bucket, err := this.getTable(tx, tableUndo)
+	if err != nil {
+		return err
+	}
+
+	var buffer [4]byte
+	binary.BigEndian.PutUint32(buffer[:], index)
+	return bucket.Delete(buffer[:])
+}
+
+func (this *StorageBoltDb) LoadUndo(index uint32) (serialized []byte) {
+	if this.db.View(func(tx *bolt.Tx) error {
+		var bucket *bolt.Bucket
+
+		if bucket = tx.Bucket([]byte(tableUndo)); bucket == nil {
+			return nil
+		}
+
+		var buffer [4]byte
+		binary.BigEndian.PutUint32(buffer[:], index)
+
+		if data := bucket.Get(buffer[:]); data != nil {
+			serialized = make([]byte, len(data))
+			copy(serialized, data)
+		}
+
+		return nil
+	}) != nil {
+		return nil
+	}
+	return serialized
+}
+
+// Truncate drops blocks, account packs and undo records at and above the specified height
+func (this *StorageBoltDb) Truncate(context interface{}, height uint32) error {
+	tx := context.(*bolt.Tx)
+
+	var from [4]byte
+	binary.BigEndian.PutUint32(from[:], height)
+
+	for _, table := range []string{tableBlock, tablePack, tableUndo} {
+		bucket, err := this.getTable(tx, table)
+		if err != nil {
+			return err
+		}
+
+		cursor := bucket.Cursor()
+		for key, _ := cursor.Seek(from[:]); key != nil; key, _ = cursor.Seek(from[:]) {
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
 func (this *StorageBoltDb) GetBlock(index uint32) (data []byte, err error) {
 	err = this.db.View(func(tx *bolt.Tx) error {
 		var bucket *bolt.Bucket
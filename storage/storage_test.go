@@ -84,6 +84,14 @@ func TestWriteRead(t *testing.T) {
 				t.Fatal(err)
 			}
 
+			if err := s.StoreSnapshotDelta(ctx, snapshotIndex+1, snapshotIndex, snapshotData); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := s.StoreUndo(ctx, 0, snapshotData); err != nil {
+				t.Fatal(err)
+			}
+
 			return nil
 		}); err != nil {
 			t.Fatal(err)
@@ -135,16 +143,79 @@ func TestWriteRead(t *testing.T) {
 			if !bytes.Equal(s.LoadSnapshot(snapshots[0]), snapshotData) {
 				t.Fatalf("invalid snapshot data")
 			}
+			deltas := s.ListSnapshotDeltas()
+			if base, ok := deltas[snapshotIndex+1]; !ok || base != snapshotIndex {
+				t.Fatalf("invalid snapshot delta base")
+			}
+			if base, delta := s.LoadSnapshotDelta(snapshotIndex + 1); base != snapshotIndex || !bytes.Equal(delta, snapshotData) {
+				t.Fatalf("invalid snapshot delta data")
+			}
 			if err := s.WithWritable(func(s StorageWritable, ctx interface{}) error {
-				return s.DropSnapshot(ctx, snapshots[0])
+				if err := s.DropSnapshot(ctx, snapshots[0]); err != nil {
+					return err
+				}
+				return s.DropSnapshot(ctx, snapshotIndex+1)
 			}); err != nil {
 				t.Fatal(err)
 			}
-			if len(s.ListSnapshots()) != 0 {
+			if len(s.ListSnapshots()) != 0 || len(s.ListSnapshotDeltas()) != 0 {
 				t.Fatalf("failed to drop snapshot")
 			}
 		}
 
+		{
+			if !bytes.Equal(s.LoadUndo(0), snapshotData) {
+				t.Fatalf("invalid undo data")
+			}
+			if err := s.WithWritable(func(s StorageWritable, ctx interface{}) error {
+				return s.Truncate(ctx, 0)
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if s.LoadUndo(0) != nil {
+				t.Fatalf("failed to truncate undo data")
+			}
+			if _, err := s.GetBlock(0); err == nil {
+				t.Fatalf("failed to truncate blocks")
+			}
+		}
+
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadBlocksAfterImport(t *testing.T) {
+	dbFileName := "test_import.db"
+	defer os.Remove(dbFileName)
+
+	if err := WithStorage(&dbFileName, func(s Storage) error {
+		// the blocks preceding the imported safebox are missing
+		if err := s.WithWritable(func(s StorageWritable, ctx interface{}) error {
+			for index := uint32(5); index < 10; index++ {
+				if err := s.StoreBlock(ctx, index, []byte{byte(index)}); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		loaded := make([]uint32, 0)
+		if err := s.LoadBlocks(7, nil, func(index uint32, serialized []byte) error {
+			if !bytes.Equal(serialized, []byte{byte(index)}) {
+				t.Fatalf("invalid block %d data", index)
+			}
+			loaded = append(loaded, index)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if len(loaded) != 3 || loaded[0] != 7 || loaded[2] != 9 {
+			t.Fatalf("unexpected blocks loaded %v", loaded)
+		}
 		return nil
 	}); err != nil {
 		t.Fatal(err)
@@ -23,11 +23,32 @@ import (
 	"bytes"
 	"container/list"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"reflect"
 )
 
+// MaxSliceLength limits the number of elements of a decoded slice
+const MaxSliceLength uint32 = 1 << 20
+
+var ErrLengthExceeded = errors.New("Length prefix exceeds the limit")
+
+type lengthReader interface {
+	Len() int
+}
+
+// CheckLength rejects length prefixes above the limit, readers aware of their size also reject prefixes above the remaining data length
+func CheckLength(r io.Reader, length uint32, limit uint32) error {
+	if length > limit {
+		return ErrLengthExceeded
+	}
+	if reader, ok := r.(lengthReader); ok && uint64(length) > uint64(reader.Len()) {
+		return ErrLengthExceeded
+	}
+	return nil
+}
+
 type Serializable interface {
 	Serialize(io.Writer) error
 	Deserialize(io.Reader) error
@@ -57,12 +78,15 @@ func SerializeBytes(data []byte) []byte {
 }
 
 func DeserializeBytes(reader io.Reader) (data []byte, err error) {
-	var size int16
+	var size uint16
 	if err = binary.Read(reader, binary.LittleEndian, &size); err != nil {
 		return
 	}
+	if err = CheckLength(reader, uint32(size), uint32(size)); err != nil {
+		return nil, err
+	}
 	data = make([]byte, size)
-	if err = binary.Read(reader, binary.LittleEndian, &data); err != nil {
+	if _, err = io.ReadFull(reader, data); err != nil {
 		return nil, err
 	}
 	return
@@ -284,6 +308,9 @@ func Deserialize(struc interface{}, r io.Reader) error {
 		case reflect.String:
 			var len uint16
 			binary.Read(r, binary.LittleEndian, &len)
+			if err := CheckLength(r, uint32(len), uint32(len)); err != nil {
+				return err
+			}
 			var str []byte = make([]byte, len)
 			if _, err := io.ReadFull(r, str); err != nil {
 				return fmt.Errorf("insufficient data %v", err)
@@ -294,6 +321,9 @@ func Deserialize(struc interface{}, r io.Reader) error {
 			case reflect.Uint8:
 				var len uint16
 				binary.Read(r, binary.LittleEndian, &len)
+				if err := CheckLength(r, uint32(len), uint32(len)); err != nil {
+					return err
+				}
 				data := make([]byte, len)
 				if _, err := io.ReadFull(r, data); err != nil {
 					return fmt.Errorf("insufficient data %v", err)
@@ -302,6 +332,9 @@ func Deserialize(struc interface{}, r io.Reader) error {
 			default:
 				var len uint32
 				binary.Read(r, binary.LittleEndian, &len)
+				if err := CheckLength(r, len, MaxSliceLength); err != nil {
+					return err
+				}
 				value.Set(reflect.MakeSlice(value.Type(), int(len), int(len)))
 			}
 		case reflect.Array: